@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Handler para /api/inventario/alertas (GET). Lista los artículos por debajo
+// de su stock mínimo con la cantidad sugerida para reponer. Con
+// ?historial=true devuelve en cambio las alertas que generaron los movimientos
+// al cruzar un umbral (?pendientes=true para sólo las no atendidas).
+func handleAlertasStock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	if r.URL.Query().Get("historial") == "true" {
+		query := &supabaseClient.DB.From("alertas_stock").Select("*").OrderBy("fecha", "desc").FilterRequestBuilder
+		if r.URL.Query().Get("pendientes") == "true" {
+			query = query.Eq("atendida", "false")
+		}
+
+		var alertas []AlertaStock
+		if err := query.Execute(&alertas); err != nil {
+			http.Error(w, `{"error":"Error al obtener alertas: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if alertas == nil {
+			alertas = []AlertaStock{}
+		}
+
+		json.NewEncoder(w).Encode(alertas)
+		return
+	}
+
+	var articulos []ArticuloBajoMinimo
+	err := supabaseClient.DB.
+		From("articulos_bajo_minimo").
+		Select("*").
+		OrderBy("nombre", "asc").
+		Execute(&articulos)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener artículos bajo mínimo: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if articulos == nil {
+		articulos = []ArticuloBajoMinimo{}
+	}
+
+	json.NewEncoder(w).Encode(articulos)
+}
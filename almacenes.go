@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"fmt"
+	"net/http"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// almacenPredeterminado devuelve el id del almacén que usan los movimientos,
+// ventas y compras que no indican almacén.
+func almacenPredeterminado() (int, error) {
+	var almacenes []Almacen
+	err := supabaseClient.DB.From("almacenes").Select("*").Eq("predeterminado", "true").Execute(&almacenes)
+	if err != nil {
+		return 0, err
+	}
+	if len(almacenes) == 0 {
+		return 0, fmt.Errorf("no hay almacén predeterminado")
+	}
+	return almacenes[0].ID, nil
+}
+
+// Handler para /api/almacenes (GET, POST)
+func handleAlmacenes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		var almacenes []Almacen
+		if err := supabaseClient.DB.From("almacenes").Select("*").OrderBy("nombre", "asc").Execute(&almacenes); err != nil {
+			http.Error(w, `{"error":"Error al obtener almacenes: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if almacenes == nil {
+			almacenes = []Almacen{}
+		}
+
+		json.NewEncoder(w).Encode(almacenes)
+		return
+	}
+
+	// POST: crear almacén
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload Almacen
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Nombre == "" {
+		http.Error(w, `{"error":"Debe indicar el nombre del almacén"}`, http.StatusBadRequest)
+		return
+	}
+
+	var results []Almacen
+	err := supabaseClient.DB.From("almacenes").Insert(map[string]interface{}{
+		"nombre":      payload.Nombre,
+		"descripcion": payload.Descripcion,
+	}).Execute(&results)
+	if err != nil {
+		http.Error(w, `{"error":"Error al crear almacén: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if len(results) > 0 {
+		json.NewEncoder(w).Encode(results[0])
+	} else {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// Handler para /api/inventario/transferir (POST). Saca la cantidad de un
+// almacén y la ingresa en otro en una sola transacción, enlazando ambos
+// movimientos a la transferencia.
+func handleTransferirInventario(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		ArticuloID       int      `json:"articulo_id"`
+		AlmacenOrigenID  int      `json:"almacen_origen_id"`
+		AlmacenDestinoID int      `json:"almacen_destino_id"`
+		Cantidad         float64  `json:"cantidad"`
+		Motivo           string   `json:"motivo"`
+		Series           []string `json:"series,omitempty"` // para artículos serializados
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"Error al decodificar JSON: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.ArticuloID <= 0 || payload.Cantidad <= 0 || payload.AlmacenOrigenID <= 0 || payload.AlmacenDestinoID <= 0 {
+		http.Error(w, `{"error":"Datos de la transferencia inválidos"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.AlmacenOrigenID == payload.AlmacenDestinoID {
+		http.Error(w, `{"error":"El almacén de origen y el de destino deben ser distintos"}`, http.StatusBadRequest)
+		return
+	}
+
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	tipoSalida, existeSalida := tipos["transferencia_salida"]
+	tipoEntrada, existeEntrada := tipos["transferencia_entrada"]
+	for _, v := range []struct {
+		tipo   TipoMovimiento
+		existe bool
+	}{{tipoSalida, existeSalida}, {tipoEntrada, existeEntrada}} {
+		if mensaje, status := validarTipoMovimiento(v.tipo, v.existe, payload.Motivo, claims); mensaje != "" {
+			http.Error(w, `{"error":"`+mensaje+`"}`, status)
+			return
+		}
+	}
+
+	movimiento := func(tipo TipoMovimiento) map[string]interface{} {
+		m := map[string]interface{}{
+			"articulo_id":     payload.ArticuloID,
+			"tipo_movimiento": tipo.Clave,
+			"cantidad":        payload.Cantidad,
+			"delta":           float64(tipo.Signo) * payload.Cantidad,
+			"motivo":          payload.Motivo,
+			"usuario_nombre":  claims.Email,
+		}
+		if len(payload.Series) > 0 {
+			m["series"] = payload.Series
+		}
+		return m
+	}
+
+	var resultado struct {
+		TransferenciaID int                    `json:"transferencia_id"`
+		Salida          map[string]interface{} `json:"salida"`
+		Entrada         map[string]interface{} `json:"entrada"`
+	}
+	err = supabaseClient.DB.Rpc("transferir_inventario", map[string]interface{}{
+		"p_transferencia": map[string]interface{}{
+			"articulo_id":        payload.ArticuloID,
+			"almacen_origen_id":  payload.AlmacenOrigenID,
+			"almacen_destino_id": payload.AlmacenDestinoID,
+			"cantidad":           payload.Cantidad,
+			"motivo":             payload.Motivo,
+			"usuario_nombre":     claims.Email,
+		},
+		"p_salida":  movimiento(tipoSalida),
+		"p_entrada": movimiento(tipoEntrada),
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":          "Transferencia registrada",
+		"transferencia_id": resultado.TransferenciaID,
+		"articulo_id":      payload.ArticuloID,
+		"origen": map[string]interface{}{
+			"almacen_id":      payload.AlmacenOrigenID,
+			"cantidad_actual": resultado.Salida["cantidad_actual"],
+		},
+		"destino": map[string]interface{}{
+			"almacen_id":      payload.AlmacenDestinoID,
+			"cantidad_actual": resultado.Entrada["cantidad_actual"],
+		},
+	})
+}
+
+// Handler para /api/inventario/ubicacion (PUT). Asigna la ubicación
+// (pasillo, anaquel, nivel) de un artículo en un almacén; las hojas de conteo
+// de ese almacén salen en ese orden. Sin almacen_id se usa el predeterminado
+// y una ubicación vacía la quita.
+func handleUbicacionInventario(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("update") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		ArticuloID int    `json:"articulo_id"`
+		AlmacenID  *int   `json:"almacen_id,omitempty"`
+		Ubicacion  string `json:"ubicacion"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"Error al decodificar JSON: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.ArticuloID <= 0 {
+		http.Error(w, `{"error":"Debe indicar articulo_id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("asignar_ubicacion", map[string]interface{}{
+		"p_articulo_id": payload.ArticuloID,
+		"p_almacen_id":  payload.AlmacenID,
+		"p_ubicacion":   payload.Ubicacion,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(resultado)
+}
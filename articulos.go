@@ -1,13 +1,9 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"equiposmedicos/middleware"
-	"io"
-	"log"
 	"net/http"
-	"os"
 	"strconv"
 	"strings"
 
@@ -143,6 +139,13 @@ func handleAgregarArticulo(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/json")
 
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
 	var nuevo map[string]interface{}
 	err := json.NewDecoder(r.Body).Decode(&nuevo)
 	if err != nil {
@@ -150,52 +153,72 @@ func handleAgregarArticulo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Extraemos inventario inicial y usuario_id del payload si viene
-	cantidadInicial, ok := nuevo["inventario"].(float64)
-	if !ok {
-		cantidadInicial = 0 // default
+	// El inventario inicial (cantidad, almacén, series y lotes) no son
+	// columnas del artículo; se separan para aplicarlos como movimiento.
+	inventario := map[string]interface{}{"cantidad": 0.0}
+	if valor, existe := nuevo["inventario"]; existe && valor != nil {
+		cantidad, ok := valor.(float64)
+		if !ok || cantidad < 0 {
+			http.Error(w, `{"error":"El inventario inicial debe ser un número mayor o igual a cero"}`, http.StatusBadRequest)
+			return
+		}
+		inventario["cantidad"] = cantidad
+	}
+	for _, campo := range []string{"almacen_id", "series", "lote", "caducidad", "lotes"} {
+		if valor, existe := nuevo[campo]; existe {
+			inventario[campo] = valor
+		}
+		delete(nuevo, campo)
 	}
-	nombreUsuario, _ := nuevo["name"].(float64)
 	delete(nuevo, "inventario")
 	delete(nuevo, "name")
 
-	// 1️⃣ Insertar artículo
-	var results []map[string]interface{}
-	err = supabaseClient.DB.From("articulos").Insert(nuevo).Execute(&results)
-	if err != nil || len(results) == 0 {
-		http.Error(w, `{"error":"Error al insertar artículo: `+err.Error()+`"}`, http.StatusInternalServerError)
+	if mensaje := validarNivelesStock(nuevo); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, http.StatusBadRequest)
 		return
 	}
 
-	articuloID := results[0]["id"].(float64) // id del artículo insertado
+	inventario["usuario_nombre"] = claims.Email
 
-	// 2️⃣ Insertar inventario inicial
-	inventario := map[string]interface{}{
-		"articulo_id":     articuloID,
-		"cantidad_actual": cantidadInicial,
-	}
-	err = supabaseClient.DB.From("inventarios").Insert(inventario).Execute(nil)
+	// El artículo y su inventario inicial se crean en la misma transacción;
+	// la existencia entra por aplicar_movimiento como un 'alta'.
+	var articulo map[string]interface{}
+	err = supabaseClient.DB.Rpc("crear_articulo", map[string]interface{}{
+		"p_articulo":   nuevo,
+		"p_inventario": inventario,
+	}).Execute(&articulo)
 	if err != nil {
-		http.Error(w, `{"error":"Error al insertar inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
+		responderErrorRPC(w, err)
 		return
 	}
 
-	// 3️⃣ Registrar movimiento inicial
-	movimiento := map[string]interface{}{
-		"articulo_id":     articuloID,
-		"tipo_movimiento": "alta",
-		"cantidad":        cantidadInicial,
-		"motivo":          "Inventario inicial",
-		"usuario_nombre":  nombreUsuario,
-	}
-	err = supabaseClient.DB.From("movimientos_inventario").Insert(movimiento).Execute(nil)
-	if err != nil {
-		http.Error(w, `{"error":"Error al registrar movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+	// Responder con el artículo creado
+	json.NewEncoder(w).Encode(articulo)
+}
+
+// validarNivelesStock revisa stock_minimo y stock_maximo si vienen en el
+// payload: números no negativos (o null para quitarlos) y mínimo <= máximo.
+// La base vuelve a validar contra el valor guardado cuando llega sólo uno.
+func validarNivelesStock(datos map[string]interface{}) string {
+	niveles := map[string]float64{}
+	for _, campo := range []string{"stock_minimo", "stock_maximo"} {
+		valor, existe := datos[campo]
+		if !existe || valor == nil {
+			continue
+		}
+		numero, ok := valor.(float64)
+		if !ok || numero < 0 {
+			return "El campo " + campo + " debe ser un número mayor o igual a cero"
+		}
+		niveles[campo] = numero
 	}
 
-	// Responder con el artículo creado
-	json.NewEncoder(w).Encode(results[0])
+	minimo, hayMinimo := niveles["stock_minimo"]
+	maximo, hayMaximo := niveles["stock_maximo"]
+	if hayMinimo && hayMaximo && minimo > maximo {
+		return "El stock mínimo no puede ser mayor que el máximo"
+	}
+	return ""
 }
 
 // Handler para /api/articulos/actualizar (PUT)
@@ -230,6 +253,14 @@ func handleActualizarArticulo(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// El costo lo mantiene el motor de costo promedio a partir de los movimientos
+	delete(datos, "costo")
+
+	if mensaje := validarNivelesStock(datos); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, http.StatusBadRequest)
+		return
+	}
+
 	var results []map[string]interface{} // Usamos directamente slice de mapas
 	err = supabaseClient.DB.From("articulos").Update(datos).Eq("id", strconv.Itoa(id)).Execute(&results)
 	if err != nil {
@@ -415,58 +446,16 @@ func handleGenerateCatalogoPDF(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	apiKey := os.Getenv("PDFSHIFT_API_KEY")
-	if apiKey == "" {
-		http.Error(w, "PDFShift API key no configurada", http.StatusInternalServerError)
-		return
-	}
-
-	payload := map[string]interface{}{
+	pdf, err := convertirPDF(map[string]interface{}{
 		"source":    "https://equiposmedicosmty.com/articulos/catalogo",
 		"use_print": true,
 		"delay":     8000, // 🔑 SPA + imágenes
 		"margin":    "10mm",
-	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		http.Error(w, "Error creando payload", http.StatusInternalServerError)
-		return
-	}
-
-	req, err := http.NewRequest(
-		"POST",
-		"https://api.pdfshift.io/v3/convert/pdf",
-		bytes.NewBuffer(body),
-	)
-	if err != nil {
-		http.Error(w, "Error creando request", http.StatusInternalServerError)
-		return
-	}
-
-	// 🔑 AUTENTICACIÓN CORRECTA
-	req.Header.Set("X-API-Key", apiKey)
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	})
 	if err != nil {
-		http.Error(w, "Error llamando PDFShift", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		errorBody, _ := io.ReadAll(resp.Body)
-		log.Println("PDFSHIFT ERROR:", string(errorBody))
-
-		w.WriteHeader(http.StatusInternalServerError)
-		w.Write(errorBody)
-		return
-	}
-
-	w.Header().Set("Content-Type", "application/pdf")
-	w.Header().Set("Content-Disposition", `attachment; filename="catalogo_equipos_medicos.pdf"`)
 
-	io.Copy(w, resp.Body)
+	responderPDF(w, pdf, "catalogo_equipos_medicos.pdf")
 }
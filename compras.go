@@ -26,12 +26,8 @@ func handleRegistrarCompra(w http.ResponseWriter, r *http.Request) {
 	}
 
 	var payload struct {
-		Articulos []struct {
-			ArticuloID     int     `json:"articulo_id"`
-			Cantidad       int     `json:"cantidad"`
-			PrecioUnitario float64 `json:"precio_unitario"`
-		} `json:"articulos"`
-		Notas string `json:"notas,omitempty"`
+		Articulos []CompraDetalle `json:"articulos"`
+		Notas     string          `json:"notas,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -44,32 +40,56 @@ func handleRegistrarCompra(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Insertar compra
-	compra := map[string]interface{}{
-		"notas": payload.Notas,
+	// Validar líneas y calcular el movimiento de inventario de cada una
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
 	}
-	var compraResult []map[string]interface{}
-	if err := supabaseClient.DB.From("compras").Insert(compra).Execute(&compraResult); err != nil || len(compraResult) == 0 {
-		http.Error(w, `{"error":"Error al crear compra: `+err.Error()+`"}`, http.StatusInternalServerError)
+	tipo, ok := tipos["compra"]
+	if !ok {
+		http.Error(w, `{"error":"Tipo de movimiento compra no registrado"}`, http.StatusInternalServerError)
 		return
 	}
-
-	compraID := compraResult[0]["id"].(float64)
-
-	// Insertar detalles
-	for _, item := range payload.Articulos {
-		detalle := map[string]interface{}{
-			"compra_id":       compraID,
-			"articulo_id":     item.ArticuloID,
-			"cantidad":        item.Cantidad,
-			"precio_unitario": item.PrecioUnitario,
+	articulos := make([]map[string]interface{}, 0, len(payload.Articulos))
+	for i, item := range payload.Articulos {
+		if item.ArticuloID <= 0 || item.Cantidad <= 0 {
+			http.Error(w, `{"error":"Artículo inválido en la línea `+strconv.Itoa(i+1)+`"}`, http.StatusBadRequest)
+			return
 		}
-		if err := supabaseClient.DB.From("compras_detalles").Insert(detalle).Execute(nil); err != nil {
-			http.Error(w, `{"error":"Error al insertar detalle: `+err.Error()+`"}`, http.StatusInternalServerError)
+		if len(item.Series) > 0 && len(item.Series) != item.Cantidad {
+			http.Error(w, `{"error":"La línea `+strconv.Itoa(i+1)+` debe traer un número de serie por unidad"}`, http.StatusBadRequest)
 			return
 		}
+		articulos = append(articulos, map[string]interface{}{
+			"articulo_id":     item.ArticuloID,
+			"cantidad":        item.Cantidad,
+			"precio_unitario": item.PrecioUnitario,
+			"delta":           tipo.Signo * item.Cantidad,
+			"series":          item.Series,
+			"lote":            item.Lote,
+			"caducidad":       item.Caducidad,
+			"almacen_id":      item.AlmacenID,
+		})
 	}
 
+	// Registrar compra, detalles, movimientos y costos en una sola transacción
+	compra := map[string]interface{}{
+		"notas":          payload.Notas,
+		"usuario_nombre": claims.Email,
+	}
+	var compraResult map[string]interface{}
+	err = supabaseClient.DB.Rpc("registrar_compra", map[string]interface{}{
+		"p_compra":    compra,
+		"p_articulos": articulos,
+	}).Execute(&compraResult)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	compraID := compraResult["compra_id"].(float64)
+
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":   "Compra registrada correctamente",
 		"compra_id": compraID,
@@ -162,13 +182,9 @@ func handleEditarCompra(w http.ResponseWriter, r *http.Request) {
 
 	// Payload
 	var payload struct {
-		CompraID  int `json:"compra_id"`
-		Articulos []struct {
-			ArticuloID     int     `json:"articulo_id"`
-			Cantidad       int     `json:"cantidad"`
-			PrecioUnitario float64 `json:"precio_unitario"`
-		} `json:"articulos"`
-		Notas string `json:"notas,omitempty"`
+		CompraID  int             `json:"compra_id"`
+		Articulos []CompraDetalle `json:"articulos"`
+		Notas     string          `json:"notas,omitempty"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
@@ -185,41 +201,36 @@ func handleEditarCompra(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Actualizar cabecera (solo notas en este ejemplo)
-	update := map[string]interface{}{
-		"notas": payload.Notas,
-	}
-	if err := supabaseClient.DB.From("compras").
-		Update(update).
-		Eq("id", strconv.Itoa(payload.CompraID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar compra: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Borrar detalles anteriores
-	if err := supabaseClient.DB.From("compras_detalles").
-		Delete().
-		Eq("compra_id", strconv.Itoa(payload.CompraID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al eliminar detalles: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
-	}
-
-	// Insertar nuevos detalles
-	for _, item := range payload.Articulos {
-		detalle := map[string]interface{}{
-			"compra_id":       payload.CompraID,
-			"articulo_id":     item.ArticuloID,
-			"cantidad":        item.Cantidad,
-			"precio_unitario": item.PrecioUnitario,
+	for i, item := range payload.Articulos {
+		if item.ArticuloID <= 0 || item.Cantidad <= 0 {
+			http.Error(w, `{"error":"Artículo inválido en la línea `+strconv.Itoa(i+1)+`"}`, http.StatusBadRequest)
+			return
 		}
-		if err := supabaseClient.DB.From("compras_detalles").Insert(detalle).Execute(nil); err != nil {
-			http.Error(w, `{"error":"Error al insertar detalle: `+err.Error()+`"}`, http.StatusInternalServerError)
+		if len(item.Series) > 0 && len(item.Series) != item.Cantidad {
+			http.Error(w, `{"error":"La línea `+strconv.Itoa(i+1)+` debe traer un número de serie por unidad"}`, http.StatusBadRequest)
 			return
 		}
 	}
 
+	// Actualizar cabecera (solo notas en este ejemplo)
+	update := map[string]interface{}{
+		"notas":          payload.Notas,
+		"usuario_nombre": claims.Email,
+	}
+
+	// Actualizar cabecera, reemplazar detalles y compensar en inventario sólo
+	// la diferencia contra las líneas anteriores, en una sola transacción
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("editar_compra", map[string]interface{}{
+		"p_compra_id": payload.CompraID,
+		"p_compra":    update,
+		"p_articulos": payload.Articulos,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
 	// Respuesta
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":   "Compra editada correctamente",
@@ -256,12 +267,15 @@ func handleEliminarCompra(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Eliminar la compra
-	if err := supabaseClient.DB.From("compras").
-		Delete().
-		Eq("id", strconv.Itoa(payload.CompraID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al eliminar compra: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Eliminar la compra y revertir en inventario lo que sumó en una sola
+	// transacción; la base compara contra las líneas con la compra bloqueada
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("eliminar_compra", map[string]interface{}{
+		"p_compra_id":      payload.CompraID,
+		"p_usuario_nombre": claims.Email,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
 		return
 	}
 
@@ -271,3 +285,161 @@ func handleEliminarCompra(w http.ResponseWriter, r *http.Request) {
 		"compra_id": payload.CompraID,
 	})
 }
+
+// handleConfirmarCompra registra una compra en borrador: a partir de ahí sus
+// líneas entran al inventario y al costo promedio como cualquier compra. Las
+// series de los artículos serializados se capturan aquí, al recibir, por
+// artículo; se reparten entre sus líneas en el orden de su id. El lote y la
+// caducidad se capturan por línea, porque el mismo artículo puede llegar en
+// dos líneas con lotes distintos.
+func handleConfirmarCompra(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validar permisos
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		CompraID int                   `json:"compra_id"`
+		Series   map[int][]string      `json:"series,omitempty"` // por articulo_id
+		Lotes    map[int]LoteRecepcion `json:"lotes,omitempty"`  // por id de línea de compras_detalles
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.CompraID == 0 {
+		http.Error(w, `{"error":"Debe indicar compra_id"}`, http.StatusBadRequest)
+		return
+	}
+
+	var detalles []CompraDetalle
+	err := supabaseClient.DB.
+		From("compras_detalles").
+		Select("id", "articulo_id", "almacen_id", "cantidad", "precio_unitario").
+		OrderBy("id", "asc").
+		Eq("compra_id", strconv.Itoa(payload.CompraID)).
+		Execute(&detalles)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener detalles: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	tipo, ok := tipos["compra"]
+	if !ok {
+		http.Error(w, `{"error":"Tipo de movimiento compra no registrado"}`, http.StatusInternalServerError)
+		return
+	}
+	seriesPorLinea, mensaje := repartirSeries(detalles, payload.Series)
+	if mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, http.StatusBadRequest)
+		return
+	}
+	if mensaje := validarLotesPorLinea(detalles, payload.Lotes); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	movimientos := make([]map[string]interface{}, 0, len(detalles))
+	for i, d := range detalles {
+		movimiento := map[string]interface{}{
+			"articulo_id":     d.ArticuloID,
+			"almacen_id":      d.AlmacenID,
+			"tipo_movimiento": tipo.Clave,
+			"cantidad":        d.Cantidad,
+			"delta":           tipo.Signo * d.Cantidad,
+			"costo_unitario":  d.PrecioUnitario,
+			"motivo":          "Compra #" + strconv.Itoa(payload.CompraID),
+			"usuario_nombre":  claims.Email,
+			"compra_id":       payload.CompraID,
+			"requiere_series": true,
+			"requiere_lote":   true,
+		}
+		if lote, ok := payload.Lotes[d.ID]; ok {
+			movimiento["lote"] = lote.Lote
+			movimiento["caducidad"] = lote.Caducidad
+		}
+		if len(seriesPorLinea[i]) > 0 {
+			movimiento["series"] = seriesPorLinea[i]
+		}
+		movimientos = append(movimientos, movimiento)
+	}
+
+	// Cambiar estado y aplicar entradas en una sola transacción
+	var resultado map[string]interface{}
+	err = supabaseClient.DB.Rpc("confirmar_compra", map[string]interface{}{
+		"p_compra_id":   payload.CompraID,
+		"p_movimientos": movimientos,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Compra confirmada e inventario actualizado",
+		"compra_id": payload.CompraID,
+	})
+}
+
+// repartirSeries reparte las series capturadas por artículo entre las líneas
+// de la compra, en el orden de las líneas (por id), hasta la cantidad de cada
+// una. Más series que unidades compradas del artículo es un error; si faltan,
+// aplicar_movimiento rechaza la línea que queda incompleta.
+func repartirSeries(detalles []CompraDetalle, series map[int][]string) ([][]string, string) {
+	unidades := map[int]int{}
+	for _, d := range detalles {
+		unidades[d.ArticuloID] += d.Cantidad
+	}
+	for articuloID, capturadas := range series {
+		if len(capturadas) > unidades[articuloID] {
+			return nil, "Se indicaron " + strconv.Itoa(len(capturadas)) + " números de serie para " +
+				strconv.Itoa(unidades[articuloID]) + " unidades del artículo " + strconv.Itoa(articuloID)
+		}
+	}
+
+	pendientes := make(map[int][]string, len(series))
+	for articuloID, capturadas := range series {
+		pendientes[articuloID] = capturadas
+	}
+	porLinea := make([][]string, len(detalles))
+	for i, d := range detalles {
+		restantes := pendientes[d.ArticuloID]
+		n := d.Cantidad
+		if n > len(restantes) {
+			n = len(restantes)
+		}
+		porLinea[i] = restantes[:n]
+		pendientes[d.ArticuloID] = restantes[n:]
+	}
+	return porLinea, ""
+}
+
+// validarLotesPorLinea revisa que cada lote capturado corresponda a una línea
+// de la compra. Un id que no es de la compra (por ejemplo, un articulo_id) se
+// rechaza en lugar de ignorarse.
+func validarLotesPorLinea(detalles []CompraDetalle, lotes map[int]LoteRecepcion) string {
+	lineas := make(map[int]bool, len(detalles))
+	for _, d := range detalles {
+		lineas[d.ID] = true
+	}
+	for lineaID := range lotes {
+		if !lineas[lineaID] {
+			return "La línea " + strconv.Itoa(lineaID) + " no pertenece a la compra"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRepartirSeries(t *testing.T) {
+	detalles := []CompraDetalle{
+		{ID: 10, ArticuloID: 1, Cantidad: 2},
+		{ID: 11, ArticuloID: 2, Cantidad: 1},
+		{ID: 12, ArticuloID: 1, Cantidad: 1},
+	}
+
+	casos := []struct {
+		nombre   string
+		series   map[int][]string
+		esperado [][]string
+		falla    bool
+	}{
+		{
+			nombre:   "sin series",
+			esperado: [][]string{nil, nil, nil},
+		},
+		{
+			nombre:   "se reparten en el orden de las líneas",
+			series:   map[int][]string{1: {"A1", "A2", "A3"}, 2: {"B1"}},
+			esperado: [][]string{{"A1", "A2"}, {"B1"}, {"A3"}},
+		},
+		{
+			nombre:   "las que faltan dejan corta la última línea",
+			series:   map[int][]string{1: {"A1", "A2"}},
+			esperado: [][]string{{"A1", "A2"}, nil, {}},
+		},
+		{
+			nombre: "más series que unidades compradas",
+			series: map[int][]string{1: {"A1", "A2", "A3", "A4"}},
+			falla:  true,
+		},
+		{
+			nombre: "series de un artículo que no está en la compra",
+			series: map[int][]string{3: {"C1"}},
+			falla:  true,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			porLinea, mensaje := repartirSeries(detalles, c.series)
+			if c.falla {
+				if mensaje == "" {
+					t.Fatalf("se esperaba error, se obtuvo %v", porLinea)
+				}
+				return
+			}
+			if mensaje != "" {
+				t.Fatalf("error inesperado: %s", mensaje)
+			}
+			if len(porLinea) != len(c.esperado) {
+				t.Fatalf("se obtuvieron %d líneas, se esperaban %d", len(porLinea), len(c.esperado))
+			}
+			for i := range c.esperado {
+				if len(porLinea[i]) == 0 && len(c.esperado[i]) == 0 {
+					continue
+				}
+				if !reflect.DeepEqual(porLinea[i], c.esperado[i]) {
+					t.Errorf("línea %d: se obtuvo %v, se esperaba %v", i, porLinea[i], c.esperado[i])
+				}
+			}
+		})
+	}
+}
+
+func TestValidarLotesPorLinea(t *testing.T) {
+	// El mismo artículo en dos líneas, cada una con su lote
+	detalles := []CompraDetalle{
+		{ID: 10, ArticuloID: 1, Cantidad: 5},
+		{ID: 11, ArticuloID: 1, Cantidad: 3},
+	}
+
+	casos := []struct {
+		nombre string
+		lotes  map[int]LoteRecepcion
+		falla  bool
+	}{
+		{"sin lotes", nil, false},
+		{"un lote por línea del mismo artículo", map[int]LoteRecepcion{10: {Lote: "L1"}, 11: {Lote: "L2", Caducidad: "2026-01-31"}}, false},
+		{"indexado por articulo_id", map[int]LoteRecepcion{1: {Lote: "L1"}}, true},
+	}
+
+	for _, c := range casos {
+		mensaje := validarLotesPorLinea(detalles, c.lotes)
+		if (mensaje != "") != c.falla {
+			t.Errorf("%s: mensaje %q, se esperaba falla=%v", c.nombre, mensaje, c.falla)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"equiposmedicos/middleware"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// GET /api/inventario/tomas/{id}/hojas.pdf. Hojas para contar en papel: una
+// sección por categoría con los artículos en orden de su ubicación en el
+// almacén de la toma (ver /api/inventario/ubicacion) y una casilla vacía para
+// anotar lo contado. Cada página lleva el folio y su número; en una toma
+// ciega no se imprime lo teórico.
+func handleHojasConteo(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var tomas []TomaInventario
+	err := supabaseClient.DB.From("tomafisica_view").Select("*").Eq("id", strconv.Itoa(tomaID)).Execute(&tomas)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(tomas) == 0 {
+		http.Error(w, `{"error":"Toma no encontrada"}`, http.StatusNotFound)
+		return
+	}
+	toma := tomas[0]
+
+	// Se pagina para no quedar corto por el máximo de filas de Supabase
+	const tamanoPagina = 1000
+
+	var lineas []LineaHojaConteo
+	for inicio := 0; ; inicio += tamanoPagina {
+		var pagina []LineaHojaConteo
+		err = supabaseClient.DB.
+			From("tomafisica_hoja_view").
+			Select("*").
+			OrderBy("categoria_nombre,ubicacion,nombre,detalle_id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			Eq("toma_id", strconv.Itoa(tomaID)).
+			Execute(&pagina)
+		if err != nil {
+			http.Error(w, `{"error":"Error al obtener las líneas de la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		lineas = append(lineas, pagina...)
+		if len(pagina) < tamanoPagina {
+			break
+		}
+	}
+	if len(lineas) == 0 {
+		http.Error(w, `{"error":"La toma no tiene artículos"}`, http.StatusNotFound)
+		return
+	}
+
+	// Una hoja por categoría, en el orden en que llegan
+	type hoja struct {
+		Categoria string
+		Lineas    []LineaHojaConteo
+	}
+	hojas := []*hoja{}
+	indice := map[string]*hoja{}
+	for _, l := range lineas {
+		nombre := "Sin categoría"
+		if l.CategoriaNombre != nil {
+			nombre = *l.CategoriaNombre
+		}
+		h, existe := indice[nombre]
+		if !existe {
+			h = &hoja{Categoria: nombre}
+			indice[nombre] = h
+			hojas = append(hojas, h)
+		}
+		h.Lineas = append(h.Lineas, l)
+	}
+
+	var html bytes.Buffer
+	err = plantillaHojasConteo.Execute(&html, map[string]interface{}{
+		"Toma":          toma,
+		"Hojas":         hojas,
+		"MostrarTeoria": !toma.Ciega,
+	})
+	if err != nil {
+		http.Error(w, `{"error":"Error al generar las hojas: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	pdf, err := convertirPDF(map[string]interface{}{
+		"source": html.String(),
+		"margin": "10mm",
+		"footer": map[string]interface{}{
+			"source": `<div style="font-size:8px;text-align:center;width:100%">Toma folio ` + strconv.Itoa(toma.Folio) + ` · Página {{page}} de {{total}}</div>`,
+		},
+	})
+	if err != nil {
+		http.Error(w, `{"error":"Error al generar el PDF: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	responderPDF(w, pdf, "hojas_conteo_toma_"+strconv.Itoa(toma.Folio)+".pdf")
+}
+
+var plantillaHojasConteo = template.Must(template.New("hojas_conteo").Funcs(template.FuncMap{
+	"num": func(v float64) string { return strconv.FormatFloat(v, 'f', -1, 64) },
+}).Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<style>
+	body { font-family: Arial, sans-serif; font-size: 10px; color: #222; }
+	section + section { page-break-before: always; }
+	h1 { font-size: 14px; margin: 0 0 2px; }
+	.datos { margin-bottom: 8px; }
+	table { width: 100%; border-collapse: collapse; }
+	thead { display: table-header-group; }
+	tr { page-break-inside: avoid; }
+	th, td { border: 1px solid #999; padding: 5px 4px; }
+	th { background: #eee; text-align: left; }
+	td.n { text-align: right; }
+	td.casilla { width: 70px; }
+	.firmas { margin-top: 24px; display: flex; justify-content: space-between; }
+	.firma { width: 30%; border-top: 1px solid #222; padding-top: 4px; text-align: center; }
+</style>
+</head>
+<body>
+{{range .Hojas}}<section>
+<h1>Hoja de conteo · Toma física folio {{$.Toma.Folio}}</h1>
+<div class="datos">Almacén: {{$.Toma.AlmacenNombre}} · Categoría: {{.Categoria}} · Inicio: {{$.Toma.FechaInicio}}</div>
+<table>
+<thead><tr><th>Ubicación</th><th>Artículo</th><th>Marca</th><th>Código de barras</th>{{if $.MostrarTeoria}}<th>Teórica</th>{{end}}<th>Conteo</th></tr></thead>
+<tbody>
+{{range .Lineas}}<tr><td>{{.Ubicacion}}</td><td>{{.Nombre}}</td><td>{{.Marca}}</td><td>{{.CodigoBarras}}</td>{{if $.MostrarTeoria}}<td class="n">{{num .CantidadTeorica}}</td>{{end}}<td class="casilla"></td></tr>
+{{end}}</tbody>
+</table>
+<div class="firmas">
+	<div class="firma">Contó</div>
+	<div class="firma">Verificó</div>
+	<div class="firma">Fecha</div>
+</div>
+</section>
+{{end}}</body>
+</html>
+`))
@@ -28,20 +28,222 @@ func handleReporteInventario(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Almacén opcional; sin él se reportan las existencias de todos
+	almacenID := 0
+	if v := r.URL.Query().Get("almacen_id"); v != "" {
+		var err error
+		if almacenID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, `{"error":"almacen_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Fecha de corte opcional (YYYY-MM-DD) para reconstruir el inventario a ese día
+	var corte time.Time
+	asOf := r.URL.Query().Get("as_of")
+	if asOf != "" {
+		var err error
+		if corte, err = time.Parse("2006-01-02", asOf); err != nil {
+			http.Error(w, `{"error":"Fecha 'as_of' inválida, use YYYY-MM-DD"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
 	var inventarios []InventarioArticulo
 
-	err := supabaseClient.DB.
-		From("inventario_view").
-		Select("*").
-		Execute(&inventarios)
+	var err error
+	if almacenID > 0 {
+		err = supabaseClient.DB.
+			From("inventario_almacen_view").
+			Select("*").
+			Eq("almacen_id", strconv.Itoa(almacenID)).
+			Execute(&inventarios)
+	} else {
+		err = supabaseClient.DB.
+			From("inventario_view").
+			Select("*").
+			Execute(&inventarios)
+	}
 	if err != nil {
 		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
 
+	if !corte.IsZero() {
+		actuales := make(map[int]float64, len(inventarios))
+		for _, inv := range inventarios {
+			actuales[inv.ID] = inv.CantidadActual
+		}
+		cantidades, costos, err := existenciasAl(corte, almacenID, actuales)
+		if err != nil {
+			http.Error(w, `{"error":"Error al reconstruir inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		for i := range inventarios {
+			inv := &inventarios[i]
+			inv.CantidadActual = cantidades[inv.ID]
+			if costo, ok := costos[inv.ID]; ok {
+				inv.Costo = costo
+			}
+			inv.UltimaActualizacion = asOf
+			// Las reservas son de hoy; no aplican a una fecha pasada
+			inv.Reservado = 0
+		}
+	}
+
+	for i := range inventarios {
+		inventarios[i].ValorInventario = inventarios[i].CantidadActual * inventarios[i].Costo
+		inventarios[i].Disponible = inventarios[i].CantidadActual - inventarios[i].Reservado
+	}
+
 	json.NewEncoder(w).Encode(inventarios)
 }
 
+// existenciasAl reconstruye la cantidad de cada artículo al cierre del día
+// indicado partiendo de las existencias actuales y deshaciendo los movimientos
+// posteriores, en un almacén o en todos si almacenID es 0. Así el resultado no
+// depende de que movimientos_inventario conserve toda la historia desde cero.
+// También devuelve el costo promedio vigente ese día para los artículos cuyo
+// costo cambió después; los demás conservan el actual.
+func existenciasAl(dia time.Time, almacenID int, actuales map[int]float64) (map[int]float64, map[int]float64, error) {
+	siguiente := dia.AddDate(0, 0, 1)
+
+	movimientos, err := obtenerMovimientos(0, almacenID, siguiente, time.Time{})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	historial, err := obtenerCostosDesde(siguiente)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return existenciasAntesDe(actuales, movimientos, tipos), costosAntesDe(historial), nil
+}
+
+// existenciasAntesDe resta a las existencias actuales lo que aportó cada
+// movimiento posterior al corte, según el signo de su tipo.
+func existenciasAntesDe(actuales map[int]float64, posteriores []MovimientoInventario, tipos map[string]TipoMovimiento) map[int]float64 {
+	cantidades := make(map[int]float64, len(actuales))
+	for articuloID, cantidad := range actuales {
+		cantidades[articuloID] = cantidad
+	}
+	for _, m := range posteriores {
+		tipo, ok := tipos[m.TipoMovimiento]
+		if !ok {
+			continue
+		}
+		cantidades[m.ArticuloID] -= float64(tipo.Signo) * m.Cantidad
+	}
+	return cantidades
+}
+
+// costosAntesDe toma, del historial posterior al corte en orden cronológico,
+// el costo anterior al primer cambio de cada artículo: ése era el vigente.
+func costosAntesDe(historial []CostoHistorial) map[int]float64 {
+	costos := map[int]float64{}
+	for _, h := range historial {
+		if _, visto := costos[h.ArticuloID]; !visto {
+			costos[h.ArticuloID] = h.CostoAnterior
+		}
+	}
+	return costos
+}
+
+// obtenerCostosDesde trae en orden cronológico los cambios de costo promedio
+// a partir del día desde, paginando como obtenerMovimientos.
+func obtenerCostosDesde(desde time.Time) ([]CostoHistorial, error) {
+	const tamanoPagina = 1000
+
+	historial := []CostoHistorial{}
+	for inicio := 0; ; inicio += tamanoPagina {
+		var pagina []CostoHistorial
+		err := supabaseClient.DB.
+			From("articulos_costos_historial").
+			Select("*").
+			OrderBy("fecha,id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			Gte("fecha", desde.Format("2006-01-02")).
+			Execute(&pagina)
+		if err != nil {
+			return nil, err
+		}
+		historial = append(historial, pagina...)
+		if len(pagina) < tamanoPagina {
+			return historial, nil
+		}
+	}
+}
+
+// Handler para /api/inventario/caducidades (GET). Lista los lotes con
+// existencias que caducan dentro de ?dias= (30 por defecto), incluidos los ya
+// caducados, del que caduca antes al que caduca después. Acepta almacen_id.
+func handleReporteCaducidades(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validación de token y permisos
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	dias := 30
+	if v := r.URL.Query().Get("dias"); v != "" {
+		var err error
+		if dias, err = strconv.Atoi(v); err != nil || dias < 0 {
+			http.Error(w, `{"error":"dias debe ser un entero mayor o igual a cero"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	limite := time.Now().AddDate(0, 0, dias).Format("2006-01-02")
+
+	query := supabaseClient.DB.
+		From("lotes_caducidad_view").
+		Select("*").
+		OrderBy("caducidad", "asc").
+		Lte("caducidad", limite)
+	if almacenID := r.URL.Query().Get("almacen_id"); almacenID != "" {
+		if _, err := strconv.Atoi(almacenID); err != nil {
+			http.Error(w, `{"error":"almacen_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+		query = query.Eq("almacen_id", almacenID)
+	}
+
+	var lotes []LoteCaducidad
+	if err := query.Execute(&lotes); err != nil {
+		http.Error(w, `{"error":"Error al obtener lotes: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if lotes == nil {
+		lotes = []LoteCaducidad{}
+	}
+
+	totalValor := 0.0
+	for _, l := range lotes {
+		totalValor += l.Valor
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"dias":        dias,
+		"hasta":       limite,
+		"lotes":       lotes,
+		"total_valor": totalValor,
+	})
+}
+
 func handleObtenerInventarios(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
@@ -60,10 +262,18 @@ func handleObtenerInventarios(w http.ResponseWriter, r *http.Request) {
 
 	var inventarios []TomaInventario
 
-	err := supabaseClient.DB.
+	query := &supabaseClient.DB.
 		From("tomafisica_view").
 		Select("*").
-		Execute(&inventarios)
+		FilterRequestBuilder
+	if almacenID := r.URL.Query().Get("almacen_id"); almacenID != "" {
+		if _, err := strconv.Atoi(almacenID); err != nil {
+			http.Error(w, `{"error":"almacen_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+		query = query.Eq("almacen_id", almacenID)
+	}
+	err := query.Execute(&inventarios)
 
 	if err != nil {
 		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusInternalServerError)
@@ -89,13 +299,25 @@ func handleCrearTomaFisica(w http.ResponseWriter, r *http.Request) {
 
 	//Decodificar payload
 	var payload struct {
-		CategoriaID *int `json:"categoria_id,omitempty"`
+		CategoriaID       *int     `json:"categoria_id,omitempty"`
+		AlmacenID         *int     `json:"almacen_id,omitempty"`
+		Ciega             bool     `json:"ciega"`                    // oculta cantidad_teorica a quien cuenta
+		ConteosRequeridos int      `json:"conteos_requeridos"`       // contadores independientes; 1 por defecto
+		ToleranciaPct     *float64 `json:"tolerancia_pct,omitempty"` // variación contra lo teórico que pide reconteo
+		Congelar          bool     `json:"congelar"`                 // bloquea movimientos de los artículos hasta cerrar
 	}
 	err := json.NewDecoder(r.Body).Decode(&payload)
 	if err != nil {
 		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
 		return
 	}
+	if payload.ConteosRequeridos == 0 {
+		payload.ConteosRequeridos = 1
+	}
+	if payload.ConteosRequeridos < 1 || (payload.ToleranciaPct != nil && *payload.ToleranciaPct < 0) {
+		http.Error(w, `{"error":"conteos_requeridos y tolerancia_pct deben ser positivos"}`, http.StatusBadRequest)
+		return
+	}
 
 	//Validar permisos del usuario
 	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
@@ -105,105 +327,29 @@ func handleCrearTomaFisica(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	usuarioSub := claims.Subject
-	usuarioCorreo := claims.Email
-
-	//Insertar la toma física
-	toma := map[string]interface{}{
-		"fecha_inicio":      time.Now(),
-		"estado":            "abierta",
-		"categoria_id":      payload.CategoriaID,
-		"usuario_auth0_sub": usuarioSub,
-		"usuario_correo":    usuarioCorreo,
-	}
-
-	var results []map[string]interface{}
-	err = supabaseClient.DB.From("tomafisica").Insert(toma).Execute(&results)
-	if err != nil || len(results) == 0 {
-		http.Error(w, `{"error":"Error al crear la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
-	}
-
-	tomaID := results[0]["id"].(float64)
-	folio := results[0]["folio"].(float64)
-
-	//Obtener artículos
-	var articulos []map[string]interface{}
-	err = supabaseClient.DB.From("articulos").Select("*").Execute(&articulos)
-	if err != nil {
-		http.Error(w, `{"error":"Error al obtener artículos: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
-	}
-
-	//Obtener inventarios
-	var inventarios []map[string]interface{}
-	err = supabaseClient.DB.From("inventarios").Select("*").Execute(&inventarios)
+	// La toma y la foto del inventario (cantidad_teorica de cada artículo del
+	// almacén, o de la categoría) se crean en una sola transacción; sin
+	// almacén se usa el predeterminado
+	var resultado map[string]interface{}
+	err = supabaseClient.DB.Rpc("crear_toma_fisica", map[string]interface{}{
+		"p_toma": map[string]interface{}{
+			"categoria_id":       payload.CategoriaID,
+			"almacen_id":         payload.AlmacenID,
+			"ciega":              payload.Ciega,
+			"conteos_requeridos": payload.ConteosRequeridos,
+			"tolerancia_pct":     payload.ToleranciaPct,
+			"congelar":           payload.Congelar,
+			"usuario_auth0_sub":  claims.Subject,
+			"usuario_correo":     claims.Email,
+		},
+	}).Execute(&resultado)
 	if err != nil {
-		http.Error(w, `{"error":"Error al obtener inventarios: `+err.Error()+`"}`, http.StatusInternalServerError)
+		responderErrorRPC(w, err)
 		return
 	}
 
-	//Crear un mapa de cantidad actual por articulo_id
-	cantidadMap := map[int]float64{}
-	for _, inv := range inventarios {
-		if idFloat, ok := inv["articulo_id"].(float64); ok {
-			id := int(idFloat)
-			if cant, ok := inv["cantidad_actual"].(float64); ok {
-				cantidadMap[id] = cant
-			}
-		}
-	}
-
-	//Crear los detalles de inventario
-	detalles := []map[string]interface{}{}
-	for _, a := range articulos {
-		// Verificar categoría
-		categoriaIDArt := 0
-		if a["categoria_id"] != nil {
-			if floatVal, ok := a["categoria_id"].(float64); ok {
-				categoriaIDArt = int(floatVal)
-			}
-		}
-		if payload.CategoriaID != nil && categoriaIDArt != *payload.CategoriaID {
-			continue
-		}
-
-		// ID del artículo
-		articuloID := 0
-		if a["id"] != nil {
-			if floatVal, ok := a["id"].(float64); ok {
-				articuloID = int(floatVal)
-			}
-		}
-
-		// Cantidad teórica desde inventarios
-		cantidadTeorica := 0.0
-		if cant, ok := cantidadMap[articuloID]; ok {
-			cantidadTeorica = cant
-		}
-
-		detalles = append(detalles, map[string]interface{}{
-			"toma_id":          tomaID,
-			"articulo_id":      articuloID,
-			"cantidad_teorica": cantidadTeorica,
-			"cantidad_real":    0,
-		})
-	}
-
-	//Insertar detalles en la base de datos
-	if len(detalles) > 0 {
-		err = supabaseClient.DB.From("tomafisicadetalle").Insert(detalles).Execute(nil)
-		if err != nil {
-			http.Error(w, `{"error":"Error al crear detalles de inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
-			return
-		}
-	}
-
 	//Retornar JSON con la toma creada
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"toma_id": tomaID,
-		"folio":   folio,
-	})
+	json.NewEncoder(w).Encode(resultado)
 }
 
 func handleObtenerDetalleToma(w http.ResponseWriter, r *http.Request) {
@@ -251,6 +397,50 @@ func handleObtenerDetalleToma(w http.ResponseWriter, r *http.Request) {
 		detalles = []map[string]interface{}{}
 	}
 
+	// Mientras se cuenta, una toma ciega no muestra lo teórico y con varios
+	// contadores cada quien ve sólo su propio conteo
+	var tomas []TomaInventario
+	err = supabaseClient.DB.From("tomafisica").Select("*").Eq("id", idValue).Execute(&tomas)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(tomas) > 0 && (tomas[0].Estado == "abierta" || tomas[0].Estado == "en_conteo") {
+		toma := tomas[0]
+		propios := map[int]float64{}
+		if toma.ConteosRequeridos > 1 {
+			var conteos []ConteoToma
+			err = supabaseClient.DB.
+				From("tomafisica_conteos").
+				Select("*").
+				Eq("toma_id", idValue).
+				Eq("usuario_auth0_sub", claims.Subject).
+				Execute(&conteos)
+			if err != nil {
+				http.Error(w, `{"error":"Error al obtener conteos: `+err.Error()+`"}`, http.StatusInternalServerError)
+				return
+			}
+			for _, c := range conteos {
+				propios[c.DetalleID] = c.Cantidad
+			}
+		}
+
+		for _, d := range detalles {
+			if toma.Ciega {
+				delete(d, "cantidad_teorica")
+				delete(d, "diferencia")
+			}
+			if toma.ConteosRequeridos > 1 {
+				detalleID, _ := d["detalle_id"].(float64)
+				if cantidad, ok := propios[int(detalleID)]; ok {
+					d["cantidad_real"] = cantidad
+				} else {
+					d["cantidad_real"] = nil
+				}
+			}
+		}
+	}
+
 	json.NewEncoder(w).Encode(detalles)
 }
 
@@ -284,18 +474,25 @@ func handleGuardarTomaDetalle(w http.ResponseWriter, r *http.Request) {
 			continue
 		}
 
-		updates := map[string]interface{}{
-			"cantidad_real": d["cantidad_real"],
+		cantidad, ok := d["cantidad_real"].(float64)
+		if !ok {
+			http.Error(w, `{"error":"cantidad_real inválida en el detalle `+strconv.Itoa(int(detalleID))+`"}`, http.StatusBadRequest)
+			return
 		}
 
-		err := supabaseClient.DB.
-			From("tomafisicadetalle").
-			Update(updates).
-			Eq("id", strconv.Itoa(int(detalleID))).
-			Execute(nil)
+		// En tomas con varios contadores se guarda el conteo de este usuario
+		var resultado float64
+		err := supabaseClient.DB.Rpc("registrar_conteo", map[string]interface{}{
+			"p_detalle_id":     int(detalleID),
+			"p_cantidad":       cantidad,
+			"p_sumar":          false,
+			"p_usuario_sub":    claims.Subject,
+			"p_usuario_correo": claims.Email,
+		}).Execute(&resultado)
 
 		if err != nil {
-			http.Error(w, `{"error":"Error al actualizar detalle: `+err.Error()+`"}`, http.StatusInternalServerError)
+			// La base rechaza con 409 los conteos de tomas fuera de en_conteo
+			responderErrorRPC(w, err)
 			return
 		}
 	}
@@ -305,7 +502,8 @@ func handleGuardarTomaDetalle(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Handler para cancelar (eliminar) una toma física completa
+// Handler para cancelar una toma física. La toma no se elimina: pasa a
+// cancelada y queda registrado quién la canceló.
 func handleCancelarToma(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
@@ -329,26 +527,18 @@ func handleCancelarToma(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	idStr := parts[4]
-
-	// Eliminar toma física
-	err := supabaseClient.DB.
-		From("tomafisica").
-		Delete().
-		Eq("id", idStr).
-		Execute(nil)
-
+	tomaID, err := strconv.Atoi(parts[4])
 	if err != nil {
-		http.Error(w, `{"error":"Error al eliminar toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error":"ID inválido"}`, http.StatusBadRequest)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Toma física cancelada correctamente",
-	})
+	cambiarEstadoToma(w, tomaID, "cancelada", r.URL.Query().Get("motivo"), claims)
 }
 
-// handleFinalizarToma actualiza los detalles y cierra el folio de la toma física.
+// handleFinalizarToma actualiza los detalles, cierra el folio de la toma física
+// y ajusta la existencia de cada artículo contado a su cantidad real. La toma
+// debe estar en revisión; los conteos enviados sólo se aceptan si no cambian.
 func handleFinalizarToma(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
@@ -384,7 +574,7 @@ func handleFinalizarToma(w http.ResponseWriter, r *http.Request) {
 		updates := map[string]interface{}{"cantidad_real": d["cantidad_real"]}
 		err := supabaseClient.DB.From("tomafisicadetalle").Update(updates).Eq("id", strconv.Itoa(int(detalleID))).Execute(nil)
 		if err != nil {
-			http.Error(w, `{"error":"Error al actualizar detalle `+strconv.Itoa(int(detalleID))+`: `+err.Error()+`"}`, http.StatusInternalServerError)
+			responderErrorRPC(w, err)
 			return
 		}
 	}
@@ -414,18 +604,6 @@ func handleFinalizarToma(w http.ResponseWriter, r *http.Request) {
 
 	tomaID := tomaDetalles[0].TomaID
 
-	// Cambia el estado y actualiza la fecha de finalización
-	updates := map[string]interface{}{
-		"estado":    "cerrada",
-		"fecha_fin": time.Now(),
-	}
-	err = supabaseClient.DB.From("tomafisica").Update(updates).Eq("id", strconv.Itoa(tomaID)).Execute(nil)
-	if err != nil {
-		http.Error(w, `{"error":"Error al cerrar el folio de la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
-	}
-
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message": "Toma física finalizada y cerrada correctamente",
-	})
+	// Cerrar la toma y ajustar el inventario a lo contado en una sola transacción
+	cambiarEstadoToma(w, tomaID, "cerrada", "", claims)
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExistenciasAntesDe(t *testing.T) {
+	tipos := map[string]TipoMovimiento{
+		"compra":             {Clave: "compra", Signo: 1},
+		"venta":              {Clave: "venta", Signo: -1},
+		"cancelacion_compra": {Clave: "cancelacion_compra", Signo: -1},
+	}
+
+	casos := []struct {
+		nombre      string
+		actuales    map[int]float64
+		posteriores []MovimientoInventario
+		esperado    map[int]float64
+	}{
+		{
+			nombre:   "sin movimientos posteriores conserva lo actual",
+			actuales: map[int]float64{1: 10, 2: 0},
+			esperado: map[int]float64{1: 10, 2: 0},
+		},
+		{
+			nombre:   "deshace entradas y salidas",
+			actuales: map[int]float64{1: 10},
+			posteriores: []MovimientoInventario{
+				{ArticuloID: 1, TipoMovimiento: "compra", Cantidad: 5},
+				{ArticuloID: 1, TipoMovimiento: "venta", Cantidad: 2},
+				{ArticuloID: 1, TipoMovimiento: "cancelacion_compra", Cantidad: 1},
+			},
+			esperado: map[int]float64{1: 8},
+		},
+		{
+			nombre:   "artículo sin existencia actual",
+			actuales: map[int]float64{},
+			posteriores: []MovimientoInventario{
+				{ArticuloID: 3, TipoMovimiento: "venta", Cantidad: 4},
+			},
+			esperado: map[int]float64{3: 4},
+		},
+		{
+			nombre:   "ignora tipos no registrados",
+			actuales: map[int]float64{1: 7},
+			posteriores: []MovimientoInventario{
+				{ArticuloID: 1, TipoMovimiento: "desconocido", Cantidad: 3},
+			},
+			esperado: map[int]float64{1: 7},
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			obtenido := existenciasAntesDe(c.actuales, c.posteriores, tipos)
+			if !reflect.DeepEqual(obtenido, c.esperado) {
+				t.Errorf("existenciasAntesDe() = %v, esperado %v", obtenido, c.esperado)
+			}
+		})
+	}
+}
+
+func TestExistenciasAntesDeNoModificaActuales(t *testing.T) {
+	actuales := map[int]float64{1: 10}
+	existenciasAntesDe(actuales, []MovimientoInventario{
+		{ArticuloID: 1, TipoMovimiento: "compra", Cantidad: 5},
+	}, map[string]TipoMovimiento{"compra": {Signo: 1}})
+
+	if actuales[1] != 10 {
+		t.Errorf("actuales[1] = %v, esperado 10", actuales[1])
+	}
+}
+
+func TestCostosAntesDe(t *testing.T) {
+	casos := []struct {
+		nombre    string
+		historial []CostoHistorial
+		esperado  map[int]float64
+	}{
+		{
+			nombre:   "sin cambios posteriores",
+			esperado: map[int]float64{},
+		},
+		{
+			nombre: "toma el costo anterior al primer cambio",
+			historial: []CostoHistorial{
+				{ArticuloID: 1, CostoAnterior: 100, CostoNuevo: 110},
+				{ArticuloID: 2, CostoAnterior: 50, CostoNuevo: 45},
+				{ArticuloID: 1, CostoAnterior: 110, CostoNuevo: 120},
+			},
+			esperado: map[int]float64{1: 100, 2: 50},
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			obtenido := costosAntesDe(c.historial)
+			if !reflect.DeepEqual(obtenido, c.esperado) {
+				t.Errorf("costosAntesDe() = %v, esperado %v", obtenido, c.esperado)
+			}
+		})
+	}
+}
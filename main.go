@@ -6,6 +6,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 	"github.com/nedpals/supabase-go"
@@ -83,7 +85,15 @@ func main() {
 
 	// Rutas de artículos
 	router.HandleFunc("/api/articulos", handleGetArticulos)
-	router.HandleFunc("/api/articulos/", handleGetArticuloPorID)
+	kardexHandler := middleware.EnsureValidToken()(http.HandlerFunc(handleKardexArticulo))
+	router.HandleFunc("/api/articulos/", func(w http.ResponseWriter, r *http.Request) {
+		// /api/articulos/{id}/kardex requiere token; el detalle del artículo es público
+		if strings.HasSuffix(r.URL.Path, "/kardex") {
+			kardexHandler.ServeHTTP(w, r)
+			return
+		}
+		handleGetArticuloPorID(w, r)
+	})
 	router.HandleFunc("/api/articulos/catalogo-pdf", handleGenerateCatalogoPDF)
 	router.HandleFunc("/api/articulos/buscar", handleBuscarArticulos)
 	router.Handle("/api/articulos/agregar", middleware.EnsureValidToken()(http.HandlerFunc(handleAgregarArticulo)))
@@ -105,12 +115,31 @@ func main() {
 	router.Handle("/api/inventario/cancelar_tomas/", middleware.EnsureValidToken()(http.HandlerFunc(handleCancelarToma)))
 	router.Handle("/api/inventario/finalizar_tomas", middleware.EnsureValidToken()(http.HandlerFunc(handleFinalizarToma)))
 	router.Handle("/api/inventario/detalles_tomas/", middleware.EnsureValidToken()(http.HandlerFunc(handleObtenerDetalleToma)))
+	router.Handle("/api/inventario/tomas/", middleware.EnsureValidToken()(http.HandlerFunc(handleTomas)))
+	router.Handle("/api/inventario/transferir", middleware.EnsureValidToken()(http.HandlerFunc(handleTransferirInventario)))
+	router.Handle("/api/inventario/ubicacion", middleware.EnsureValidToken()(http.HandlerFunc(handleUbicacionInventario)))
+	router.Handle("/api/inventario/caducidades", middleware.EnsureValidToken()(http.HandlerFunc(handleReporteCaducidades)))
+	router.Handle("/api/inventario/alertas", middleware.EnsureValidToken()(http.HandlerFunc(handleAlertasStock)))
+	router.Handle("/api/inventario/politicas", middleware.EnsureValidToken()(http.HandlerFunc(handlePoliticasStock)))
+	router.Handle("/api/inventario/politicas/eliminar/", middleware.EnsureValidToken()(http.HandlerFunc(handleEliminarPoliticaStock)))
+
+	// Almacenes
+	router.Handle("/api/almacenes", middleware.EnsureValidToken()(http.HandlerFunc(handleAlmacenes)))
+
+	// Series
+	router.Handle("/api/series/", middleware.EnsureValidToken()(http.HandlerFunc(handleObtenerSerie)))
+	router.Handle("/api/trazabilidad", middleware.EnsureValidToken()(http.HandlerFunc(handleTrazabilidad)))
+
+	// Reservas
+	router.Handle("/api/reservas", middleware.EnsureValidToken()(http.HandlerFunc(handleReservas)))
+	router.Handle("/api/reservas/liberar/", middleware.EnsureValidToken()(http.HandlerFunc(handleLiberarReserva)))
 
 	// Movimientos
 	router.Handle("/api/movimientos/registrar", middleware.EnsureValidToken()(http.HandlerFunc(handleRegistrarMovimiento)))
 	router.Handle("/api/movimientos", middleware.EnsureValidToken()(http.HandlerFunc(handleReporteMovimientos)))
 	router.Handle("/api/movimientos/editar", middleware.EnsureValidToken()(http.HandlerFunc(handleEditarMovimiento)))
 	router.Handle("/api/movimientos/eliminar", middleware.EnsureValidToken()(http.HandlerFunc(handleEliminarMovimiento)))
+	router.Handle("/api/movimientos/tipos", middleware.EnsureValidToken()(http.HandlerFunc(handleTiposMovimiento)))
 
 	// Compras
 	router.Handle("/api/compras/registrar", middleware.EnsureValidToken()(http.HandlerFunc(handleRegistrarCompra)))
@@ -118,6 +147,9 @@ func main() {
 	router.Handle("/api/compras/", middleware.EnsureValidToken()(http.HandlerFunc(handleDetalleCompra)))
 	router.Handle("/api/compras/editar", middleware.EnsureValidToken()(http.HandlerFunc(handleEditarCompra)))
 	router.Handle("/api/compras/eliminar", middleware.EnsureValidToken()(http.HandlerFunc(handleEliminarCompra)))
+	router.Handle("/api/compras/confirmar", middleware.EnsureValidToken()(http.HandlerFunc(handleConfirmarCompra)))
+	router.Handle("/api/compras/sugerencias", middleware.EnsureValidToken()(http.HandlerFunc(handleSugerenciasCompra)))
+	router.Handle("/api/compras/proveedores", middleware.EnsureValidToken()(http.HandlerFunc(handleProveedoresTiempos)))
 
 	// Ventas
 	router.Handle("/api/ventas/registrar", middleware.EnsureValidToken()(http.HandlerFunc(handleRegistrarVenta)))
@@ -125,12 +157,16 @@ func main() {
 	router.Handle("/api/ventas/", middleware.EnsureValidToken()(http.HandlerFunc(handleDetalleVenta)))
 	router.Handle("/api/ventas/eliminar", middleware.EnsureValidToken()(http.HandlerFunc(handleEliminarVenta)))
 	router.Handle("/api/ventas/editar", middleware.EnsureValidToken()(http.HandlerFunc(handleEditarVenta)))
+	router.Handle("/api/ventas/margenes", middleware.EnsureValidToken()(http.HandlerFunc(handleReporteMargenes)))
 
 	// Pagos
 	router.Handle("/api/pagos", middleware.EnsureValidToken()(http.HandlerFunc(handleObtenerPagos)))
 	router.Handle("/api/pagos/venta/", middleware.EnsureValidToken()(http.HandlerFunc(handleObtenerPagosId)))
 	router.Handle("/api/pagos/registrar", middleware.EnsureValidToken()(http.HandlerFunc(handleAgregarPagos)))
 
+	// Marcar como vencidas las reservas que pasaron su fecha
+	go liberarReservasVencidas(time.Minute)
+
 	fmt.Println("Servidor escuchando en http://0.0.0.0:3010")
 	if err := http.ListenAndServe("0.0.0.0:3010", corsHandler(router)); err != nil {
 		log.Fatalf("Error en el servidor HTTP: %v", err)
@@ -3,9 +3,10 @@ package main
 import (
 	"encoding/json"
 	"equiposmedicos/middleware"
-	"log"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
@@ -31,10 +32,16 @@ func handleRegistrarMovimiento(w http.ResponseWriter, r *http.Request) {
 
 	// Decodificar el movimiento
 	var payload struct {
-		ArticuloID     int     `json:"articulo_id"`
-		TipoMovimiento string  `json:"tipo_movimiento"`
-		Cantidad       float64 `json:"cantidad"`
-		Motivo         string  `json:"motivo"`
+		ArticuloID     int      `json:"articulo_id"`
+		TipoMovimiento string   `json:"tipo_movimiento"`
+		Cantidad       float64  `json:"cantidad"`
+		Motivo         string   `json:"motivo"`
+		CostoUnitario  *float64 `json:"costo_unitario,omitempty"`
+		Version        *int64   `json:"version,omitempty"`
+		AlmacenID      *int     `json:"almacen_id,omitempty"`
+		Series         []string `json:"series,omitempty"`
+		Lote           string   `json:"lote,omitempty"`
+		Caducidad      string   `json:"caducidad,omitempty"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, `{"error":"Error al decodificar JSON: `+err.Error()+`"}`, http.StatusBadRequest)
@@ -47,60 +54,53 @@ func handleRegistrarMovimiento(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Preparar movimiento como map[string]interface{} sin fecha
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	tipo, existe := tipos[payload.TipoMovimiento]
+	if mensaje, status := validarTipoMovimiento(tipo, existe, payload.Motivo, claims); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, status)
+		return
+	}
+
+	// El costo sólo recalcula el promedio en entradas
 	movimiento := map[string]interface{}{
 		"articulo_id":     payload.ArticuloID,
 		"tipo_movimiento": payload.TipoMovimiento,
 		"cantidad":        payload.Cantidad,
+		"delta":           float64(tipo.Signo) * payload.Cantidad,
 		"motivo":          payload.Motivo,
-		// no incluir "fecha" para que PostgreSQL use DEFAULT now()
+		"usuario_nombre":  claims.Email,
 	}
-
-	// Insertar movimiento
-	if err := supabaseClient.DB.
-		From("movimientos_inventario").
-		Insert(movimiento).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al insertar movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+	if payload.CostoUnitario != nil {
+		movimiento["costo_unitario"] = *payload.CostoUnitario
 	}
-
-	// Obtener inventario actual
-	var inventarios []InventarioArticulo
-	err := supabaseClient.DB.
-		From("inventarios").
-		Select("*").
-		Eq("articulo_id", strconv.Itoa(payload.ArticuloID)).
-		Execute(&inventarios)
-	if err != nil || len(inventarios) == 0 {
-		http.Error(w, `{"error":"Inventario no encontrado"}`, http.StatusInternalServerError)
-		return
+	if len(payload.Series) > 0 {
+		movimiento["series"] = payload.Series
 	}
-
-	cantidadActual := inventarios[0].CantidadActual
-
-	// Ajustar inventario según tipo
-	switch payload.TipoMovimiento {
-	case "compra", "transferencia_entrada":
-		cantidadActual += payload.Cantidad
-	case "venta", "baja", "robo", "transferencia_salida":
-		cantidadActual -= payload.Cantidad
-	default:
-		http.Error(w, `{"error":"Tipo de movimiento desconocido o no permitido"}`, http.StatusBadRequest)
-		return
+	// Sin lote, las salidas se surten por FEFO
+	if payload.Lote != "" {
+		movimiento["lote"] = payload.Lote
+		movimiento["caducidad"] = payload.Caducidad
 	}
-
-	// Actualizar inventario con Update (sin fecha)
-	update := map[string]interface{}{
-		"cantidad_actual": cantidadActual,
+	// Sin almacén se usa el predeterminado
+	if payload.AlmacenID != nil {
+		movimiento["almacen_id"] = *payload.AlmacenID
+	}
+	// Versión del inventario que leyó el cliente; si cambió se responde 409
+	if payload.Version != nil {
+		movimiento["version"] = *payload.Version
 	}
 
-	if err := supabaseClient.DB.
-		From("inventarios").
-		Update(update).
-		Eq("articulo_id", strconv.Itoa(payload.ArticuloID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Registrar movimiento, ajustar inventario y costo promedio en una sola transacción
+	var resultado map[string]interface{}
+	err = supabaseClient.DB.Rpc("aplicar_movimiento", map[string]interface{}{
+		"p_movimiento": movimiento,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
 		return
 	}
 
@@ -108,7 +108,13 @@ func handleRegistrarMovimiento(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"message":         "Movimiento registrado e inventario actualizado",
 		"articulo_id":     payload.ArticuloID,
-		"cantidad_actual": cantidadActual,
+		"almacen_id":      resultado["almacen_id"],
+		"cantidad_actual": resultado["cantidad_actual"],
+		"costo_promedio":  resultado["costo_promedio"],
+		"version":         resultado["version"],
+		"backorder":       resultado["backorder"],
+		"alerta":          resultado["alerta"],
+		"lotes":           resultado["lotes"],
 	})
 }
 
@@ -145,7 +151,9 @@ func handleReporteMovimientos(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(movimientos)
 }
 
-// Handler para editar la cantidad de un movimiento existente
+// Handler para editar un movimiento existente. El libro de movimientos es
+// inmutable: se registra un reverso del original y un movimiento nuevo con la
+// cantidad corregida, ambos enlazados al original.
 func handleEditarMovimiento(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPut {
 		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
@@ -169,87 +177,82 @@ func handleEditarMovimiento(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Obtener movimiento original
-	var movimientos []Movimiento
-	err := supabaseClient.DB.
-		From("movimientos_inventario").
-		Select("*").
-		Eq("id", strconv.Itoa(payload.ID)).
-		Execute(&movimientos)
-	if err != nil || len(movimientos) == 0 {
-		http.Error(w, `{"error":"No se encontró el movimiento original"}`, http.StatusNotFound)
+	if payload.ID <= 0 || payload.Cantidad <= 0 {
+		http.Error(w, `{"error":"Datos del movimiento inválidos"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Motivo == "" {
+		http.Error(w, `{"error":"Debe indicar el motivo de la corrección"}`, http.StatusBadRequest)
 		return
 	}
-	original := movimientos[0]
 
-	// Obtener inventario actual
-	var inventarios []InventarioMovimientoArticulo
-	err = supabaseClient.DB.
-		From("inventarios").
-		Select("*").
-		Eq("articulo_id", strconv.Itoa(original.ArticuloID)).
-		Execute(&inventarios)
+	original, status, err := obtenerMovimientoReversible(payload.ID)
 	if err != nil {
-		log.Printf("Error al consultar inventario: %v\n", err)
-		http.Error(w, `{"error":"Error al consultar inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
+		http.Error(w, `{"error":"`+err.Error()+`"}`, status)
 		return
 	}
 
-	if len(inventarios) == 0 {
-		log.Printf("Inventario no encontrado para articulo_id %d\n", original.ArticuloID)
-		http.Error(w, `{"error":"Inventario no encontrado"}`, http.StatusInternalServerError)
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
-
-	cantidadActual := inventarios[0].CantidadActual
-
-	delta := payload.Cantidad - original.Cantidad
-
-	switch original.TipoMovimiento {
-	case "alta", "compra", "transferencia_entrada":
-		cantidadActual += delta
-	case "venta", "baja", "robo", "transferencia_salida":
-		cantidadActual -= delta
-	default:
-		http.Error(w, `{"error":"Tipo de movimiento desconocido"}`, http.StatusBadRequest)
+	tipoOriginal, existe := tipos[original.TipoMovimiento]
+	if mensaje, status := validarTipoMovimiento(tipoOriginal, existe, payload.Motivo, claims); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, status)
 		return
 	}
 
-	if err := supabaseClient.DB.
-		From("inventarios").
-		Update(map[string]interface{}{
-			"cantidad_actual":      cantidadActual,
-			"ultima_actualizacion": time.Now(),
-		}).
-		Eq("articulo_id", strconv.Itoa(original.ArticuloID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+	// El movimiento nuevo conserva el tipo original salvo que se indique otro
+	tipoNuevo := tipoOriginal
+	if payload.TipoMovimiento != "" && payload.TipoMovimiento != original.TipoMovimiento {
+		tipoNuevo, existe = tipos[payload.TipoMovimiento]
+		if mensaje, status := validarTipoMovimiento(tipoNuevo, existe, payload.Motivo, claims); mensaje != "" {
+			http.Error(w, `{"error":"`+mensaje+`"}`, status)
+			return
+		}
 	}
 
-	// Actualizar cantidad en el movimiento original
-	updates := map[string]interface{}{
-		"cantidad": payload.Cantidad,
-		"fecha":    time.Now(),
+	reverso := movimientoReverso(original, tipoOriginal, payload.Motivo, claims.Email)
+	nuevo := map[string]interface{}{
+		"articulo_id":     original.ArticuloID,
+		"tipo_movimiento": tipoNuevo.Clave,
+		"cantidad":        payload.Cantidad,
+		"delta":           float64(tipoNuevo.Signo) * payload.Cantidad,
+		"motivo":          payload.Motivo,
+		"usuario_nombre":  claims.Email,
+		"costo_unitario":  original.CostoUnitario,
+		"almacen_id":      original.AlmacenID,
 	}
-	if err := supabaseClient.DB.
-		From("movimientos_inventario").
-		Update(updates).
-		Eq("id", strconv.Itoa(payload.ID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar cantidad del movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+
+	// Reverso y movimiento nuevo en una sola transacción
+	var resultado struct {
+		Reverso map[string]interface{} `json:"reverso"`
+		Nuevo   map[string]interface{} `json:"nuevo"`
+	}
+	err = supabaseClient.DB.Rpc("reversar_movimiento", map[string]interface{}{
+		"p_movimiento_id": original.ID,
+		"p_reverso":       reverso,
+		"p_nuevo":         nuevo,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
 		return
 	}
 
 	// Respuesta
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":         "Inventario y movimiento actualizados",
-		"articulo_id":     original.ArticuloID,
-		"cantidad_actual": cantidadActual,
+		"message":             "Movimiento corregido con reverso y nuevo registro",
+		"articulo_id":         original.ArticuloID,
+		"movimiento_original": original.ID,
+		"reverso_id":          resultado.Reverso["movimiento_id"],
+		"movimiento_id":       resultado.Nuevo["movimiento_id"],
+		"cantidad_actual":     resultado.Nuevo["cantidad_actual"],
 	})
 }
 
-// Handler para eliminar un movimiento existente y ajustar inventario
+// Handler para eliminar un movimiento existente. No se borra: se registra un
+// reverso enlazado al original que deja el inventario como estaba.
 func handleEliminarMovimiento(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodDelete {
 		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
@@ -266,78 +269,315 @@ func handleEliminarMovimiento(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Decodificar payload con ID
+	// Decodificar payload con ID y motivo
 	var payload struct {
-		ID int `json:"id"`
+		ID     int    `json:"id"`
+		Motivo string `json:"motivo"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
 		http.Error(w, `{"error":"Error al decodificar JSON: `+err.Error()+`"}`, http.StatusBadRequest)
 		return
 	}
+	if payload.Motivo == "" {
+		http.Error(w, `{"error":"Debe indicar el motivo de la eliminación"}`, http.StatusBadRequest)
+		return
+	}
+
+	original, status, err := obtenerMovimientoReversible(payload.ID)
+	if err != nil {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, status)
+		return
+	}
 
-	// Obtener movimiento original
-	var movimientos []Movimiento
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	tipo, existe := tipos[original.TipoMovimiento]
+	if mensaje, status := validarTipoMovimiento(tipo, existe, payload.Motivo, claims); mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, status)
+		return
+	}
+
+	var resultado struct {
+		Reverso map[string]interface{} `json:"reverso"`
+	}
+	err = supabaseClient.DB.Rpc("reversar_movimiento", map[string]interface{}{
+		"p_movimiento_id": original.ID,
+		"p_reverso":       movimientoReverso(original, tipo, payload.Motivo, claims.Email),
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	// Respuesta
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":             "Movimiento revertido e inventario ajustado",
+		"articulo_id":         original.ArticuloID,
+		"movimiento_original": original.ID,
+		"reverso_id":          resultado.Reverso["movimiento_id"],
+		"cantidad_actual":     resultado.Reverso["cantidad_actual"],
+	})
+}
+
+// obtenerMovimientoReversible busca un movimiento que se pueda corregir a
+// mano. Los que vienen de una venta o compra se corrigen editando el
+// documento, para que éste y el inventario no se contradigan.
+func obtenerMovimientoReversible(id int) (MovimientoInventario, int, error) {
+	var movimientos []MovimientoInventario
 	err := supabaseClient.DB.
 		From("movimientos_inventario").
 		Select("*").
-		Eq("id", strconv.Itoa(payload.ID)).
+		Eq("id", strconv.Itoa(id)).
 		Execute(&movimientos)
-	if err != nil || len(movimientos) == 0 {
-		http.Error(w, `{"error":"No se encontró el movimiento original"}`, http.StatusNotFound)
-		return
+	if err != nil {
+		return MovimientoInventario{}, http.StatusInternalServerError, err
 	}
+	if len(movimientos) == 0 {
+		return MovimientoInventario{}, http.StatusNotFound, fmt.Errorf("No se encontró el movimiento original")
+	}
+
 	original := movimientos[0]
+	if original.VentaID != nil || original.CompraID != nil {
+		return original, http.StatusConflict, fmt.Errorf("El movimiento pertenece a una venta o compra, corrija el documento")
+	}
+	return original, 0, nil
+}
 
-	// Obtener inventario actual
-	var inventarios []InventarioMovimientoArticulo
-	err = supabaseClient.DB.
-		From("inventarios").
-		Select("*").
-		Eq("articulo_id", strconv.Itoa(original.ArticuloID)).
-		Execute(&inventarios)
-	if err != nil || len(inventarios) == 0 {
-		http.Error(w, `{"error":"No se pudo obtener inventario"}`, http.StatusInternalServerError)
+// movimientoReverso arma el asiento que anula a original: mismo tipo y
+// cantidad negativa, de modo que signo * cantidad se cancela con el original.
+func movimientoReverso(original MovimientoInventario, tipo TipoMovimiento, motivo, usuario string) map[string]interface{} {
+	return map[string]interface{}{
+		"articulo_id":     original.ArticuloID,
+		"tipo_movimiento": original.TipoMovimiento,
+		"cantidad":        -original.Cantidad,
+		"delta":           -float64(tipo.Signo) * original.Cantidad,
+		"motivo":          "Reverso del movimiento #" + strconv.Itoa(original.ID) + ": " + motivo,
+		"usuario_nombre":  usuario,
+		"costo_unitario":  original.CostoUnitario,
+		"almacen_id":      original.AlmacenID,
+	}
+}
+
+// Handler para /api/articulos/{id}/kardex (GET)
+// Devuelve los movimientos de un artículo en orden cronológico con saldo
+// acumulado, costo unitario y saldo valorizado. Acepta desde y hasta
+// (YYYY-MM-DD); el saldo inicial es la existencia al empezar desde (o antes
+// del primer movimiento registrado). Con almacen_id el saldo es el de ese
+// almacén.
+func handleKardexArticulo(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
 		return
 	}
-	cantidadActual := inventarios[0].CantidadActual
 
-	switch original.TipoMovimiento {
-	case "compra", "transferencia_entrada":
-		cantidadActual -= original.Cantidad
-	case "venta", "baja", "robo", "transferencia_salida":
-		cantidadActual += original.Cantidad
-	default:
-		http.Error(w, `{"error":"Tipo de movimiento desconocido"}`, http.StatusBadRequest)
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validación de token y permisos
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
 		return
 	}
 
-	update := map[string]interface{}{
-		"cantidad_actual":      cantidadActual,
-		"ultima_actualizacion": time.Now(),
+	// Extraer id desde la URL (/api/articulos/{id}/kardex)
+	parts := strings.Split(r.URL.Path, "/")
+	if len(parts) < 5 {
+		http.Error(w, `{"error":"ID no proporcionado"}`, http.StatusBadRequest)
+		return
+	}
+	articuloID, err := strconv.Atoi(parts[3])
+	if err != nil {
+		http.Error(w, `{"error":"ID inválido"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Rango de fechas opcional
+	var desde, hastaExclusivo time.Time
+	if v := r.URL.Query().Get("desde"); v != "" {
+		if desde, err = time.Parse("2006-01-02", v); err != nil {
+			http.Error(w, `{"error":"Fecha 'desde' inválida, use YYYY-MM-DD"}`, http.StatusBadRequest)
+			return
+		}
+	}
+	if v := r.URL.Query().Get("hasta"); v != "" {
+		hasta, err := time.Parse("2006-01-02", v)
+		if err != nil {
+			http.Error(w, `{"error":"Fecha 'hasta' inválida, use YYYY-MM-DD"}`, http.StatusBadRequest)
+			return
+		}
+		hastaExclusivo = hasta.AddDate(0, 0, 1)
+	}
+	almacenID := 0
+	if v := r.URL.Query().Get("almacen_id"); v != "" {
+		if almacenID, err = strconv.Atoi(v); err != nil {
+			http.Error(w, `{"error":"almacen_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Artículo, para el costo de los movimientos sin costo registrado
+	var articulos []InventarioArticulo
+	err = supabaseClient.DB.
+		From("articulos").
+		Select("id", "nombre", "costo").
+		Eq("id", strconv.Itoa(articuloID)).
+		Execute(&articulos)
+	if err != nil || len(articulos) == 0 {
+		http.Error(w, `{"error":"Artículo no encontrado"}`, http.StatusNotFound)
+		return
 	}
-	if err := supabaseClient.DB.
+	articulo := articulos[0]
+
+	// Existencia actual: el saldo se reconstruye hacia atrás desde aquí, como
+	// en existenciasAl, para no depender de que el historial empiece en cero.
+	var existencias []struct {
+		CantidadActual float64 `json:"cantidad_actual"`
+	}
+	query := &supabaseClient.DB.
 		From("inventarios").
-		Update(update).
-		Eq("articulo_id", strconv.Itoa(original.ArticuloID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
+		Select("cantidad_actual").
+		FilterRequestBuilder
+	query = query.Eq("articulo_id", strconv.Itoa(articuloID))
+	if almacenID > 0 {
+		query = query.Eq("almacen_id", strconv.Itoa(almacenID))
+	}
+	if err := query.Execute(&existencias); err != nil {
+		http.Error(w, `{"error":"Error al obtener inventario: `+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
+	actual := 0.0
+	for _, e := range existencias {
+		actual += e.CantidadActual
+	}
 
-	// Eliminar movimiento
-	if err := supabaseClient.DB.
-		From("movimientos_inventario").
-		Delete().
-		Eq("id", strconv.Itoa(payload.ID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al eliminar movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Se traen los movimientos desde el inicio del rango hasta hoy: los
+	// posteriores a hasta también se deshacen para llegar al saldo inicial.
+	movimientos, err := obtenerMovimientos(articuloID, almacenID, desde, time.Time{})
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener movimientos: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	saldoInicial, saldoFinal, kardex, err := armarKardex(actual, movimientos, tipos, articulo.Costo, hastaExclusivo)
+	if err != nil {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusInternalServerError)
 		return
 	}
 
-	// Respuesta
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":         "Movimiento eliminado e inventario ajustado",
-		"articulo_id":     original.ArticuloID,
-		"cantidad_actual": cantidadActual,
+		"articulo_id":   articulo.ID,
+		"nombre":        articulo.Nombre,
+		"almacen_id":    almacenID,
+		"saldo_inicial": saldoInicial,
+		"saldo_final":   saldoFinal,
+		"movimientos":   kardex,
 	})
 }
+
+// armarKardex arma los renglones del kardex a partir de la existencia actual
+// y de los movimientos desde el inicio del rango hasta hoy, en orden
+// cronológico. El saldo inicial es la existencia actual menos lo que aportó
+// cada uno de esos movimientos; desde ahí se acumula hacia adelante hasta
+// antes de hasta (sin límite si es cero). Un tipo de movimiento desconocido es
+// un error: sin su signo el saldo no cuadra.
+func armarKardex(actual float64, movimientos []MovimientoInventario, tipos map[string]TipoMovimiento, costoArticulo float64, hasta time.Time) (float64, float64, []KardexMovimiento, error) {
+	saldoInicial := actual
+	for _, m := range movimientos {
+		tipo, ok := tipos[m.TipoMovimiento]
+		if !ok {
+			return 0, 0, nil, fmt.Errorf("Tipo de movimiento desconocido %q en el movimiento %d", m.TipoMovimiento, m.ID)
+		}
+		saldoInicial -= float64(tipo.Signo) * m.Cantidad
+	}
+
+	hastaStr := hasta.Format("2006-01-02")
+	saldo := saldoInicial
+	kardex := []KardexMovimiento{}
+	for _, m := range movimientos {
+		if !hasta.IsZero() && m.Fecha >= hastaStr {
+			break
+		}
+		tipo := tipos[m.TipoMovimiento]
+		saldo += float64(tipo.Signo) * m.Cantidad
+
+		costo := costoArticulo
+		if m.CostoUnitario != nil {
+			costo = *m.CostoUnitario
+		}
+		promedio := costo
+		if m.CostoPromedio != nil {
+			promedio = *m.CostoPromedio
+		}
+
+		renglon := KardexMovimiento{
+			ID:              m.ID,
+			Fecha:           m.Fecha,
+			TipoMovimiento:  m.TipoMovimiento,
+			Motivo:          m.Motivo,
+			UsuarioNombre:   m.UsuarioNombre,
+			VentaID:         m.VentaID,
+			CompraID:        m.CompraID,
+			Saldo:           saldo,
+			CostoUnitario:   costo,
+			CostoPromedio:   promedio,
+			SaldoValorizado: saldo * promedio,
+		}
+		if tipo.Signo > 0 {
+			renglon.Entrada = m.Cantidad
+		} else {
+			renglon.Salida = m.Cantidad
+		}
+		kardex = append(kardex, renglon)
+	}
+
+	return saldoInicial, saldo, kardex, nil
+}
+
+// obtenerMovimientos trae en orden cronológico los movimientos de un artículo
+// (de todos si articuloID es 0) en un almacén (en todos si almacenID es 0)
+// desde el día desde y anteriores a hasta (sin límite si son cero). Pagina la
+// consulta para no quedar corto por el máximo de filas de Supabase.
+func obtenerMovimientos(articuloID, almacenID int, desde, hasta time.Time) ([]MovimientoInventario, error) {
+	const tamanoPagina = 1000
+
+	movimientos := []MovimientoInventario{}
+	for inicio := 0; ; inicio += tamanoPagina {
+		query := &supabaseClient.DB.
+			From("movimientos_inventario").
+			Select("*").
+			OrderBy("fecha,id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			FilterRequestBuilder
+		if articuloID > 0 {
+			query = query.Eq("articulo_id", strconv.Itoa(articuloID))
+		}
+		if almacenID > 0 {
+			query = query.Eq("almacen_id", strconv.Itoa(almacenID))
+		}
+		if !desde.IsZero() {
+			query = query.Gte("fecha", desde.Format("2006-01-02"))
+		}
+		if !hasta.IsZero() {
+			query = query.Lt("fecha", hasta.Format("2006-01-02"))
+		}
+
+		var pagina []MovimientoInventario
+		if err := query.Execute(&pagina); err != nil {
+			return nil, err
+		}
+		movimientos = append(movimientos, pagina...)
+		if len(pagina) < tamanoPagina {
+			return movimientos, nil
+		}
+	}
+}
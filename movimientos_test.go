@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestArmarKardex(t *testing.T) {
+	tipos := map[string]TipoMovimiento{
+		"compra": {Clave: "compra", Signo: 1},
+		"venta":  {Clave: "venta", Signo: -1},
+	}
+
+	compra := func(id int, fecha string, cantidad float64) MovimientoInventario {
+		return MovimientoInventario{ID: id, Fecha: fecha, TipoMovimiento: "compra", Cantidad: cantidad}
+	}
+	venta := func(id int, fecha string, cantidad float64) MovimientoInventario {
+		return MovimientoInventario{ID: id, Fecha: fecha, TipoMovimiento: "venta", Cantidad: cantidad}
+	}
+
+	casos := []struct {
+		nombre      string
+		actual      float64
+		movimientos []MovimientoInventario
+		hasta       time.Time
+		inicial     float64
+		saldos      []float64
+		final       float64
+	}{
+		{
+			nombre:      "historial completo desde cero",
+			actual:      8,
+			movimientos: []MovimientoInventario{compra(1, "2024-03-01T10:00:00", 10), venta(2, "2024-03-05T10:00:00", 2)},
+			inicial:     0,
+			saldos:      []float64{10, 8},
+			final:       8,
+		},
+		{
+			nombre:      "existencia cargada antes del primer movimiento",
+			actual:      15,
+			movimientos: []MovimientoInventario{compra(1, "2024-03-01T10:00:00", 10), venta(2, "2024-03-05T10:00:00", 2)},
+			inicial:     7,
+			saldos:      []float64{17, 15},
+			final:       15,
+		},
+		{
+			nombre:      "los movimientos posteriores a hasta se deshacen pero no se listan",
+			actual:      15,
+			movimientos: []MovimientoInventario{compra(1, "2024-03-01T10:00:00", 10), venta(2, "2024-03-05T10:00:00", 2)},
+			hasta:       time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC),
+			inicial:     7,
+			saldos:      []float64{17},
+			final:       17,
+		},
+		{
+			nombre:      "un reverso cancela al original",
+			actual:      0,
+			movimientos: []MovimientoInventario{compra(1, "2024-03-01T10:00:00", 5), compra(2, "2024-03-02T10:00:00", -5)},
+			inicial:     0,
+			saldos:      []float64{5, 0},
+			final:       0,
+		},
+		{
+			nombre:  "sin movimientos el saldo es la existencia",
+			actual:  4,
+			inicial: 4,
+			final:   4,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			inicial, final, kardex, err := armarKardex(c.actual, c.movimientos, tipos, 1, c.hasta)
+			if err != nil {
+				t.Fatalf("error inesperado: %v", err)
+			}
+			if inicial != c.inicial || final != c.final {
+				t.Errorf("saldo inicial %v y final %v, se esperaban %v y %v", inicial, final, c.inicial, c.final)
+			}
+			if len(kardex) != len(c.saldos) {
+				t.Fatalf("se obtuvieron %d renglones, se esperaban %d", len(kardex), len(c.saldos))
+			}
+			for i, saldo := range c.saldos {
+				if kardex[i].Saldo != saldo {
+					t.Errorf("renglón %d: saldo %v, se esperaba %v", i, kardex[i].Saldo, saldo)
+				}
+			}
+		})
+	}
+
+	t.Run("tipo desconocido es error", func(t *testing.T) {
+		movimientos := []MovimientoInventario{{ID: 9, TipoMovimiento: "desconocido", Cantidad: 3}}
+		if _, _, _, err := armarKardex(3, movimientos, tipos, 1, time.Time{}); err == nil {
+			t.Fatal("se esperaba error por el tipo desconocido")
+		}
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+)
+
+var errPDFShiftSinClave = errors.New("PDFShift API key no configurada")
+
+// convertirPDF manda a PDFShift el payload (source con una URL o con el HTML
+// del documento, márgenes, encabezado, etc.) y devuelve el PDF generado.
+func convertirPDF(payload map[string]interface{}) ([]byte, error) {
+	apiKey := os.Getenv("PDFSHIFT_API_KEY")
+	if apiKey == "" {
+		return nil, errPDFShiftSinClave
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, fmt.Errorf("error creando payload: %w", err)
+	}
+
+	req, err := http.NewRequest(
+		"POST",
+		"https://api.pdfshift.io/v3/convert/pdf",
+		bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error creando request: %w", err)
+	}
+
+	// 🔑 AUTENTICACIÓN CORRECTA
+	req.Header.Set("X-API-Key", apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error llamando PDFShift: %w", err)
+	}
+	defer resp.Body.Close()
+
+	contenido, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error leyendo respuesta de PDFShift: %w", err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		log.Println("PDFSHIFT ERROR:", string(contenido))
+		return nil, fmt.Errorf("PDFShift respondió %d: %s", resp.StatusCode, contenido)
+	}
+
+	return contenido, nil
+}
+
+// responderPDF envía el PDF como descarga con el nombre de archivo indicado.
+func responderPDF(w http.ResponseWriter, pdf []byte, archivo string) {
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", `attachment; filename="`+archivo+`"`)
+	w.Write(pdf)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Handler para /api/inventario/politicas (GET, POST). La política se evalúa en
+// la base al aplicar cada salida, tanto en movimientos manuales como en ventas.
+func handlePoliticasStock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		var politicas []PoliticaStockNegativo
+		if err := supabaseClient.DB.From("politicas_stock_negativo").Select("*").OrderBy("id", "asc").Execute(&politicas); err != nil {
+			http.Error(w, `{"error":"Error al obtener políticas: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if politicas == nil {
+			politicas = []PoliticaStockNegativo{}
+		}
+
+		json.NewEncoder(w).Encode(politicas)
+		return
+	}
+
+	// POST: registrar una política
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload PoliticaStockNegativo
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch payload.Accion {
+	case "permitir", "rechazar", "backorder":
+	default:
+		http.Error(w, `{"error":"La acción debe ser permitir, rechazar o backorder"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.ArticuloID != nil && payload.CategoriaID != nil {
+		http.Error(w, `{"error":"Indique artículo o categoría, no ambos"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.TipoMovimiento != nil {
+		tipos, err := obtenerTiposMovimiento()
+		if err != nil {
+			http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if tipo, ok := tipos[*payload.TipoMovimiento]; !ok || tipo.Signo > 0 {
+			http.Error(w, `{"error":"La política sólo aplica a tipos de salida registrados"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	var results []PoliticaStockNegativo
+	err := supabaseClient.DB.From("politicas_stock_negativo").Insert(map[string]interface{}{
+		"articulo_id":     payload.ArticuloID,
+		"categoria_id":    payload.CategoriaID,
+		"tipo_movimiento": payload.TipoMovimiento,
+		"accion":          payload.Accion,
+	}).Execute(&results)
+	if err != nil {
+		if esViolacionUnica(err) {
+			http.Error(w, `{"error":"Ya existe una política para ese artículo, categoría y tipo de movimiento"}`, http.StatusConflict)
+			return
+		}
+		http.Error(w, `{"error":"Error al guardar política: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if len(results) > 0 {
+		json.NewEncoder(w).Encode(results[0])
+	} else {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// Handler para /api/inventario/politicas/eliminar/{id} (DELETE)
+func handleEliminarPoliticaStock(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("delete") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/inventario/politicas/eliminar/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, `{"error":"ID inválido"}`, http.StatusBadRequest)
+		return
+	}
+
+	var results []PoliticaStockNegativo
+	err = supabaseClient.DB.From("politicas_stock_negativo").Delete().Eq("id", strconv.Itoa(id)).Execute(&results)
+	if err != nil {
+		http.Error(w, `{"error":"Error al eliminar: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(results) == 0 {
+		http.Error(w, `{"error":"Política no encontrada"}`, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results[0])
+}
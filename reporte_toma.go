@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// GET /api/inventario/tomas/{id}/reporte. Variación de la toma por línea y por
+// categoría (contra lo esperado: teórico más los movimientos posteriores al
+// corte), en unidades y en dinero al costo, con el porcentaje de merma
+// (faltante valorizado entre valor teórico). Las líneas sin contar se señalan
+// y quedan fuera de los totales, igual que el cierre no las ajusta.
+// ?formato=csv o ?formato=pdf descargan el reporte; el PDF lleva el folio y el
+// responsable para firma.
+func handleReporteToma(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	formato := r.URL.Query().Get("formato")
+	switch formato {
+	case "", "json", "csv", "pdf":
+	default:
+		http.Error(w, `{"error":"Formato inválido; use json, csv o pdf"}`, http.StatusBadRequest)
+		return
+	}
+
+	var tomas []TomaInventario
+	err := supabaseClient.DB.From("tomafisica_view").Select("*").Eq("id", strconv.Itoa(tomaID)).Execute(&tomas)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(tomas) == 0 {
+		http.Error(w, `{"error":"Toma no encontrada"}`, http.StatusNotFound)
+		return
+	}
+	toma := tomas[0]
+
+	// El reporte muestra lo teórico; en una toma ciega no antes de la revisión
+	if toma.Ciega && (toma.Estado == "abierta" || toma.Estado == "en_conteo") {
+		http.Error(w, `{"error":"La toma es ciega; el reporte está disponible a partir de la revisión"}`, http.StatusConflict)
+		return
+	}
+
+	// Se pagina para no quedar corto por el máximo de filas de Supabase
+	const tamanoPagina = 1000
+
+	lineas := []VariacionToma{}
+	for inicio := 0; ; inicio += tamanoPagina {
+		var pagina []VariacionToma
+		err = supabaseClient.DB.
+			From("tomafisica_variacion_view").
+			Select("*").
+			OrderBy("categoria_nombre,nombre,detalle_id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			Eq("toma_id", strconv.Itoa(tomaID)).
+			Execute(&pagina)
+		if err != nil {
+			http.Error(w, `{"error":"Error al obtener las líneas de la toma: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		lineas = append(lineas, pagina...)
+		if len(pagina) < tamanoPagina {
+			break
+		}
+	}
+
+	categorias, total := resumirVariaciones(lineas)
+
+	switch formato {
+	case "csv":
+		escribirReporteTomaCSV(w, toma, lineas, categorias, total)
+	case "pdf":
+		html, err := reporteTomaHTML(toma, lineas, categorias, total)
+		if err != nil {
+			http.Error(w, `{"error":"Error al generar el reporte: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		pdf, err := convertirPDF(map[string]interface{}{
+			"source": html,
+			"margin": "10mm",
+			"footer": map[string]interface{}{
+				"source": `<div style="font-size:8px;text-align:center;width:100%">Toma folio ` + strconv.Itoa(toma.Folio) + ` · Página {{page}} de {{total}}</div>`,
+			},
+		})
+		if err != nil {
+			http.Error(w, `{"error":"Error al generar el PDF: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		responderPDF(w, pdf, "reporte_toma_"+strconv.Itoa(toma.Folio)+".pdf")
+	default:
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"toma":       toma,
+			"lineas":     lineas,
+			"categorias": categorias,
+			"total":      total,
+		})
+	}
+}
+
+// resumirVariaciones acumula las líneas por categoría (en el orden en que
+// llegan) y en un total general. Las líneas sin contar sólo se cuentan.
+func resumirVariaciones(lineas []VariacionToma) ([]*ResumenVariacion, *ResumenVariacion) {
+	categorias := []*ResumenVariacion{}
+	indice := map[string]*ResumenVariacion{}
+	total := &ResumenVariacion{CategoriaNombre: "Total"}
+
+	for _, l := range lineas {
+		nombre := "Sin categoría"
+		if l.CategoriaNombre != nil {
+			nombre = *l.CategoriaNombre
+		}
+		resumen, existe := indice[nombre]
+		if !existe {
+			resumen = &ResumenVariacion{CategoriaID: l.CategoriaID, CategoriaNombre: nombre}
+			indice[nombre] = resumen
+			categorias = append(categorias, resumen)
+		}
+		resumen.acumular(l)
+		total.acumular(l)
+	}
+
+	for _, c := range categorias {
+		c.calcularMerma()
+	}
+	total.calcularMerma()
+
+	return categorias, total
+}
+
+func (r *ResumenVariacion) acumular(l VariacionToma) {
+	if !l.Contada || l.CantidadReal == nil {
+		r.LineasSinContar++
+		return
+	}
+
+	r.Lineas++
+	r.UnidadesTeoricas += l.CantidadTeorica
+	r.UnidadesContadas += *l.CantidadReal
+	if l.Diferencia != nil {
+		r.UnidadesDiferencia += *l.Diferencia
+	}
+	r.ValorTeorico += l.ValorTeorico
+	if l.ValorDiferencia != nil {
+		r.ValorDiferencia += *l.ValorDiferencia
+		if *l.ValorDiferencia > 0 {
+			r.ValorSobrante += *l.ValorDiferencia
+		} else {
+			r.ValorFaltante -= *l.ValorDiferencia
+		}
+	}
+}
+
+func (r *ResumenVariacion) calcularMerma() {
+	if r.ValorTeorico != 0 {
+		r.MermaPct = r.ValorFaltante / r.ValorTeorico * 100
+	}
+}
+
+func escribirReporteTomaCSV(w http.ResponseWriter, toma TomaInventario, lineas []VariacionToma, categorias []*ResumenVariacion, total *ResumenVariacion) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="reporte_toma_`+strconv.Itoa(toma.Folio)+`.csv"`)
+
+	numero := func(v float64) string {
+		return strconv.FormatFloat(v, 'f', 2, 64)
+	}
+	// Las líneas sin contar quedan en blanco
+	opcional := func(v *float64) string {
+		if v == nil {
+			return ""
+		}
+		return numero(*v)
+	}
+
+	escritor := csv.NewWriter(w)
+	escritor.Write([]string{"folio", strconv.Itoa(toma.Folio), "almacen", toma.AlmacenNombre, "responsable", toma.UsuarioCorreo})
+	escritor.Write([]string{
+		"categoria", "articulo_id", "articulo", "marca", "codigo_barras",
+		"cantidad_teorica", "movimientos_corte", "cantidad_esperada", "cantidad_real", "diferencia", "costo",
+		"valor_teorico", "valor_diferencia", "contada",
+	})
+	for _, l := range lineas {
+		categoria := "Sin categoría"
+		if l.CategoriaNombre != nil {
+			categoria = *l.CategoriaNombre
+		}
+		contada := "si"
+		if !l.Contada {
+			contada = "no"
+		}
+		escritor.Write([]string{
+			categoria, strconv.Itoa(l.ArticuloID), l.Nombre, l.Marca, l.CodigoBarras,
+			numero(l.CantidadTeorica), numero(l.MovimientosCorte), numero(l.CantidadEsperada),
+			opcional(l.CantidadReal), opcional(l.Diferencia), numero(l.Costo),
+			numero(l.ValorTeorico), opcional(l.ValorDiferencia), contada,
+		})
+	}
+
+	escritor.Write([]string{})
+	escritor.Write([]string{
+		"categoria", "lineas", "lineas_sin_contar", "unidades_teoricas", "unidades_contadas", "unidades_diferencia",
+		"valor_teorico", "valor_sobrante", "valor_faltante", "valor_diferencia", "merma_pct",
+	})
+	for _, c := range append(categorias, total) {
+		escritor.Write([]string{
+			c.CategoriaNombre, strconv.Itoa(c.Lineas), strconv.Itoa(c.LineasSinContar),
+			numero(c.UnidadesTeoricas), numero(c.UnidadesContadas),
+			numero(c.UnidadesDiferencia), numero(c.ValorTeorico), numero(c.ValorSobrante),
+			numero(c.ValorFaltante), numero(c.ValorDiferencia), numero(c.MermaPct),
+		})
+	}
+	escritor.Flush()
+}
+
+var plantillaReporteToma = template.Must(template.New("reporte_toma").Funcs(template.FuncMap{
+	"num": func(v float64) string { return strconv.FormatFloat(v, 'f', 2, 64) },
+	"dinero": func(v float64) string {
+		return fmt.Sprintf("$%.2f", v)
+	},
+	// Cantidades y valores que una línea sin contar no tiene
+	"numOpt": func(v *float64) string {
+		if v == nil {
+			return "—"
+		}
+		return strconv.FormatFloat(*v, 'f', 2, 64)
+	},
+	"dineroOpt": func(v *float64) string {
+		if v == nil {
+			return "—"
+		}
+		return fmt.Sprintf("$%.2f", *v)
+	},
+	"categoria": func(nombre *string) string {
+		if nombre == nil {
+			return "Sin categoría"
+		}
+		return *nombre
+	},
+}).Parse(`<!DOCTYPE html>
+<html lang="es">
+<head>
+<meta charset="utf-8">
+<style>
+	body { font-family: Arial, sans-serif; font-size: 10px; color: #222; }
+	h1 { font-size: 16px; margin: 0 0 4px; }
+	h2 { font-size: 12px; margin: 16px 0 4px; }
+	table { width: 100%; border-collapse: collapse; }
+	th, td { border: 1px solid #bbb; padding: 3px 4px; }
+	th { background: #eee; text-align: left; }
+	td.n { text-align: right; }
+	tr.total td { font-weight: bold; background: #f5f5f5; }
+	tr.sin-contar td { color: #888; font-style: italic; }
+	.firmas { margin-top: 40px; display: flex; justify-content: space-between; }
+	.firma { width: 40%; border-top: 1px solid #222; padding-top: 4px; text-align: center; }
+</style>
+</head>
+<body>
+<h1>Reporte de variaciones · Toma física folio {{.Toma.Folio}}</h1>
+<div>Almacén: {{.Toma.AlmacenNombre}}{{if .Toma.CategoriaNombre}} · Categoría: {{.Toma.CategoriaNombre}}{{end}} · Estado: {{.Toma.Estado}}</div>
+<div>Inicio: {{.Toma.FechaInicio}}{{if .Toma.FechaFin}} · Fin: {{.Toma.FechaFin}}{{end}} · Generado: {{.Generado}}</div>
+
+<h2>Resumen por categoría</h2>
+<table>
+<tr><th>Categoría</th><th>Líneas</th><th>Sin contar</th><th>Unid. teóricas</th><th>Unid. contadas</th><th>Dif. unid.</th><th>Valor teórico</th><th>Sobrante</th><th>Faltante</th><th>Dif. valor</th><th>Merma %</th></tr>
+{{range .Categorias}}<tr><td>{{.CategoriaNombre}}</td><td class="n">{{.Lineas}}</td><td class="n">{{.LineasSinContar}}</td><td class="n">{{num .UnidadesTeoricas}}</td><td class="n">{{num .UnidadesContadas}}</td><td class="n">{{num .UnidadesDiferencia}}</td><td class="n">{{dinero .ValorTeorico}}</td><td class="n">{{dinero .ValorSobrante}}</td><td class="n">{{dinero .ValorFaltante}}</td><td class="n">{{dinero .ValorDiferencia}}</td><td class="n">{{num .MermaPct}}</td></tr>
+{{end}}{{with .Total}}<tr class="total"><td>{{.CategoriaNombre}}</td><td class="n">{{.Lineas}}</td><td class="n">{{.LineasSinContar}}</td><td class="n">{{num .UnidadesTeoricas}}</td><td class="n">{{num .UnidadesContadas}}</td><td class="n">{{num .UnidadesDiferencia}}</td><td class="n">{{dinero .ValorTeorico}}</td><td class="n">{{dinero .ValorSobrante}}</td><td class="n">{{dinero .ValorFaltante}}</td><td class="n">{{dinero .ValorDiferencia}}</td><td class="n">{{num .MermaPct}}</td></tr>{{end}}
+</table>
+
+<h2>Detalle por artículo</h2>
+{{if .Total.LineasSinContar}}<div>Líneas sin contar: {{.Total.LineasSinContar}}. No entran en los totales y el cierre no las ajusta.</div>
+{{end}}
+<table>
+<tr><th>Categoría</th><th>Artículo</th><th>Marca</th><th>Código</th><th>Teórica</th><th>Mov. posteriores</th><th>Esperada</th><th>Real</th><th>Dif.</th><th>Costo</th><th>Dif. valor</th></tr>
+{{range .Lineas}}<tr{{if not .Contada}} class="sin-contar"{{end}}><td>{{categoria .CategoriaNombre}}</td><td>{{.Nombre}}</td><td>{{.Marca}}</td><td>{{.CodigoBarras}}</td><td class="n">{{num .CantidadTeorica}}</td><td class="n">{{num .MovimientosCorte}}</td><td class="n">{{num .CantidadEsperada}}</td><td class="n">{{if .Contada}}{{numOpt .CantidadReal}}{{else}}Sin contar{{end}}</td><td class="n">{{numOpt .Diferencia}}</td><td class="n">{{dinero .Costo}}</td><td class="n">{{dineroOpt .ValorDiferencia}}</td></tr>
+{{end}}</table>
+
+<div class="firmas">
+	<div class="firma">Responsable de la toma<br>{{.Toma.UsuarioCorreo}}</div>
+	<div class="firma">Autorizó</div>
+</div>
+</body>
+</html>
+`))
+
+// reporteTomaHTML arma el documento que PDFShift convierte en PDF.
+func reporteTomaHTML(toma TomaInventario, lineas []VariacionToma, categorias []*ResumenVariacion, total *ResumenVariacion) (string, error) {
+	var html bytes.Buffer
+	err := plantillaReporteToma.Execute(&html, map[string]interface{}{
+		"Toma":       toma,
+		"Lineas":     lineas,
+		"Categorias": categorias,
+		"Total":      total,
+		"Generado":   time.Now().Format("2006-01-02 15:04"),
+	})
+	return html.String(), err
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestResumirVariaciones(t *testing.T) {
+	flotante := func(v float64) *float64 { return &v }
+	texto := func(v string) *string { return &v }
+
+	// contada arma una línea contada con su diferencia a costo
+	contada := func(categoria *string, teorica, real, costo float64) VariacionToma {
+		diferencia := real - teorica
+		return VariacionToma{
+			CategoriaNombre: categoria,
+			CantidadTeorica: teorica,
+			CantidadReal:    flotante(real),
+			Diferencia:      flotante(diferencia),
+			Costo:           costo,
+			ValorTeorico:    teorica * costo,
+			ValorDiferencia: flotante(diferencia * costo),
+			Contada:         true,
+		}
+	}
+	sinContar := func(categoria *string, teorica, costo float64) VariacionToma {
+		return VariacionToma{
+			CategoriaNombre: categoria,
+			CantidadTeorica: teorica,
+			Costo:           costo,
+			ValorTeorico:    teorica * costo,
+		}
+	}
+
+	casos := []struct {
+		nombre     string
+		lineas     []VariacionToma
+		categorias []ResumenVariacion
+		total      ResumenVariacion
+	}{
+		{
+			nombre: "sin líneas",
+			total:  ResumenVariacion{CategoriaNombre: "Total"},
+		},
+		{
+			nombre: "sobrante y faltante por categoría",
+			lineas: []VariacionToma{
+				contada(texto("Guantes"), 10, 8, 5),
+				contada(texto("Guantes"), 4, 5, 10),
+				contada(nil, 2, 2, 1),
+			},
+			categorias: []ResumenVariacion{
+				{
+					CategoriaNombre: "Guantes", Lineas: 2,
+					UnidadesTeoricas: 14, UnidadesContadas: 13, UnidadesDiferencia: -1,
+					ValorTeorico: 90, ValorSobrante: 10, ValorFaltante: 10, ValorDiferencia: 0,
+					MermaPct: 10.0 / 90 * 100,
+				},
+				{
+					CategoriaNombre: "Sin categoría", Lineas: 1,
+					UnidadesTeoricas: 2, UnidadesContadas: 2, ValorTeorico: 2,
+				},
+			},
+			total: ResumenVariacion{
+				CategoriaNombre: "Total", Lineas: 3,
+				UnidadesTeoricas: 16, UnidadesContadas: 15, UnidadesDiferencia: -1,
+				ValorTeorico: 92, ValorSobrante: 10, ValorFaltante: 10,
+				MermaPct: 10.0 / 92 * 100,
+			},
+		},
+		{
+			nombre: "las líneas sin contar no son merma",
+			lineas: []VariacionToma{
+				contada(texto("Jeringas"), 10, 10, 2),
+				sinContar(texto("Jeringas"), 50, 2),
+			},
+			categorias: []ResumenVariacion{
+				{
+					CategoriaNombre: "Jeringas", Lineas: 1, LineasSinContar: 1,
+					UnidadesTeoricas: 10, UnidadesContadas: 10, ValorTeorico: 20,
+				},
+			},
+			total: ResumenVariacion{
+				CategoriaNombre: "Total", Lineas: 1, LineasSinContar: 1,
+				UnidadesTeoricas: 10, UnidadesContadas: 10, ValorTeorico: 20,
+			},
+		},
+		{
+			nombre: "categoría sólo con líneas sin contar",
+			lineas: []VariacionToma{
+				sinContar(texto("Batas"), 3, 7),
+			},
+			categorias: []ResumenVariacion{
+				{CategoriaNombre: "Batas", LineasSinContar: 1},
+			},
+			total: ResumenVariacion{CategoriaNombre: "Total", LineasSinContar: 1},
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			categorias, total := resumirVariaciones(c.lineas)
+			if len(categorias) != len(c.categorias) {
+				t.Fatalf("se obtuvieron %d categorías, se esperaban %d", len(categorias), len(c.categorias))
+			}
+			for i, esperado := range c.categorias {
+				compararResumen(t, *categorias[i], esperado)
+			}
+			compararResumen(t, *total, c.total)
+		})
+	}
+}
+
+func compararResumen(t *testing.T, obtenido, esperado ResumenVariacion) {
+	t.Helper()
+	if obtenido.CategoriaNombre != esperado.CategoriaNombre ||
+		obtenido.Lineas != esperado.Lineas ||
+		obtenido.LineasSinContar != esperado.LineasSinContar {
+		t.Errorf("%s: se obtuvo %+v, se esperaba %+v", esperado.CategoriaNombre, obtenido, esperado)
+		return
+	}
+
+	valores := []struct {
+		campo              string
+		obtenido, esperado float64
+	}{
+		{"unidades_teoricas", obtenido.UnidadesTeoricas, esperado.UnidadesTeoricas},
+		{"unidades_contadas", obtenido.UnidadesContadas, esperado.UnidadesContadas},
+		{"unidades_diferencia", obtenido.UnidadesDiferencia, esperado.UnidadesDiferencia},
+		{"valor_teorico", obtenido.ValorTeorico, esperado.ValorTeorico},
+		{"valor_sobrante", obtenido.ValorSobrante, esperado.ValorSobrante},
+		{"valor_faltante", obtenido.ValorFaltante, esperado.ValorFaltante},
+		{"valor_diferencia", obtenido.ValorDiferencia, esperado.ValorDiferencia},
+		{"merma_pct", obtenido.MermaPct, esperado.MermaPct},
+	}
+	for _, v := range valores {
+		if math.Abs(v.obtenido-v.esperado) > 1e-9 {
+			t.Errorf("%s %s: se obtuvo %v, se esperaba %v", esperado.CategoriaNombre, v.campo, v.obtenido, v.esperado)
+		}
+	}
+}
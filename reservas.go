@@ -0,0 +1,224 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Vigencia de una reserva cuando no se indica expira_en
+const diasReservaPredeterminados = 7
+
+// parsearExpiraReserva interpreta el expira_en de una reserva: RFC3339, o
+// YYYY-MM-DD para que venza al final de ese día en la zona de ahora (la hora
+// local del servidor, no UTC). Vacío da la vigencia predeterminada a partir
+// de ahora; una fecha que no sea futura es un error.
+func parsearExpiraReserva(valor string, ahora time.Time) (time.Time, error) {
+	if valor == "" {
+		return ahora.AddDate(0, 0, diasReservaPredeterminados), nil
+	}
+
+	expira, err := time.Parse(time.RFC3339, valor)
+	if err != nil {
+		dia, errDia := time.ParseInLocation("2006-01-02", valor, ahora.Location())
+		if errDia != nil {
+			return time.Time{}, errors.New("expira_en inválida, use RFC3339 o YYYY-MM-DD")
+		}
+		expira = dia.AddDate(0, 0, 1).Add(-time.Second)
+	}
+	if !expira.After(ahora) {
+		return time.Time{}, errors.New("expira_en debe ser una fecha futura")
+	}
+	return expira, nil
+}
+
+// Handler para /api/reservas (GET, POST). GET lista las reservas, por defecto
+// sólo las activas; ?estado=todas las incluye todas y ?articulo_id filtra.
+// POST aparta una cantidad para un cliente o documento (cotización, pedido)
+// siempre que lo disponible alcance.
+func handleReservas(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		query := &supabaseClient.DB.
+			From("reservas").
+			Select("*").
+			OrderBy("expira_en", "asc").
+			FilterRequestBuilder
+		switch estado := r.URL.Query().Get("estado"); estado {
+		case "":
+			query = query.Eq("estado", "activa")
+		case "todas":
+		case "activa", "consumida", "liberada", "vencida":
+			query = query.Eq("estado", estado)
+		default:
+			http.Error(w, `{"error":"Estado inválido"}`, http.StatusBadRequest)
+			return
+		}
+		if articuloID := r.URL.Query().Get("articulo_id"); articuloID != "" {
+			if _, err := strconv.Atoi(articuloID); err != nil {
+				http.Error(w, `{"error":"articulo_id inválido"}`, http.StatusBadRequest)
+				return
+			}
+			query = query.Eq("articulo_id", articuloID)
+		}
+
+		var reservas []Reserva
+		if err := query.Execute(&reservas); err != nil {
+			http.Error(w, `{"error":"Error al obtener reservas: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if reservas == nil {
+			reservas = []Reserva{}
+		}
+
+		json.NewEncoder(w).Encode(reservas)
+		return
+	}
+
+	// POST: crear reserva
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		ArticuloID    int     `json:"articulo_id"`
+		AlmacenID     *int    `json:"almacen_id,omitempty"`
+		Cantidad      float64 `json:"cantidad"`
+		ClienteNombre string  `json:"cliente_nombre"`
+		Documento     string  `json:"documento"`
+		Notas         string  `json:"notas"`
+		ExpiraEn      string  `json:"expira_en"` // RFC3339 o YYYY-MM-DD (fin de ese día)
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.ArticuloID <= 0 || payload.Cantidad <= 0 {
+		http.Error(w, `{"error":"Debe indicar articulo_id y una cantidad mayor a cero"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.ClienteNombre == "" && payload.Documento == "" {
+		http.Error(w, `{"error":"Debe indicar el cliente o el documento de la reserva"}`, http.StatusBadRequest)
+		return
+	}
+
+	expira, err := parsearExpiraReserva(payload.ExpiraEn, time.Now())
+	if err != nil {
+		http.Error(w, `{"error":"`+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	reserva := map[string]interface{}{
+		"articulo_id":    payload.ArticuloID,
+		"almacen_id":     payload.AlmacenID,
+		"cantidad":       payload.Cantidad,
+		"expira_en":      expira.Format(time.RFC3339),
+		"usuario_nombre": claims.Email,
+	}
+	if payload.ClienteNombre != "" {
+		reserva["cliente_nombre"] = payload.ClienteNombre
+	}
+	if payload.Documento != "" {
+		reserva["documento"] = payload.Documento
+	}
+	if payload.Notas != "" {
+		reserva["notas"] = payload.Notas
+	}
+
+	// La validación de lo disponible y el alta ocurren en la misma transacción
+	var resultado map[string]interface{}
+	err = supabaseClient.DB.Rpc("crear_reserva", map[string]interface{}{
+		"p_reserva": reserva,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resultado)
+}
+
+// Handler para /api/reservas/liberar/{id} (PUT). Libera una reserva activa
+// antes de su vencimiento.
+func handleLiberarReserva(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("update") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	idStr := strings.TrimPrefix(r.URL.Path, "/api/reservas/liberar/")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		http.Error(w, `{"error":"ID inválido"}`, http.StatusBadRequest)
+		return
+	}
+
+	var results []Reserva
+	err = supabaseClient.DB.From("reservas").Update(map[string]interface{}{
+		"estado":      "liberada",
+		"liberada_en": time.Now().Format(time.RFC3339),
+	}).Eq("id", strconv.Itoa(id)).Eq("estado", "activa").Execute(&results)
+	if err != nil {
+		http.Error(w, `{"error":"Error al liberar reserva: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(results) == 0 {
+		http.Error(w, `{"error":"Reserva no encontrada o ya no está activa"}`, http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(results[0])
+}
+
+// liberarReservasVencidas marca como vencidas, cada intervalo, las reservas
+// que pasaron su fecha. Los reportes ya ignoran las vencidas; esto sólo deja
+// el estado al día para quien consulta /api/reservas.
+func liberarReservasVencidas(intervalo time.Duration) {
+	ticker := time.NewTicker(intervalo)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		var liberadas int
+		err := supabaseClient.DB.Rpc("liberar_reservas_vencidas", map[string]interface{}{}).Execute(&liberadas)
+		if err != nil {
+			log.Printf("Error al liberar reservas vencidas: %v", err)
+			continue
+		}
+		if liberadas > 0 {
+			log.Printf("Reservas vencidas liberadas: %d", liberadas)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParsearExpiraReserva(t *testing.T) {
+	ahora := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+
+	// Ciudad de México (UTC-6): a las 20:00 del día 10 en UTC ya es el 11
+	mexico := time.FixedZone("CST", -6*60*60)
+	nocheMexico := time.Date(2024, 3, 10, 20, 0, 0, 0, mexico)
+
+	casos := []struct {
+		nombre   string
+		valor    string
+		ahora    time.Time
+		esperado time.Time
+		falla    bool
+	}{
+		{
+			nombre:   "vacío usa la vigencia predeterminada",
+			ahora:    ahora,
+			esperado: ahora.AddDate(0, 0, diasReservaPredeterminados),
+		},
+		{
+			nombre:   "RFC3339",
+			valor:    "2024-03-15T09:30:00Z",
+			ahora:    ahora,
+			esperado: time.Date(2024, 3, 15, 9, 30, 0, 0, time.UTC),
+		},
+		{
+			nombre:   "fecha sola vence al final del día",
+			valor:    "2024-03-15",
+			ahora:    ahora,
+			esperado: time.Date(2024, 3, 15, 23, 59, 59, 0, time.UTC),
+		},
+		{
+			nombre:   "hoy sigue vigente hasta el final del día",
+			valor:    "2024-03-10",
+			ahora:    ahora,
+			esperado: time.Date(2024, 3, 10, 23, 59, 59, 0, time.UTC),
+		},
+		{
+			nombre:   "hoy en hora local vence al final del día local, no del de UTC",
+			valor:    "2024-03-10",
+			ahora:    nocheMexico,
+			esperado: time.Date(2024, 3, 10, 23, 59, 59, 0, mexico),
+		},
+		{
+			nombre: "fecha pasada",
+			valor:  "2024-03-09",
+			ahora:  ahora,
+			falla:  true,
+		},
+		{
+			nombre: "instante igual a ahora",
+			valor:  "2024-03-10T12:00:00Z",
+			ahora:  ahora,
+			falla:  true,
+		},
+		{
+			nombre: "formato inválido",
+			valor:  "15/03/2024",
+			ahora:  ahora,
+			falla:  true,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			expira, err := parsearExpiraReserva(c.valor, c.ahora)
+			if c.falla {
+				if err == nil {
+					t.Fatalf("se esperaba error, se obtuvo %v", expira)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("error inesperado: %v", err)
+			}
+			if !expira.Equal(c.esperado) {
+				t.Errorf("se obtuvo %v, se esperaba %v", expira, c.esperado)
+			}
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	postgrest "github.com/nedpals/supabase-go/postgrest/pkg"
+)
+
+// Responde con el error devuelto por una función de Postgres llamada vía RPC.
+// Los errores lanzados con RAISE llegan con su propio código HTTP y un mensaje
+// pensado para el cliente; cualquier otro error se trata como interno. Los
+// conflictos que la base marca con hint 'reintentar' se indican al cliente
+// para que repita la petición.
+func responderErrorRPC(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	mensaje := err.Error()
+	reintentar := false
+
+	var reqErr *postgrest.RequestError
+	if errors.As(err, &reqErr) {
+		mensaje = reqErr.Message
+		if reqErr.HTTPStatusCode >= 400 {
+			status = reqErr.HTTPStatusCode
+		}
+		reintentar = reqErr.Hint == "reintentar"
+	}
+
+	respuesta := map[string]interface{}{
+		"error": mensaje,
+	}
+	if reintentar {
+		w.Header().Set("Retry-After", "1")
+		respuesta["reintentar"] = true
+	}
+
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// esViolacionUnica indica si err viene de una restricción unique (código 23505
+// de Postgres), que el cliente debe recibir como conflicto y no como error
+// interno.
+func esViolacionUnica(err error) bool {
+	var reqErr *postgrest.RequestError
+	return errors.As(err, &reqErr) && reqErr.Code == "23505"
+}
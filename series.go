@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+	"strings"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Handler para /api/series/{serial} (GET). Devuelve la vida de cada unidad con
+// ese número de serie: compra de origen, almacén actual, venta y cliente, y
+// todos sus movimientos en orden. Puede haber más de una si dos fabricantes
+// usan el mismo número.
+func handleObtenerSerie(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	serial := strings.TrimPrefix(r.URL.Path, "/api/series/")
+	if serial == "" {
+		http.Error(w, `{"error":"Número de serie no proporcionado"}`, http.StatusBadRequest)
+		return
+	}
+
+	var renglones []SerieMovimiento
+	err := supabaseClient.DB.
+		From("series_historial").
+		Select("*").
+		OrderBy("fecha,movimiento_id", "asc").
+		Eq("numero_serie", serial).
+		Execute(&renglones)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener la serie: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(renglones) == 0 {
+		http.Error(w, `{"error":"Número de serie no encontrado"}`, http.StatusNotFound)
+		return
+	}
+
+	// Agrupar por unidad; la compra es la primera que la ingresó y la venta
+	// la última que la sacó
+	unidades := []map[string]interface{}{}
+	indice := map[int]int{}
+	for _, m := range renglones {
+		i, existe := indice[m.SerieID]
+		if !existe {
+			i = len(unidades)
+			indice[m.SerieID] = i
+			unidades = append(unidades, map[string]interface{}{
+				"serie_id":        m.SerieID,
+				"numero_serie":    m.NumeroSerie,
+				"articulo_id":     m.ArticuloID,
+				"articulo_nombre": m.ArticuloNombre,
+				"marca":           m.Marca,
+				"estado":          m.Estado,
+				"almacen_id":      m.AlmacenActualID,
+				"almacen_nombre":  m.AlmacenActualNombre,
+				"compra_id":       nil,
+				"venta":           nil,
+				"movimientos":     []SerieMovimiento{},
+			})
+		}
+		unidad := unidades[i]
+		if m.MovimientoID == nil {
+			continue
+		}
+		if m.CompraID != nil && unidad["compra_id"] == nil {
+			unidad["compra_id"] = *m.CompraID
+		}
+		if m.VentaID != nil {
+			unidad["venta"] = map[string]interface{}{
+				"venta_id":             *m.VentaID,
+				"fecha":                m.Fecha,
+				"cliente_nombre":       m.ClienteNombre,
+				"cliente_razon_social": m.ClienteRazonSocial,
+				"cliente_telefono":     m.ClienteTelefono,
+				"cliente_correo":       m.ClienteCorreo,
+			}
+		}
+		unidad["movimientos"] = append(unidad["movimientos"].([]SerieMovimiento), m)
+	}
+
+	// Si la venta se canceló la unidad volvió a existencias
+	for _, unidad := range unidades {
+		if unidad["estado"] != "vendida" {
+			unidad["venta"] = nil
+		}
+	}
+
+	json.NewEncoder(w).Encode(unidades)
+}
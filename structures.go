@@ -1,20 +1,24 @@
 package main
 
 type ArticleResponse struct {
-	ID              int     `json:"id,omitempty"`
-	CreatedAt       string  `json:"created_at,omitempty"`
-	CategoriaID     int     `json:"categoria_id,omitempty"`
-	CodigoBarras    string  `json:"codigo_barras,omitempty"`
-	Costo           float64 `json:"costo,omitempty"`
-	Descripcion     string  `json:"descripcion,omitempty"`
-	Imagen          string  `json:"imagen,omitempty"`
-	Inventario      int     `json:"inventario,omitempty"`
-	Nombre          string  `json:"nombre,omitempty"`
-	PrecioVenta     float64 `json:"precio_venta,omitempty"`
-	Proveedor       string  `json:"proveedor,omitempty"`
-	CategoriaNombre string  `json:"categoria_nombre,omitempty"`
-	Marca           string  `json:"marca,omitempty"`
-	Estado          string  `json:"estado,omitempty"`
+	ID              int      `json:"id,omitempty"`
+	CreatedAt       string   `json:"created_at,omitempty"`
+	CategoriaID     int      `json:"categoria_id,omitempty"`
+	CodigoBarras    string   `json:"codigo_barras,omitempty"`
+	Costo           float64  `json:"costo,omitempty"`
+	Descripcion     string   `json:"descripcion,omitempty"`
+	Imagen          string   `json:"imagen,omitempty"`
+	Inventario      int      `json:"inventario,omitempty"`
+	Nombre          string   `json:"nombre,omitempty"`
+	PrecioVenta     float64  `json:"precio_venta,omitempty"`
+	Proveedor       string   `json:"proveedor,omitempty"`
+	CategoriaNombre string   `json:"categoria_nombre,omitempty"`
+	Marca           string   `json:"marca,omitempty"`
+	Estado          string   `json:"estado,omitempty"`
+	StockMinimo     *float64 `json:"stock_minimo,omitempty"`
+	StockMaximo     *float64 `json:"stock_maximo,omitempty"`
+	Serializado     bool     `json:"serializado,omitempty"`
+	ManejaLotes     bool     `json:"maneja_lotes,omitempty"`
 }
 
 type InventarioArticulo struct {
@@ -28,6 +32,22 @@ type InventarioArticulo struct {
 	UltimaActualizacion string  `json:"ultima_actualizacion"`
 	Marca               string  `json:"marca,omitempty"`
 	Estado              string  `json:"estado,omitempty"`
+	ValorInventario     float64 `json:"valor_inventario"`
+	AlmacenID           *int    `json:"almacen_id,omitempty"`
+	AlmacenNombre       string  `json:"almacen_nombre,omitempty"`
+	Reservado           float64 `json:"reservado"`
+	Disponible          float64 `json:"disponible"`          // cantidad_actual menos lo reservado
+	Ubicacion           string  `json:"ubicacion,omitempty"` // pasillo/anaquel en el almacén; ordena las hojas de conteo
+}
+
+// Cambio del costo promedio de un artículo (articulos_costos_historial)
+type CostoHistorial struct {
+	ID            int     `json:"id"`
+	ArticuloID    int     `json:"articulo_id"`
+	MovimientoID  *int    `json:"movimiento_id"`
+	CostoAnterior float64 `json:"costo_anterior"`
+	CostoNuevo    float64 `json:"costo_nuevo"`
+	Fecha         string  `json:"fecha"`
 }
 
 type InventarioMovimientoArticulo struct {
@@ -46,11 +66,68 @@ type Movimiento struct {
 	Fecha          string  `json:"fecha"`
 }
 
+type TipoMovimiento struct {
+	Clave          string `json:"clave"`
+	Etiqueta       string `json:"etiqueta"`
+	Signo          int    `json:"signo"`
+	RequiereMotivo bool   `json:"requiere_motivo"`
+	Permiso        string `json:"permiso"`
+	SoloSistema    bool   `json:"solo_sistema"` // lo registran sólo las funciones de la base (ajuste_toma)
+}
+
+// Payload para crear o editar un tipo de movimiento. Los campos son punteros
+// para distinguir en un PUT lo que no se envió de un valor en cero.
+type TipoMovimientoPayload struct {
+	Clave          string  `json:"clave"`
+	Etiqueta       *string `json:"etiqueta"`
+	Signo          *int    `json:"signo"`
+	RequiereMotivo *bool   `json:"requiere_motivo"`
+	Permiso        *string `json:"permiso"`
+}
+
+// Política para salidas que dejan el inventario en negativo. Sin artículo ni
+// categoría es global; sin tipo de movimiento aplica a todas las salidas.
+type PoliticaStockNegativo struct {
+	ID             int     `json:"id,omitempty"`
+	ArticuloID     *int    `json:"articulo_id"`
+	CategoriaID    *int    `json:"categoria_id"`
+	TipoMovimiento *string `json:"tipo_movimiento"`
+	Accion         string  `json:"accion"` // permitir, rechazar o backorder
+}
+
+// Artículo por debajo de su stock mínimo (vista articulos_bajo_minimo)
+type ArticuloBajoMinimo struct {
+	ArticuloID       int      `json:"articulo_id"`
+	Nombre           string   `json:"nombre"`
+	Marca            string   `json:"marca,omitempty"`
+	CodigoBarras     string   `json:"codigo_barras,omitempty"`
+	Proveedor        string   `json:"proveedor,omitempty"`
+	CategoriaID      *int     `json:"categoria_id,omitempty"`
+	CantidadActual   float64  `json:"cantidad_actual"`
+	StockMinimo      float64  `json:"stock_minimo"`
+	StockMaximo      *float64 `json:"stock_maximo,omitempty"`
+	CantidadSugerida float64  `json:"cantidad_sugerida"`
+	FechaAlerta      *string  `json:"fecha_alerta,omitempty"`
+}
+
+type AlertaStock struct {
+	ID               int      `json:"id"`
+	ArticuloID       int      `json:"articulo_id"`
+	MovimientoID     *int     `json:"movimiento_id"`
+	Tipo             string   `json:"tipo"` // bajo_minimo o sobre_maximo
+	CantidadAnterior float64  `json:"cantidad_anterior"`
+	CantidadActual   float64  `json:"cantidad_actual"`
+	StockMinimo      *float64 `json:"stock_minimo"`
+	StockMaximo      *float64 `json:"stock_maximo"`
+	Atendida         bool     `json:"atendida"`
+	Fecha            string   `json:"fecha"`
+}
+
 type MovimientoEditar struct {
 	ID             int     `json:"id"`              // ID del movimiento a editar
 	Cantidad       float64 `json:"cantidad"`        // Nueva cantidad
 	TipoMovimiento string  `json:"tipo_movimiento"` // Nuevo tipo de movimiento
-	Motivo         string  `json:"motivo"`          // Nuevo motivo
+	Motivo         string  `json:"motivo"`          // Motivo de la corrección (obligatorio)
 }
 
 type MovimientoConNombre struct {
@@ -65,27 +142,343 @@ type MovimientoConNombre struct {
 	UsuarioNombre     string  `json:"usuario_nombre"`
 }
 
+type MovimientoInventario struct {
+	ID              int      `json:"id"`
+	ArticuloID      int      `json:"articulo_id"`
+	TipoMovimiento  string   `json:"tipo_movimiento"`
+	Cantidad        float64  `json:"cantidad"`
+	Motivo          string   `json:"motivo"`
+	UsuarioNombre   string   `json:"usuario_nombre"`
+	Fecha           string   `json:"fecha"`
+	CostoUnitario   *float64 `json:"costo_unitario"`
+	CostoPromedio   *float64 `json:"costo_promedio"`
+	VentaID         *int     `json:"venta_id"`
+	CompraID        *int     `json:"compra_id"`
+	AlmacenID       *int     `json:"almacen_id"`
+	TransferenciaID *int     `json:"transferencia_id"`
+	ReversaDe       *int     `json:"reversa_de"`
+	ReemplazaA      *int     `json:"reemplaza_a"`
+	Backorder       bool     `json:"backorder"`
+}
+
+type KardexMovimiento struct {
+	ID              int     `json:"id"`
+	Fecha           string  `json:"fecha"`
+	TipoMovimiento  string  `json:"tipo_movimiento"`
+	Motivo          string  `json:"motivo"`
+	UsuarioNombre   string  `json:"usuario_nombre"`
+	VentaID         *int    `json:"venta_id,omitempty"`
+	CompraID        *int    `json:"compra_id,omitempty"`
+	Entrada         float64 `json:"entrada"`
+	Salida          float64 `json:"salida"`
+	Saldo           float64 `json:"saldo"`
+	CostoUnitario   float64 `json:"costo_unitario"`
+	CostoPromedio   float64 `json:"costo_promedio"`
+	SaldoValorizado float64 `json:"saldo_valorizado"`
+}
+
+type Almacen struct {
+	ID             int    `json:"id,omitempty"`
+	Nombre         string `json:"nombre"`
+	Descripcion    string `json:"descripcion,omitempty"`
+	Activo         bool   `json:"activo"`
+	Predeterminado bool   `json:"predeterminado"`
+}
+
+// Un renglón de la vista series_historial
+type SerieMovimiento struct {
+	SerieID             int     `json:"serie_id"`
+	NumeroSerie         string  `json:"numero_serie"`
+	ArticuloID          int     `json:"articulo_id"`
+	ArticuloNombre      string  `json:"articulo_nombre"`
+	Marca               string  `json:"marca,omitempty"`
+	Estado              string  `json:"estado"`
+	AlmacenActualID     int     `json:"almacen_actual_id"`
+	AlmacenActualNombre string  `json:"almacen_actual_nombre"`
+	MovimientoID        *int    `json:"movimiento_id"`
+	Fecha               string  `json:"fecha"`
+	TipoMovimiento      string  `json:"tipo_movimiento"`
+	Motivo              string  `json:"motivo"`
+	UsuarioNombre       string  `json:"usuario_nombre"`
+	AlmacenID           *int    `json:"almacen_id"`
+	AlmacenNombre       *string `json:"almacen_nombre"`
+	CompraID            *int    `json:"compra_id"`
+	VentaID             *int    `json:"venta_id"`
+	ClienteNombre       *string `json:"cliente_nombre"`
+	ClienteRazonSocial  *string `json:"cliente_razon_social"`
+	ClienteTelefono     *string `json:"cliente_telefono"`
+	ClienteCorreo       *string `json:"cliente_correo"`
+}
+
+// Lote con existencias (vista lotes_caducidad_view)
+type LoteCaducidad struct {
+	LoteID        int     `json:"lote_id"`
+	ArticuloID    int     `json:"articulo_id"`
+	Nombre        string  `json:"nombre"`
+	Marca         string  `json:"marca,omitempty"`
+	CodigoBarras  string  `json:"codigo_barras,omitempty"`
+	CategoriaID   *int    `json:"categoria_id,omitempty"`
+	AlmacenID     int     `json:"almacen_id"`
+	AlmacenNombre string  `json:"almacen_nombre"`
+	Lote          string  `json:"lote"`
+	Caducidad     string  `json:"caducidad"`
+	Cantidad      float64 `json:"cantidad"`
+	DiasRestantes int     `json:"dias_restantes"`
+	Costo         float64 `json:"costo"`
+	Valor         float64 `json:"valor"`
+}
+
+// Reserva (apartado) de existencias para un cliente o documento
+type Reserva struct {
+	ID                int     `json:"id"`
+	ArticuloID        int     `json:"articulo_id"`
+	AlmacenID         int     `json:"almacen_id"`
+	Cantidad          float64 `json:"cantidad"`
+	CantidadConsumida float64 `json:"cantidad_consumida"` // lo que ya surtieron las ventas
+	ClienteNombre     *string `json:"cliente_nombre"`
+	Documento         *string `json:"documento"`
+	Notas             *string `json:"notas,omitempty"`
+	Estado            string  `json:"estado"` // activa, consumida, liberada o vencida
+	ExpiraEn          string  `json:"expira_en"`
+	VentaID           *int    `json:"venta_id"`
+	UsuarioNombre     string  `json:"usuario_nombre,omitempty"`
+	CreatedAt         string  `json:"created_at"`
+	LiberadaEn        *string `json:"liberada_en,omitempty"`
+}
+
+// Fila de trazabilidad_ventas: lo que una venta se llevó de un lote o serie
+type TrazabilidadVenta struct {
+	VentaID            int     `json:"venta_id"`
+	FechaVenta         string  `json:"fecha_venta"`
+	ClienteNombre      string  `json:"cliente_nombre"`
+	ClienteRazonSocial string  `json:"cliente_razon_social,omitempty"`
+	ClienteTelefono    string  `json:"cliente_telefono,omitempty"`
+	ClienteCorreo      string  `json:"cliente_correo,omitempty"`
+	ArticuloID         int     `json:"articulo_id"`
+	ArticuloNombre     string  `json:"articulo_nombre"`
+	Marca              string  `json:"marca,omitempty"`
+	Lote               *string `json:"lote"`
+	Caducidad          *string `json:"caducidad"`
+	NumeroSerie        *string `json:"numero_serie"`
+	Cantidad           float64 `json:"cantidad"`
+}
+
+// Fila de trazabilidad_existencias: lo que aún tenemos de un lote o serie
+type TrazabilidadExistencia struct {
+	ArticuloID     int     `json:"articulo_id"`
+	ArticuloNombre string  `json:"articulo_nombre"`
+	Marca          string  `json:"marca,omitempty"`
+	AlmacenID      int     `json:"almacen_id"`
+	AlmacenNombre  string  `json:"almacen_nombre"`
+	Lote           *string `json:"lote"`
+	Caducidad      *string `json:"caducidad"`
+	NumeroSerie    *string `json:"numero_serie"`
+	Cantidad       float64 `json:"cantidad"`
+}
+
 type CategoryDetail struct {
 	Nombre string `json:"nombre,omitempty"`
 }
 
 type TomaInventario struct {
-	ID              int    `json:"id,omitempty"`
-	Folio           int    `json:"folio,omitempty"`
-	FechaInicio     string `json:"fecha_inicio,omitempty"`
-	FechaFin        string `json:"fecha_fin,omitempty"`
-	UsuarioAuth0Sub string `json:"usuario_auth0_sub,omitempty"`
-	UsuarioCorreo   string `json:"usuario_correo,omitempty"`
-	Estado          string `json:"estado,omitempty"`
-	CategoriaID     *int   `json:"categoria_id,omitempty"`
-	CategoriaNombre string `json:"categoria_nombre,omitempty"`
-	Observaciones   string `json:"observaciones,omitempty"`
+	ID                int      `json:"id,omitempty"`
+	Folio             int      `json:"folio,omitempty"`
+	FechaInicio       string   `json:"fecha_inicio,omitempty"`
+	FechaFin          string   `json:"fecha_fin,omitempty"`
+	UsuarioAuth0Sub   string   `json:"usuario_auth0_sub,omitempty"`
+	UsuarioCorreo     string   `json:"usuario_correo,omitempty"`
+	Estado            string   `json:"estado,omitempty"`
+	CategoriaID       *int     `json:"categoria_id,omitempty"`
+	CategoriaNombre   string   `json:"categoria_nombre,omitempty"`
+	Observaciones     string   `json:"observaciones,omitempty"`
+	AlmacenID         int      `json:"almacen_id,omitempty"`
+	AlmacenNombre     string   `json:"almacen_nombre,omitempty"`
+	Ciega             bool     `json:"ciega"`
+	ConteosRequeridos int      `json:"conteos_requeridos,omitempty"`
+	ToleranciaPct     *float64 `json:"tolerancia_pct,omitempty"`
+	Congelar          bool     `json:"congelar"`
+}
+
+// Ajuste de inventario generado al cerrar una toma física
+type AjusteToma struct {
+	DetalleID        int     `json:"detalle_id"`
+	ArticuloID       int     `json:"articulo_id"`
+	CantidadTeorica  float64 `json:"cantidad_teorica"`
+	CantidadAnterior float64 `json:"cantidad_anterior"` // existencia al momento del cierre
+	MovimientosCorte float64 `json:"movimientos_corte"` // movidos entre el corte y el conteo
+	CantidadReal     float64 `json:"cantidad_real"`
+	Ajuste           float64 `json:"ajuste"`
+	CostoPromedio    float64 `json:"costo_promedio"`
+	MovimientoID     int     `json:"movimiento_id"`
+}
+
+// Resultado de cambiar_estado_toma; Ajustes sólo viene al cerrar
+type CambioEstadoToma struct {
+	TomaID         int             `json:"toma_id"`
+	Folio          int             `json:"folio"`
+	AlmacenID      int             `json:"almacen_id"`
+	EstadoAnterior string          `json:"estado_anterior"`
+	Estado         string          `json:"estado"`
+	Ajustes        []AjusteToma    `json:"ajustes,omitempty"`
+	Reconteo       []LineaReconteo `json:"reconteo,omitempty"` // si no pudo pasar a revisión
+}
+
+// Línea marcada para reconteo (tomafisica_reconteo_view)
+type LineaReconteo struct {
+	DetalleID            int    `json:"detalle_id"`
+	TomaID               int    `json:"toma_id,omitempty"`
+	ArticuloID           int    `json:"articulo_id"`
+	Nombre               string `json:"nombre,omitempty"`
+	Marca                string `json:"marca,omitempty"`
+	CodigoBarras         string `json:"codigo_barras,omitempty"`
+	MotivoReconteo       string `json:"motivo_reconteo"` // conteos_distintos o variacion
+	ReconteoSolicitadoEn string `json:"reconteo_solicitado_en,omitempty"`
+}
+
+// Conteo de un usuario en una toma con varios contadores
+type ConteoToma struct {
+	ID              int     `json:"id"`
+	TomaID          int     `json:"toma_id"`
+	DetalleID       int     `json:"detalle_id"`
+	UsuarioAuth0Sub string  `json:"usuario_auth0_sub"`
+	UsuarioCorreo   string  `json:"usuario_correo,omitempty"`
+	Cantidad        float64 `json:"cantidad"`
+	UpdatedAt       string  `json:"updated_at"`
+}
+
+// Registro de tomafisica_transiciones
+type TransicionToma struct {
+	ID              int     `json:"id"`
+	TomaID          int     `json:"toma_id"`
+	EstadoAnterior  string  `json:"estado_anterior"`
+	EstadoNuevo     string  `json:"estado_nuevo"`
+	UsuarioAuth0Sub string  `json:"usuario_auth0_sub,omitempty"`
+	UsuarioCorreo   string  `json:"usuario_correo,omitempty"`
+	Motivo          *string `json:"motivo"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// Lectura de código de barras en una toma (tomafisica_escaneos)
+type EscaneoToma struct {
+	ID              int     `json:"id"`
+	TomaID          int     `json:"toma_id"`
+	CodigoBarras    string  `json:"codigo_barras"`
+	Cantidad        float64 `json:"cantidad"`
+	Resultado       string  `json:"resultado"` // contado, desconocido, fuera_de_categoria o fuera_de_toma
+	ArticuloID      *int    `json:"articulo_id"`
+	DetalleID       *int    `json:"detalle_id"`
+	UsuarioAuth0Sub string  `json:"usuario_auth0_sub,omitempty"`
+	UsuarioCorreo   string  `json:"usuario_correo,omitempty"`
+	CreatedAt       string  `json:"created_at"`
+}
+
+// Línea de tomafisica_variacion_view: diferencia contado contra teórico
+type VariacionToma struct {
+	DetalleID        int      `json:"detalle_id"`
+	TomaID           int      `json:"toma_id"`
+	ArticuloID       int      `json:"articulo_id"`
+	Nombre           string   `json:"nombre"`
+	Marca            string   `json:"marca,omitempty"`
+	CodigoBarras     string   `json:"codigo_barras,omitempty"`
+	CategoriaID      *int     `json:"categoria_id"`
+	CategoriaNombre  *string  `json:"categoria_nombre"`
+	CantidadTeorica  float64  `json:"cantidad_teorica"`
+	CantidadReal     *float64 `json:"cantidad_real"` // null si la línea no se contó
+	Diferencia       *float64 `json:"diferencia"`
+	Costo            float64  `json:"costo"`
+	ValorTeorico     float64  `json:"valor_teorico"`
+	ValorDiferencia  *float64 `json:"valor_diferencia"`
+	MovimientosCorte float64  `json:"movimientos_corte"` // movidos entre el corte y el conteo
+	CantidadEsperada float64  `json:"cantidad_esperada"` // teórica más movimientos_corte
+	Contada          bool     `json:"contada"`
+}
+
+// Línea de una hoja de conteo (tomafisica_hoja_view)
+type LineaHojaConteo struct {
+	DetalleID       int     `json:"detalle_id"`
+	TomaID          int     `json:"toma_id"`
+	ArticuloID      int     `json:"articulo_id"`
+	Nombre          string  `json:"nombre"`
+	Marca           string  `json:"marca"`
+	CodigoBarras    string  `json:"codigo_barras"`
+	Ubicacion       string  `json:"ubicacion"`
+	CategoriaID     *int    `json:"categoria_id"`
+	CategoriaNombre *string `json:"categoria_nombre"`
+	CantidadTeorica float64 `json:"cantidad_teorica"`
+}
+
+// Variación acumulada de una categoría o de toda la toma
+type ResumenVariacion struct {
+	CategoriaID        *int    `json:"categoria_id,omitempty"`
+	CategoriaNombre    string  `json:"categoria_nombre"`
+	Lineas             int     `json:"lineas"`            // sólo las contadas
+	LineasSinContar    int     `json:"lineas_sin_contar"` // fuera de los totales, el cierre no las ajusta
+	UnidadesTeoricas   float64 `json:"unidades_teoricas"`
+	UnidadesContadas   float64 `json:"unidades_contadas"`
+	UnidadesDiferencia float64 `json:"unidades_diferencia"`
+	ValorTeorico       float64 `json:"valor_teorico"`
+	ValorSobrante      float64 `json:"valor_sobrante"`
+	ValorFaltante      float64 `json:"valor_faltante"`
+	ValorDiferencia    float64 `json:"valor_diferencia"`
+	MermaPct           float64 `json:"merma_pct"` // faltante valorizado / valor teórico
 }
 
 type VentaDetalle struct {
-	ArticuloID     int     `json:"articulo_id"`
-	Cantidad       int     `json:"cantidad"`
-	PrecioUnitario float64 `json:"precio_unitario"`
+	ArticuloID     int      `json:"articulo_id"`
+	Cantidad       int      `json:"cantidad"`
+	PrecioUnitario float64  `json:"precio_unitario"`
+	Series         []string `json:"series,omitempty"` // obligatorias si el artículo es serializado
+	Lote           string   `json:"lote,omitempty"`   // opcional; sin lote se surte por FEFO
+	ReservaID      *int     `json:"reserva_id,omitempty"`
+	AlmacenID      *int     `json:"almacen_id,omitempty"` // sin almacén, el de la reserva o el predeterminado
+}
+
+type CompraDetalle struct {
+	ID             int      `json:"id,omitempty"`
+	ArticuloID     int      `json:"articulo_id"`
+	Cantidad       int      `json:"cantidad"`
+	PrecioUnitario float64  `json:"precio_unitario"`
+	Series         []string `json:"series,omitempty"` // obligatorias si el artículo es serializado
+	Lote           string   `json:"lote,omitempty"`   // obligatorio si el artículo maneja lotes
+	Caducidad      string   `json:"caducidad,omitempty"`
+	AlmacenID      *int     `json:"almacen_id,omitempty"` // sin almacén, el predeterminado
+}
+
+// Lote y caducidad que se capturan al recibir una línea de compra
+type LoteRecepcion struct {
+	Lote      string `json:"lote"`
+	Caducidad string `json:"caducidad,omitempty"`
+}
+
+// Fila de sugerencias_reorden
+type SugerenciaReorden struct {
+	ArticuloID       int      `json:"articulo_id"`
+	Nombre           string   `json:"nombre"`
+	Marca            string   `json:"marca,omitempty"`
+	Proveedor        *string  `json:"proveedor"`
+	DiasEntrega      int      `json:"dias_entrega"`
+	CantidadActual   float64  `json:"cantidad_actual"`
+	CantidadPedida   float64  `json:"cantidad_pedida"` // en compras en borrador
+	StockMinimo      *float64 `json:"stock_minimo,omitempty"`
+	StockMaximo      *float64 `json:"stock_maximo,omitempty"`
+	Vendidas         float64  `json:"vendidas"`
+	OtrasSalidas     float64  `json:"otras_salidas"`
+	ConsumoDiario    float64  `json:"consumo_diario"`
+	PuntoReorden     float64  `json:"punto_reorden"`
+	CantidadSugerida float64  `json:"cantidad_sugerida"`
+	CostoUnitario    float64  `json:"costo_unitario"`
+}
+
+type SugerenciasProveedor struct {
+	Proveedor     string              `json:"proveedor"`
+	DiasEntrega   int                 `json:"dias_entrega"`
+	Articulos     []SugerenciaReorden `json:"articulos"`
+	TotalEstimado float64             `json:"total_estimado"`
+}
+
+type ProveedorTiempoEntrega struct {
+	Proveedor   string `json:"proveedor"`
+	DiasEntrega int    `json:"dias_entrega"`
 }
 
 type Pago struct {
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"math"
+	"net/http"
+	"strconv"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// obtenerSugerenciasReorden ejecuta sugerencias_reorden con la ventana de
+// consumo y los días de cobertura indicados.
+func obtenerSugerenciasReorden(dias, cobertura int) ([]SugerenciaReorden, error) {
+	var sugerencias []SugerenciaReorden
+	err := supabaseClient.DB.Rpc("sugerencias_reorden", map[string]interface{}{
+		"p_dias":      dias,
+		"p_cobertura": cobertura,
+	}).Execute(&sugerencias)
+	return sugerencias, err
+}
+
+// Lee un entero positivo de la query con valor por defecto.
+func enteroPositivo(r *http.Request, nombre string, defecto int) (int, bool) {
+	v := r.URL.Query().Get(nombre)
+	if v == "" {
+		return defecto, true
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// Handler para /api/compras/sugerencias.
+// GET propone cantidades a pedir agrupadas por proveedor (?dias= ventana de
+// consumo, 90 por defecto; ?cobertura= días a cubrir tras la entrega, 30).
+// POST convierte la sugerencia de un proveedor en una compra en borrador; si
+// se envían artículos se usan esos en lugar de los sugeridos.
+func handleSugerenciasCompra(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		dias, ok := enteroPositivo(r, "dias", 90)
+		cobertura, ok2 := enteroPositivo(r, "cobertura", 30)
+		if !ok || !ok2 {
+			http.Error(w, `{"error":"dias y cobertura deben ser enteros positivos"}`, http.StatusBadRequest)
+			return
+		}
+
+		sugerencias, err := obtenerSugerenciasReorden(dias, cobertura)
+		if err != nil {
+			responderErrorRPC(w, err)
+			return
+		}
+
+		// Agrupar por proveedor conservando el orden de la función
+		proveedores := []SugerenciasProveedor{}
+		indice := map[string]int{}
+		for _, s := range sugerencias {
+			proveedor := "Sin proveedor"
+			if s.Proveedor != nil && *s.Proveedor != "" {
+				proveedor = *s.Proveedor
+			}
+			i, existe := indice[proveedor]
+			if !existe {
+				i = len(proveedores)
+				indice[proveedor] = i
+				proveedores = append(proveedores, SugerenciasProveedor{
+					Proveedor:   proveedor,
+					DiasEntrega: s.DiasEntrega,
+				})
+			}
+			proveedores[i].Articulos = append(proveedores[i].Articulos, s)
+			proveedores[i].TotalEstimado += s.CantidadSugerida * s.CostoUnitario
+		}
+		for i := range proveedores {
+			proveedores[i].TotalEstimado = math.Round(proveedores[i].TotalEstimado*100) / 100
+		}
+
+		json.NewEncoder(w).Encode(proveedores)
+		return
+	}
+
+	// POST: crear compra en borrador
+	if !claims.HasPermission("create") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		Proveedor string          `json:"proveedor"`
+		Dias      int             `json:"dias,omitempty"`
+		Cobertura int             `json:"cobertura,omitempty"`
+		Articulos []CompraDetalle `json:"articulos,omitempty"`
+		Notas     string          `json:"notas,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Proveedor == "" {
+		http.Error(w, `{"error":"Debe indicar el proveedor"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Dias <= 0 {
+		payload.Dias = 90
+	}
+	if payload.Cobertura <= 0 {
+		payload.Cobertura = 30
+	}
+
+	articulos := payload.Articulos
+	if len(articulos) == 0 {
+		sugerencias, err := obtenerSugerenciasReorden(payload.Dias, payload.Cobertura)
+		if err != nil {
+			responderErrorRPC(w, err)
+			return
+		}
+		for _, s := range sugerencias {
+			if s.Proveedor == nil || *s.Proveedor != payload.Proveedor {
+				continue
+			}
+			articulos = append(articulos, CompraDetalle{
+				ArticuloID:     s.ArticuloID,
+				Cantidad:       int(s.CantidadSugerida),
+				PrecioUnitario: s.CostoUnitario,
+			})
+		}
+	}
+	if len(articulos) == 0 {
+		http.Error(w, `{"error":"No hay artículos por pedir a este proveedor"}`, http.StatusNotFound)
+		return
+	}
+	for i, item := range articulos {
+		if item.ArticuloID <= 0 || item.Cantidad <= 0 {
+			http.Error(w, `{"error":"Artículo inválido en la línea `+strconv.Itoa(i+1)+`"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	notas := payload.Notas
+	if notas == "" {
+		notas = "Sugerencia de reorden para " + payload.Proveedor
+	}
+
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("crear_compra_borrador", map[string]interface{}{
+		"p_compra": map[string]interface{}{
+			"proveedor": payload.Proveedor,
+			"notas":     notas,
+		},
+		"p_articulos": articulos,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":   "Compra en borrador creada",
+		"compra_id": resultado["compra_id"],
+		"estado":    "borrador",
+		"articulos": articulos,
+	})
+}
+
+// Handler para /api/compras/proveedores (GET, POST): tiempo de entrega por
+// proveedor usado en las sugerencias. Sin registro se asumen 7 días.
+func handleProveedoresTiempos(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		var proveedores []ProveedorTiempoEntrega
+		if err := supabaseClient.DB.From("proveedores_tiempos_entrega").Select("proveedor", "dias_entrega").OrderBy("proveedor", "asc").Execute(&proveedores); err != nil {
+			http.Error(w, `{"error":"Error al obtener proveedores: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if proveedores == nil {
+			proveedores = []ProveedorTiempoEntrega{}
+		}
+
+		json.NewEncoder(w).Encode(proveedores)
+		return
+	}
+
+	if !claims.HasPermission("update") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload ProveedorTiempoEntrega
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	if payload.Proveedor == "" || payload.DiasEntrega < 0 {
+		http.Error(w, `{"error":"Debe indicar proveedor y días de entrega"}`, http.StatusBadRequest)
+		return
+	}
+
+	var results []ProveedorTiempoEntrega
+	err := supabaseClient.DB.From("proveedores_tiempos_entrega").Upsert(map[string]interface{}{
+		"proveedor":    payload.Proveedor,
+		"dias_entrega": payload.DiasEntrega,
+	}).Execute(&results)
+	if err != nil {
+		http.Error(w, `{"error":"Error al guardar proveedor: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(payload)
+}
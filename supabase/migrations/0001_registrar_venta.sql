@@ -0,0 +1,78 @@
+-- Registro atómico de ventas.
+--
+-- La cabecera, los detalles y los pagos se insertan dentro de la misma
+-- transacción: si cualquier línea falla no queda nada persistido y el error
+-- indica qué artículo o pago lo provocó.
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_venta_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('venta_id', v_venta_id);
+end;
+$$;
@@ -0,0 +1,138 @@
+-- Las ventas descuentan inventario y dejan un movimiento "venta" por línea.
+
+-- Sin llave foránea a propósito: el movimiento debe seguir apuntando a la
+-- venta aunque ésta se elimine después.
+alter table movimientos_inventario
+	add column if not exists venta_id bigint;
+
+create index if not exists movimientos_inventario_venta_id_idx
+	on movimientos_inventario (venta_id);
+
+-- Aplica un movimiento sobre inventarios y lo registra en
+-- movimientos_inventario. El signo ya viene resuelto en "delta".
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_cantidad_actual numeric;
+	v_movimiento_id bigint;
+begin
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual into v_cantidad_actual;
+
+	if not found then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint
+	)
+	returning id into v_movimiento_id;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual
+	);
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_venta_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id
+			));
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('venta_id', v_venta_id);
+end;
+$$;
@@ -0,0 +1,109 @@
+-- Las compras suman inventario, dejan un movimiento "compra" por línea y
+-- actualizan el costo del artículo con el precio unitario de la compra.
+
+-- Igual que venta_id: sin llave foránea para conservar la trazabilidad.
+alter table movimientos_inventario
+	add column if not exists compra_id bigint;
+
+create index if not exists movimientos_inventario_compra_id_idx
+	on movimientos_inventario (compra_id);
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_cantidad_actual numeric;
+	v_movimiento_id bigint;
+begin
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual into v_cantidad_actual;
+
+	if not found then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint
+	)
+	returning id into v_movimiento_id;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual
+	);
+end;
+$$;
+
+create or replace function registrar_compra(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas)
+	values (p_compra->>'notas')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'compra',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Compra #' || v_compra_id,
+				'usuario_nombre', p_compra->>'usuario_nombre',
+				'compra_id', v_compra_id
+			));
+
+			update articulos
+			set costo = (v_item->>'precio_unitario')::numeric
+			where id = (v_item->>'articulo_id')::bigint;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
@@ -0,0 +1,162 @@
+-- Edición y eliminación de ventas y compras con conciliación de inventario.
+--
+-- Los movimientos compensatorios se calculan en la API comparando las líneas
+-- anteriores contra las nuevas; aquí sólo se aplican junto con el cambio del
+-- documento para que ambos ocurran en la misma transacción.
+
+create or replace function aplicar_movimientos(p_movimientos jsonb)
+returns void
+language plpgsql
+as $$
+declare
+	v_mov jsonb;
+begin
+	for v_mov in
+		select value from jsonb_array_elements(coalesce(p_movimientos, '[]'::jsonb))
+	loop
+		begin
+			perform aplicar_movimiento(v_mov);
+		exception when others then
+			raise exception 'Error al ajustar inventario del articulo_id %: %',
+				v_mov->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+begin
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario)
+			values (
+				p_venta_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform aplicar_movimientos(p_movimientos);
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function eliminar_venta(
+	p_venta_id bigint,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+begin
+	perform aplicar_movimientos(p_movimientos);
+
+	delete from ventas where id = p_venta_id;
+
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+begin
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+
+			update articulos
+			set costo = (v_item->>'precio_unitario')::numeric
+			where id = (v_item->>'articulo_id')::bigint;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform aplicar_movimientos(p_movimientos);
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+create or replace function eliminar_compra(
+	p_compra_id bigint,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+begin
+	perform aplicar_movimientos(p_movimientos);
+
+	delete from compras where id = p_compra_id;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
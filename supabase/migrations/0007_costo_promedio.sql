@@ -0,0 +1,371 @@
+-- Motor de costo promedio ponderado.
+--
+-- articulos.costo deja de capturarse a mano: cada entrada con costo (compras,
+-- transferencias de entrada) recalcula el promedio móvil, el cambio queda en
+-- articulos_costos_historial y cada movimiento guarda el promedio vigente.
+-- Las líneas de venta guardan el costo del momento para que los márgenes no
+-- cambien cuando el promedio se mueve después.
+
+create table if not exists articulos_costos_historial (
+	id bigint generated always as identity primary key,
+	articulo_id bigint not null references articulos (id) on delete cascade,
+	movimiento_id bigint,
+	cantidad_anterior numeric not null,
+	costo_anterior numeric not null,
+	cantidad_entrada numeric not null,
+	costo_entrada numeric,
+	costo_nuevo numeric not null,
+	fecha timestamptz not null default now()
+);
+
+create index if not exists articulos_costos_historial_articulo_idx
+	on articulos_costos_historial (articulo_id, fecha);
+
+-- Promedio vigente después de aplicar el movimiento.
+alter table movimientos_inventario
+	add column if not exists costo_promedio numeric;
+
+alter table ventas_detalle
+	add column if not exists costo_unitario numeric;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+begin
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual into v_cantidad_actual;
+
+	if not found then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select coalesce(costo, 0)
+	into v_costo_anterior
+	from articulos
+	where id = v_articulo_id
+	for update;
+
+	-- Promedio ponderado móvil: sólo las entradas que traen costo lo recalculan.
+	-- Si no había existencias (o eran negativas) el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_cantidad_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_cantidad_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_cantidad_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		costo_unitario,
+		costo_promedio
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_cantidad_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio
+	);
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id
+			));
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('venta_id', v_venta_id);
+end;
+$$;
+
+create or replace function registrar_compra(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas)
+	values (p_compra->>'notas')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'compra',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'costo_unitario', v_item->'precio_unitario',
+				'motivo', 'Compra #' || v_compra_id,
+				'usuario_nombre', p_compra->>'usuario_nombre',
+				'compra_id', v_compra_id
+			));
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+begin
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform aplicar_movimientos(p_movimientos);
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+begin
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform aplicar_movimientos(p_movimientos);
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
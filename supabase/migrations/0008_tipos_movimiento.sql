@@ -0,0 +1,36 @@
+-- Registro de tipos de movimiento.
+--
+-- Sustituye los switch que había en la API: cada tipo define si suma o resta
+-- inventario, su etiqueta, si exige motivo y el permiso necesario para
+-- registrarlo a mano.
+
+create table if not exists tipos_movimiento (
+	clave text primary key,
+	etiqueta text not null,
+	signo smallint not null check (signo in (-1, 1)),
+	requiere_motivo boolean not null default false,
+	permiso text not null default 'create',
+	created_at timestamptz not null default now()
+);
+
+insert into tipos_movimiento (clave, etiqueta, signo, requiere_motivo, permiso) values
+	('alta', 'Alta de inventario', 1, false, 'create'),
+	('compra', 'Compra', 1, false, 'create'),
+	('transferencia_entrada', 'Transferencia de entrada', 1, false, 'create'),
+	('cancelacion_venta', 'Cancelación de venta', 1, false, 'update'),
+	('venta', 'Venta', -1, false, 'create'),
+	('baja', 'Baja', -1, true, 'create'),
+	('robo', 'Robo', -1, true, 'create'),
+	('transferencia_salida', 'Transferencia de salida', -1, false, 'create'),
+	('cancelacion_compra', 'Cancelación de compra', -1, false, 'update')
+on conflict (clave) do nothing;
+
+-- Los movimientos nuevos sólo pueden usar tipos registrados. NOT VALID deja
+-- fuera de la revisión a los movimientos históricos.
+alter table movimientos_inventario
+	drop constraint if exists movimientos_inventario_tipo_movimiento_fkey;
+
+alter table movimientos_inventario
+	add constraint movimientos_inventario_tipo_movimiento_fkey
+	foreign key (tipo_movimiento) references tipos_movimiento (clave)
+	not valid;
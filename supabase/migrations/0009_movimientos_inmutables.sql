@@ -0,0 +1,187 @@
+-- Libro de movimientos inmutable.
+--
+-- Los movimientos ya no se editan ni se borran. Editar registra un reverso del
+-- original más un movimiento nuevo; eliminar registra sólo el reverso. El
+-- reverso usa el mismo tipo con la cantidad en negativo, así que cualquier
+-- suma de signo * cantidad (kardex, inventario a una fecha) lo descuenta sin
+-- tratarlo aparte.
+
+alter table movimientos_inventario
+	add column if not exists reversa_de bigint references movimientos_inventario (id),
+	add column if not exists reemplaza_a bigint references movimientos_inventario (id);
+
+-- Un movimiento sólo se puede revertir una vez.
+create unique index if not exists movimientos_inventario_reversa_de_key
+	on movimientos_inventario (reversa_de)
+	where reversa_de is not null;
+
+create or replace function movimientos_inventario_inmutable()
+returns trigger
+language plpgsql
+as $$
+begin
+	raise exception 'Los movimientos de inventario no se pueden modificar ni eliminar, registre un reverso'
+		using errcode = 'PT409';
+end;
+$$;
+
+drop trigger if exists movimientos_inventario_inmutable on movimientos_inventario;
+create trigger movimientos_inventario_inmutable
+	before update or delete on movimientos_inventario
+	for each row execute function movimientos_inventario_inmutable();
+
+drop trigger if exists movimientos_inventario_inmutable_truncate on movimientos_inventario;
+create trigger movimientos_inventario_inmutable_truncate
+	before truncate on movimientos_inventario
+	for each statement execute function movimientos_inventario_inmutable();
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+begin
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual into v_cantidad_actual;
+
+	if not found then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select coalesce(costo, 0)
+	into v_costo_anterior
+	from articulos
+	where id = v_articulo_id
+	for update;
+
+	-- Promedio ponderado móvil: sólo las entradas que traen costo lo recalculan.
+	-- Si no había existencias (o eran negativas) el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_cantidad_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_cantidad_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_cantidad_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_cantidad_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio
+	);
+end;
+$$;
+
+-- Revierte un movimiento y, si se indica, registra el que lo reemplaza.
+-- p_reverso y p_nuevo llegan armados desde la API con su delta; aquí se
+-- validan contra el original y se enlazan a él.
+create or replace function reversar_movimiento(
+	p_movimiento_id bigint,
+	p_reverso jsonb,
+	p_nuevo jsonb default null
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_original movimientos_inventario;
+	v_reverso jsonb;
+	v_nuevo jsonb;
+begin
+	select * into v_original
+	from movimientos_inventario
+	where id = p_movimiento_id
+	for update;
+
+	if not found then
+		raise exception 'No se encontró el movimiento %', p_movimiento_id using errcode = 'PT404';
+	end if;
+
+	if v_original.reversa_de is not null then
+		raise exception 'El movimiento % es un reverso y no se puede revertir', p_movimiento_id
+			using errcode = 'PT409';
+	end if;
+
+	if exists (select 1 from movimientos_inventario where reversa_de = p_movimiento_id) then
+		raise exception 'El movimiento % ya fue revertido', p_movimiento_id using errcode = 'PT409';
+	end if;
+
+	v_reverso := aplicar_movimiento(p_reverso || jsonb_build_object('reversa_de', p_movimiento_id));
+
+	if p_nuevo is not null then
+		v_nuevo := aplicar_movimiento(p_nuevo || jsonb_build_object('reemplaza_a', p_movimiento_id));
+	end if;
+
+	return jsonb_build_object(
+		'reverso', v_reverso,
+		'nuevo', v_nuevo
+	);
+end;
+$$;
@@ -0,0 +1,141 @@
+-- Actualización atómica de existencias.
+--
+-- aplicar_movimiento ya suma el delta en la base y registra el movimiento en
+-- la misma transacción; aquí se agrega una versión por inventario para
+-- control optimista y se acota la espera por el bloqueo de la fila. Ambos
+-- conflictos se reportan como 409 con hint 'reintentar'.
+
+alter table inventarios
+	add column if not exists version bigint not null default 0;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+begin
+	-- Si otro movimiento tiene el inventario bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	if v_version is null then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select coalesce(costo, 0)
+	into v_costo_anterior
+	from articulos
+	where id = v_articulo_id
+	for update;
+
+	-- Promedio ponderado móvil: sólo las entradas que traen costo lo recalculan.
+	-- Si no había existencias (o eran negativas) el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_cantidad_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_cantidad_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_cantidad_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_cantidad_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version
+	);
+end;
+$$;
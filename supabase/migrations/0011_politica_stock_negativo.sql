@@ -0,0 +1,314 @@
+-- Política de existencias negativas.
+--
+-- Una política aplica a todo el inventario, a una categoría o a un artículo,
+-- y opcionalmente a un solo tipo de movimiento. Cuando una salida deja el
+-- inventario en negativo se usa la política más específica: rechazar el
+-- movimiento (422), permitirlo marcado como backorder, o permitirlo sin más.
+-- Sin política configurada se permite, como hasta ahora.
+
+create table if not exists politicas_stock_negativo (
+	id bigint generated by default as identity primary key,
+	articulo_id bigint references articulos (id) on delete cascade,
+	categoria_id bigint references categorias (id) on delete cascade,
+	tipo_movimiento text references tipos_movimiento (clave) on delete cascade,
+	accion text not null check (accion in ('permitir', 'rechazar', 'backorder')),
+	created_at timestamptz not null default now(),
+	check (articulo_id is null or categoria_id is null)
+);
+
+create unique index if not exists politicas_stock_negativo_alcance_key
+	on politicas_stock_negativo (
+		coalesce(articulo_id, 0),
+		coalesce(categoria_id, 0),
+		coalesce(tipo_movimiento, '')
+	);
+
+alter table movimientos_inventario
+	add column if not exists backorder boolean not null default false;
+
+-- Acción que corresponde a una salida del artículo con el tipo indicado.
+-- Gana el alcance más específico (artículo, categoría, global) y, dentro de
+-- cada alcance, la regla del tipo de movimiento sobre la general.
+create or replace function politica_stock_negativo(p_articulo_id bigint, p_tipo text)
+returns text
+language sql
+stable
+as $$
+	select coalesce((
+		select p.accion
+		from politicas_stock_negativo p
+		left join articulos a on a.id = p_articulo_id
+		where (p.tipo_movimiento is null or p.tipo_movimiento = p_tipo)
+			and (
+				p.articulo_id = p_articulo_id
+				or p.categoria_id = a.categoria_id
+				or (p.articulo_id is null and p.categoria_id is null)
+			)
+		order by
+			case
+				when p.articulo_id is not null then 0
+				when p.categoria_id is not null then 1
+				else 2
+			end,
+			p.tipo_movimiento is null
+		limit 1
+	), 'permitir');
+$$;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+begin
+	-- Si otro movimiento tiene el inventario bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	if v_version is null then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	-- Una salida que deja existencias negativas se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo %: hay %, se solicitan %',
+					v_articulo_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	select coalesce(costo, 0)
+	into v_costo_anterior
+	from articulos
+	where id = v_articulo_id
+	for update;
+
+	-- Promedio ponderado móvil: sólo las entradas que traen costo lo recalculan.
+	-- Si no había existencias (o eran negativas) el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_cantidad_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_cantidad_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_cantidad_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_cantidad_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder
+	);
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id
+			));
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
@@ -0,0 +1,248 @@
+-- Niveles mínimo y máximo de existencias con alertas.
+--
+-- aplicar_movimiento registra una alerta cuando un movimiento cruza el mínimo
+-- hacia abajo o el máximo hacia arriba, y marca como atendidas las alertas de
+-- mínimo cuando las existencias se reponen.
+
+alter table articulos
+	add column if not exists stock_minimo numeric check (stock_minimo >= 0),
+	add column if not exists stock_maximo numeric check (stock_maximo >= 0);
+
+alter table articulos
+	drop constraint if exists articulos_stock_minimo_maximo_check;
+alter table articulos
+	add constraint articulos_stock_minimo_maximo_check
+	check (stock_minimo is null or stock_maximo is null or stock_minimo <= stock_maximo);
+
+create table if not exists alertas_stock (
+	id bigint generated by default as identity primary key,
+	articulo_id bigint not null references articulos (id) on delete cascade,
+	movimiento_id bigint references movimientos_inventario (id),
+	tipo text not null check (tipo in ('bajo_minimo', 'sobre_maximo')),
+	cantidad_anterior numeric not null,
+	cantidad_actual numeric not null,
+	stock_minimo numeric,
+	stock_maximo numeric,
+	atendida boolean not null default false,
+	fecha timestamptz not null default now()
+);
+
+create index if not exists alertas_stock_pendientes_idx
+	on alertas_stock (articulo_id)
+	where not atendida;
+
+-- Artículos activos por debajo de su mínimo. La cantidad sugerida repone
+-- hasta el máximo, o hasta el mínimo si no hay máximo configurado.
+create or replace view articulos_bajo_minimo as
+select
+	a.id as articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.proveedor,
+	a.categoria_id,
+	i.cantidad_actual,
+	a.stock_minimo,
+	a.stock_maximo,
+	coalesce(a.stock_maximo, a.stock_minimo) - i.cantidad_actual as cantidad_sugerida,
+	(
+		select max(al.fecha)
+		from alertas_stock al
+		where al.articulo_id = a.id
+			and al.tipo = 'bajo_minimo'
+			and not al.atendida
+	) as fecha_alerta
+from articulos a
+join inventarios i on i.articulo_id = a.id
+where a.estado = 'activo'
+	and a.stock_minimo is not null
+	and i.cantidad_actual < a.stock_minimo;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+begin
+	-- Si otro movimiento tiene el inventario bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	if v_version is null then
+		raise exception 'Inventario no encontrado para articulo_id %', v_articulo_id;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	-- Una salida que deja existencias negativas se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo %: hay %, se solicitan %',
+					v_articulo_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	select coalesce(costo, 0), stock_minimo, stock_maximo
+	into v_costo_anterior, v_stock_minimo, v_stock_maximo
+	from articulos
+	where id = v_articulo_id
+	for update;
+
+	-- Promedio ponderado móvil: sólo las entradas que traen costo lo recalculan.
+	-- Si no había existencias (o eran negativas) el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_cantidad_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_cantidad_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_cantidad_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_cantidad_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Alertas al cruzar un umbral; al volver sobre el mínimo se dan por atendidas
+	if v_stock_minimo is not null and v_cantidad_anterior >= v_stock_minimo and v_cantidad_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_cantidad_anterior <= v_stock_maximo and v_cantidad_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_cantidad_anterior,
+			v_cantidad_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_cantidad_anterior < v_stock_minimo and v_cantidad_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta
+	);
+end;
+$$;
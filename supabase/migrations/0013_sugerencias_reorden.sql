@@ -0,0 +1,276 @@
+-- Sugerencias de reorden y compras en borrador.
+--
+-- Una compra en borrador guarda cabecera y líneas pero no mueve inventario ni
+-- costo hasta que se confirma. Las sugerencias comparan el consumo reciente
+-- con las existencias y el tiempo de entrega del proveedor.
+
+alter table compras
+	add column if not exists estado text not null default 'registrada'
+		check (estado in ('borrador', 'registrada')),
+	add column if not exists proveedor text;
+
+-- Días que tarda cada proveedor (articulos.proveedor) en surtir un pedido.
+create table if not exists proveedores_tiempos_entrega (
+	proveedor text primary key,
+	dias_entrega int not null check (dias_entrega >= 0),
+	created_at timestamptz not null default now()
+);
+
+-- Propone cuánto pedir de cada artículo activo. El consumo diario sale de lo
+-- vendido en los últimos p_dias (ventas_detalle) más las demás salidas
+-- manuales del periodo (bajas, robos; movimientos sin venta ni compra). Se
+-- sugiere pedir cuando lo que hay más lo ya pedido en borradores no cubre el
+-- tiempo de entrega más el mínimo, y se pide lo necesario para cubrir además
+-- p_cobertura días, o hasta el máximo si es mayor.
+create or replace function sugerencias_reorden(
+	p_dias int default 90,
+	p_cobertura int default 30
+) returns table (
+	articulo_id bigint,
+	nombre text,
+	marca text,
+	proveedor text,
+	dias_entrega int,
+	cantidad_actual numeric,
+	cantidad_pedida numeric,
+	stock_minimo numeric,
+	stock_maximo numeric,
+	vendidas numeric,
+	otras_salidas numeric,
+	consumo_diario numeric,
+	punto_reorden numeric,
+	cantidad_sugerida numeric,
+	costo_unitario numeric
+)
+language sql
+stable
+as $$
+	with ventas_periodo as (
+		select vd.articulo_id, sum(vd.cantidad) as cantidad
+		from ventas_detalle vd
+		join ventas v on v.id = vd.venta_id
+		where v.created_at >= now() - make_interval(days => p_dias)
+		group by vd.articulo_id
+	),
+	salidas_periodo as (
+		select m.articulo_id, sum(-t.signo * m.cantidad) as cantidad
+		from movimientos_inventario m
+		join tipos_movimiento t on t.clave = m.tipo_movimiento
+		where t.signo < 0
+			and m.venta_id is null
+			and m.compra_id is null
+			and m.tipo_movimiento <> 'transferencia_salida'
+			and m.fecha >= now() - make_interval(days => p_dias)
+		group by m.articulo_id
+	),
+	borradores as (
+		select cd.articulo_id, sum(cd.cantidad) as cantidad
+		from compras_detalles cd
+		join compras c on c.id = cd.compra_id
+		where c.estado = 'borrador'
+		group by cd.articulo_id
+	),
+	consumo as (
+		select
+			a.id as articulo_id,
+			a.nombre,
+			a.marca,
+			a.proveedor,
+			coalesce(pt.dias_entrega, 7) as dias_entrega,
+			i.cantidad_actual,
+			coalesce(b.cantidad, 0) as cantidad_pedida,
+			a.stock_minimo,
+			a.stock_maximo,
+			coalesce(vp.cantidad, 0) as vendidas,
+			coalesce(sp.cantidad, 0) as otras_salidas,
+			(coalesce(vp.cantidad, 0) + coalesce(sp.cantidad, 0)) / greatest(p_dias, 1)::numeric as consumo_diario,
+			coalesce(a.costo, 0) as costo_unitario
+		from articulos a
+		join inventarios i on i.articulo_id = a.id
+		left join proveedores_tiempos_entrega pt on pt.proveedor = a.proveedor
+		left join ventas_periodo vp on vp.articulo_id = a.id
+		left join salidas_periodo sp on sp.articulo_id = a.id
+		left join borradores b on b.articulo_id = a.id
+		where a.estado = 'activo'
+	),
+	calculo as (
+		select
+			c.*,
+			round(c.consumo_diario * c.dias_entrega + coalesce(c.stock_minimo, 0), 2) as punto_reorden,
+			greatest(
+				coalesce(c.stock_maximo, 0),
+				c.consumo_diario * (c.dias_entrega + p_cobertura) + coalesce(c.stock_minimo, 0)
+			) as objetivo
+		from consumo c
+	)
+	select
+		articulo_id,
+		nombre,
+		marca,
+		proveedor,
+		dias_entrega,
+		cantidad_actual,
+		cantidad_pedida,
+		stock_minimo,
+		stock_maximo,
+		vendidas,
+		otras_salidas,
+		round(consumo_diario, 4),
+		punto_reorden,
+		ceil(objetivo - cantidad_actual - cantidad_pedida),
+		costo_unitario
+	from calculo
+	where cantidad_actual + cantidad_pedida <= punto_reorden
+		and ceil(objetivo - cantidad_actual - cantidad_pedida) > 0
+	order by proveedor nulls last, nombre;
+$$;
+
+-- Guarda una compra en borrador: cabecera y líneas, sin movimientos.
+create or replace function crear_compra_borrador(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas, proveedor, estado)
+	values (p_compra->>'notas', p_compra->>'proveedor', 'borrador')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
+
+-- Confirma un borrador: la compra pasa a registrada y se aplican los
+-- movimientos de entrada que arma la API a partir de sus líneas.
+create or replace function confirmar_compra(
+	p_compra_id bigint,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_estado text;
+begin
+	select estado into v_estado
+	from compras
+	where id = p_compra_id
+	for update;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	if v_estado <> 'borrador' then
+		raise exception 'La compra % ya está registrada', p_compra_id using errcode = 'PT409';
+	end if;
+
+	update compras
+	set estado = 'registrada'
+	where id = p_compra_id;
+
+	perform aplicar_movimientos(p_movimientos);
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+-- Editar o eliminar un borrador no toca inventario: nunca lo afectó.
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_estado text;
+begin
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id
+	returning estado into v_estado;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	if v_estado <> 'borrador' then
+		perform aplicar_movimientos(p_movimientos);
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+create or replace function eliminar_compra(
+	p_compra_id bigint,
+	p_movimientos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_estado text;
+begin
+	delete from compras
+	where id = p_compra_id
+	returning estado into v_estado;
+
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	if v_estado <> 'borrador' then
+		perform aplicar_movimientos(p_movimientos);
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
@@ -0,0 +1,557 @@
+-- Inventario por almacén.
+--
+-- Cada artículo tiene un renglón de inventarios por almacén y cada movimiento
+-- indica el almacén que afecta; sin almacén se usa el predeterminado, así que
+-- ventas, compras y movimientos existentes siguen funcionando igual. El costo
+-- promedio y los umbrales de stock siguen siendo por artículo y se calculan
+-- con el total de todos los almacenes. Una transferencia registra la salida
+-- de un almacén y la entrada al otro en la misma transacción.
+
+create table if not exists almacenes (
+	id bigint generated by default as identity primary key,
+	nombre text not null unique,
+	descripcion text,
+	activo boolean not null default true,
+	predeterminado boolean not null default false,
+	created_at timestamptz not null default now()
+);
+
+create unique index if not exists almacenes_predeterminado_key
+	on almacenes (predeterminado)
+	where predeterminado;
+
+insert into almacenes (nombre, predeterminado)
+select 'Principal', true
+where not exists (select 1 from almacenes where predeterminado);
+
+create or replace function almacen_predeterminado()
+returns bigint
+language sql
+stable
+as $$
+	select id from almacenes where predeterminado;
+$$;
+
+-- Inventarios: un renglón por artículo y almacén
+alter table inventarios
+	add column if not exists almacen_id bigint references almacenes (id);
+
+update inventarios
+set almacen_id = almacen_predeterminado()
+where almacen_id is null;
+
+alter table inventarios
+	alter column almacen_id set default almacen_predeterminado(),
+	alter column almacen_id set not null;
+
+alter table inventarios
+	drop constraint if exists inventarios_articulo_id_key;
+
+create unique index if not exists inventarios_articulo_almacen_key
+	on inventarios (articulo_id, almacen_id);
+
+create table if not exists transferencias (
+	id bigint generated by default as identity primary key,
+	articulo_id bigint not null references articulos (id),
+	almacen_origen_id bigint not null references almacenes (id),
+	almacen_destino_id bigint not null references almacenes (id),
+	cantidad numeric not null check (cantidad > 0),
+	motivo text,
+	usuario_nombre text,
+	fecha timestamptz not null default now(),
+	check (almacen_origen_id <> almacen_destino_id)
+);
+
+-- Movimientos: los anteriores a esta migración ocurrieron en el único almacén
+-- que había. Es la única vez que se tocan movimientos ya registrados, por eso
+-- se suspende el trigger de inmutabilidad sólo para este llenado.
+alter table movimientos_inventario
+	add column if not exists almacen_id bigint references almacenes (id),
+	add column if not exists transferencia_id bigint references transferencias (id);
+
+alter table movimientos_inventario disable trigger movimientos_inventario_inmutable;
+update movimientos_inventario
+set almacen_id = almacen_predeterminado()
+where almacen_id is null;
+alter table movimientos_inventario enable trigger movimientos_inventario_inmutable;
+
+alter table movimientos_inventario
+	alter column almacen_id set not null;
+
+create index if not exists movimientos_inventario_almacen_idx
+	on movimientos_inventario (almacen_id, articulo_id, fecha);
+
+-- Tomas físicas: cada toma cuenta un solo almacén
+alter table tomafisica
+	add column if not exists almacen_id bigint references almacenes (id);
+
+update tomafisica
+set almacen_id = almacen_predeterminado()
+where almacen_id is null;
+
+alter table tomafisica
+	alter column almacen_id set default almacen_predeterminado(),
+	alter column almacen_id set not null;
+
+drop view if exists tomafisica_view;
+create view tomafisica_view as
+select
+	t.*,
+	c.nombre as categoria_nombre,
+	al.nombre as almacen_nombre
+from tomafisica t
+left join categorias c on c.id = t.categoria_id
+join almacenes al on al.id = t.almacen_id;
+
+-- Reporte de inventario: inventario_view suma todos los almacenes e
+-- inventario_almacen_view da el detalle por almacén con las mismas columnas.
+drop view if exists inventario_view;
+create view inventario_view as
+select
+	a.id,
+	a.nombre,
+	a.precio_venta,
+	a.costo,
+	a.proveedor,
+	a.codigo_barras,
+	a.marca,
+	a.estado,
+	a.categoria_id,
+	coalesce(sum(i.cantidad_actual), 0) as cantidad_actual,
+	max(i.ultima_actualizacion) as ultima_actualizacion
+from articulos a
+left join inventarios i on i.articulo_id = a.id
+group by a.id;
+
+create or replace view inventario_almacen_view as
+select
+	a.id,
+	a.nombre,
+	a.precio_venta,
+	a.costo,
+	a.proveedor,
+	a.codigo_barras,
+	a.marca,
+	a.estado,
+	a.categoria_id,
+	i.cantidad_actual,
+	i.ultima_actualizacion,
+	i.almacen_id,
+	al.nombre as almacen_nombre
+from articulos a
+join inventarios i on i.articulo_id = a.id
+join almacenes al on al.id = i.almacen_id;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_movimiento->>'almacen_id')::bigint, almacen_predeterminado());
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_total_anterior numeric;
+	v_total_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Si otro movimiento tiene el artículo bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	-- El artículo se bloquea antes que el inventario del almacén: el costo y
+	-- los umbrales dependen de las existencias de todos los almacenes.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select coalesce(costo, 0), stock_minimo, stock_maximo
+		into v_costo_anterior, v_stock_minimo, v_stock_maximo
+		from articulos
+		where id = v_articulo_id
+		for update;
+
+		if not found then
+			raise exception 'El artículo % no existe', v_articulo_id;
+		end if;
+
+		-- El primer movimiento de un artículo en un almacén abre su inventario
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo_id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+			and almacen_id = v_almacen_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+		and almacen_id = v_almacen_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select sum(cantidad_actual)
+	into v_total_actual
+	from inventarios
+	where articulo_id = v_articulo_id;
+
+	v_total_anterior := v_total_actual - v_delta;
+
+	-- Una salida que deja el almacén en negativo se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo % en el almacén %: hay %, se solicitan %',
+					v_articulo_id, v_almacen_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	-- Promedio ponderado móvil sobre las existencias de todos los almacenes:
+	-- sólo las entradas que traen costo lo recalculan, de modo que una
+	-- transferencia no lo altera. Si no había existencias (o eran negativas)
+	-- el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_total_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_total_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_total_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		almacen_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		transferencia_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		(p_movimiento->>'transferencia_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_total_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Los umbrales son por artículo y se comparan contra el total de almacenes.
+	-- Al volver sobre el mínimo las alertas pendientes se dan por atendidas.
+	if v_stock_minimo is not null and v_total_anterior >= v_stock_minimo and v_total_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_total_anterior <= v_stock_maximo and v_total_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_total_anterior,
+			v_total_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_total_anterior < v_stock_minimo and v_total_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'almacen_id', v_almacen_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta
+	);
+end;
+$$;
+
+-- Mueve existencias entre almacenes: registra la transferencia y aplica la
+-- salida y la entrada, enlazadas a ella, en la misma transacción. p_salida y
+-- p_entrada llegan de la API con su tipo y delta según el registro de tipos.
+create or replace function transferir_inventario(
+	p_transferencia jsonb,
+	p_salida jsonb,
+	p_entrada jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_transferencia_id bigint;
+	v_salida jsonb;
+	v_entrada jsonb;
+begin
+	insert into transferencias (
+		articulo_id,
+		almacen_origen_id,
+		almacen_destino_id,
+		cantidad,
+		motivo,
+		usuario_nombre
+	) values (
+		(p_transferencia->>'articulo_id')::bigint,
+		(p_transferencia->>'almacen_origen_id')::bigint,
+		(p_transferencia->>'almacen_destino_id')::bigint,
+		(p_transferencia->>'cantidad')::numeric,
+		p_transferencia->>'motivo',
+		p_transferencia->>'usuario_nombre'
+	)
+	returning id into v_transferencia_id;
+
+	v_salida := aplicar_movimiento(p_salida || jsonb_build_object(
+		'almacen_id', p_transferencia->'almacen_origen_id',
+		'transferencia_id', v_transferencia_id
+	));
+	v_entrada := aplicar_movimiento(p_entrada || jsonb_build_object(
+		'almacen_id', p_transferencia->'almacen_destino_id',
+		'transferencia_id', v_transferencia_id
+	));
+
+	return jsonb_build_object(
+		'transferencia_id', v_transferencia_id,
+		'salida', v_salida,
+		'entrada', v_entrada
+	);
+end;
+$$;
+
+-- Artículos activos por debajo de su mínimo, sumando todos los almacenes. La cantidad sugerida repone
+-- hasta el máximo, o hasta el mínimo si no hay máximo configurado.
+create or replace view articulos_bajo_minimo as
+select
+	a.id as articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.proveedor,
+	a.categoria_id,
+	i.cantidad_actual,
+	a.stock_minimo,
+	a.stock_maximo,
+	coalesce(a.stock_maximo, a.stock_minimo) - i.cantidad_actual as cantidad_sugerida,
+	(
+		select max(al.fecha)
+		from alertas_stock al
+		where al.articulo_id = a.id
+			and al.tipo = 'bajo_minimo'
+			and not al.atendida
+	) as fecha_alerta
+from articulos a
+join (
+	select articulo_id, sum(cantidad_actual) as cantidad_actual
+	from inventarios
+	group by articulo_id
+) i on i.articulo_id = a.id
+where a.estado = 'activo'
+	and a.stock_minimo is not null
+	and i.cantidad_actual < a.stock_minimo;
+
+-- Propone cuánto pedir de cada artículo activo, con las existencias de todos
+-- los almacenes. El consumo diario sale de lo
+-- vendido en los últimos p_dias (ventas_detalle) más las demás salidas
+-- manuales del periodo (bajas, robos; movimientos sin venta ni compra). Se
+-- sugiere pedir cuando lo que hay más lo ya pedido en borradores no cubre el
+-- tiempo de entrega más el mínimo, y se pide lo necesario para cubrir además
+-- p_cobertura días, o hasta el máximo si es mayor.
+create or replace function sugerencias_reorden(
+	p_dias int default 90,
+	p_cobertura int default 30
+) returns table (
+	articulo_id bigint,
+	nombre text,
+	marca text,
+	proveedor text,
+	dias_entrega int,
+	cantidad_actual numeric,
+	cantidad_pedida numeric,
+	stock_minimo numeric,
+	stock_maximo numeric,
+	vendidas numeric,
+	otras_salidas numeric,
+	consumo_diario numeric,
+	punto_reorden numeric,
+	cantidad_sugerida numeric,
+	costo_unitario numeric
+)
+language sql
+stable
+as $$
+	with ventas_periodo as (
+		select vd.articulo_id, sum(vd.cantidad) as cantidad
+		from ventas_detalle vd
+		join ventas v on v.id = vd.venta_id
+		where v.created_at >= now() - make_interval(days => p_dias)
+		group by vd.articulo_id
+	),
+	salidas_periodo as (
+		select m.articulo_id, sum(-t.signo * m.cantidad) as cantidad
+		from movimientos_inventario m
+		join tipos_movimiento t on t.clave = m.tipo_movimiento
+		where t.signo < 0
+			and m.venta_id is null
+			and m.compra_id is null
+			and m.tipo_movimiento <> 'transferencia_salida'
+			and m.fecha >= now() - make_interval(days => p_dias)
+		group by m.articulo_id
+	),
+	borradores as (
+		select cd.articulo_id, sum(cd.cantidad) as cantidad
+		from compras_detalles cd
+		join compras c on c.id = cd.compra_id
+		where c.estado = 'borrador'
+		group by cd.articulo_id
+	),
+	consumo as (
+		select
+			a.id as articulo_id,
+			a.nombre,
+			a.marca,
+			a.proveedor,
+			coalesce(pt.dias_entrega, 7) as dias_entrega,
+			i.cantidad_actual,
+			coalesce(b.cantidad, 0) as cantidad_pedida,
+			a.stock_minimo,
+			a.stock_maximo,
+			coalesce(vp.cantidad, 0) as vendidas,
+			coalesce(sp.cantidad, 0) as otras_salidas,
+			(coalesce(vp.cantidad, 0) + coalesce(sp.cantidad, 0)) / greatest(p_dias, 1)::numeric as consumo_diario,
+			coalesce(a.costo, 0) as costo_unitario
+		from articulos a
+		join (
+			select articulo_id, sum(cantidad_actual) as cantidad_actual
+			from inventarios
+			group by articulo_id
+		) i on i.articulo_id = a.id
+		left join proveedores_tiempos_entrega pt on pt.proveedor = a.proveedor
+		left join ventas_periodo vp on vp.articulo_id = a.id
+		left join salidas_periodo sp on sp.articulo_id = a.id
+		left join borradores b on b.articulo_id = a.id
+		where a.estado = 'activo'
+	),
+	calculo as (
+		select
+			c.*,
+			round(c.consumo_diario * c.dias_entrega + coalesce(c.stock_minimo, 0), 2) as punto_reorden,
+			greatest(
+				coalesce(c.stock_maximo, 0),
+				c.consumo_diario * (c.dias_entrega + p_cobertura) + coalesce(c.stock_minimo, 0)
+			) as objetivo
+		from consumo c
+	)
+	select
+		articulo_id,
+		nombre,
+		marca,
+		proveedor,
+		dias_entrega,
+		cantidad_actual,
+		cantidad_pedida,
+		stock_minimo,
+		stock_maximo,
+		vendidas,
+		otras_salidas,
+		round(consumo_diario, 4),
+		punto_reorden,
+		ceil(objetivo - cantidad_actual - cantidad_pedida),
+		costo_unitario
+	from calculo
+	where cantidad_actual + cantidad_pedida <= punto_reorden
+		and ceil(objetivo - cantidad_actual - cantidad_pedida) > 0
+	order by proveedor nulls last, nombre;
+$$;
@@ -0,0 +1,579 @@
+-- Números de serie para artículos serializados.
+--
+-- Cada unidad de un artículo serializado tiene un renglón en series con su
+-- estado y almacén. aplicar_movimiento acepta la lista de series que mueve:
+-- las entradas las dejan disponibles en el almacén, las salidas las sacan
+-- (vendida si es venta) y cada movimiento queda enlazado a sus series en
+-- movimientos_series, de donde sale la historia de la unidad. La recepción
+-- de compras y las ventas exigen las series de los artículos serializados.
+
+alter table articulos
+	add column if not exists serializado boolean not null default false;
+
+create table if not exists series (
+	id bigint generated by default as identity primary key,
+	articulo_id bigint not null references articulos (id),
+	numero_serie text not null,
+	estado text not null check (estado in ('disponible', 'vendida', 'fuera')),
+	almacen_id bigint not null references almacenes (id),
+	created_at timestamptz not null default now(),
+	unique (articulo_id, numero_serie)
+);
+
+create index if not exists series_numero_serie_idx on series (numero_serie);
+
+create table if not exists movimientos_series (
+	movimiento_id bigint not null references movimientos_inventario (id),
+	serie_id bigint not null references series (id),
+	primary key (movimiento_id, serie_id)
+);
+
+-- Historia de cada serie: un renglón por movimiento con su almacén y, si lo
+-- hay, la venta (con el cliente) o la compra que lo originó.
+create or replace view series_historial as
+select
+	s.id as serie_id,
+	s.numero_serie,
+	s.articulo_id,
+	a.nombre as articulo_nombre,
+	a.marca,
+	s.estado,
+	s.almacen_id as almacen_actual_id,
+	aa.nombre as almacen_actual_nombre,
+	m.id as movimiento_id,
+	m.fecha,
+	m.tipo_movimiento,
+	m.motivo,
+	m.usuario_nombre,
+	m.almacen_id,
+	al.nombre as almacen_nombre,
+	m.compra_id,
+	m.venta_id,
+	v.cliente_nombre,
+	v.cliente_razon_social,
+	v.cliente_telefono,
+	v.cliente_correo
+from series s
+join articulos a on a.id = s.articulo_id
+join almacenes aa on aa.id = s.almacen_id
+left join movimientos_series ms on ms.serie_id = s.id
+left join movimientos_inventario m on m.id = ms.movimiento_id
+left join almacenes al on al.id = m.almacen_id
+left join ventas v on v.id = m.venta_id;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_movimiento->>'almacen_id')::bigint, almacen_predeterminado());
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_total_anterior numeric;
+	v_total_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+	v_serializado boolean;
+	v_series jsonb := p_movimiento->'series';
+	v_serie text;
+	v_serie_id bigint;
+	v_serie_estado text;
+	v_serie_almacen bigint;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Si otro movimiento tiene el artículo bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	-- El artículo se bloquea antes que el inventario del almacén: el costo y
+	-- los umbrales dependen de las existencias de todos los almacenes.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select coalesce(costo, 0), stock_minimo, stock_maximo, serializado
+		into v_costo_anterior, v_stock_minimo, v_stock_maximo, v_serializado
+		from articulos
+		where id = v_articulo_id
+		for update;
+
+		if not found then
+			raise exception 'El artículo % no existe', v_articulo_id;
+		end if;
+
+		-- El primer movimiento de un artículo en un almacén abre su inventario
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo_id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+			and almacen_id = v_almacen_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	-- Números de serie: obligatorios cuando quien llama lo pide (recepción de
+	-- compras, ventas) y, si vienen, uno por unidad.
+	if v_serializado and jsonb_typeof(v_series) is distinct from 'array'
+		and coalesce((p_movimiento->>'requiere_series')::boolean, false) then
+		raise exception 'El artículo % es serializado, indique los números de serie', v_articulo_id
+			using errcode = 'PT422';
+	end if;
+	if jsonb_typeof(v_series) = 'array' then
+		if not v_serializado then
+			raise exception 'El artículo % no es serializado', v_articulo_id using errcode = 'PT422';
+		end if;
+		if jsonb_array_length(v_series) <> abs(v_delta) then
+			raise exception 'Se indicaron % números de serie para % unidades del artículo %',
+				jsonb_array_length(v_series), abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	else
+		v_series := null;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+		and almacen_id = v_almacen_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select sum(cantidad_actual)
+	into v_total_actual
+	from inventarios
+	where articulo_id = v_articulo_id;
+
+	v_total_anterior := v_total_actual - v_delta;
+
+	-- Una salida que deja el almacén en negativo se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo % en el almacén %: hay %, se solicitan %',
+					v_articulo_id, v_almacen_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	-- Promedio ponderado móvil sobre las existencias de todos los almacenes:
+	-- sólo las entradas que traen costo lo recalculan, de modo que una
+	-- transferencia no lo altera. Si no había existencias (o eran negativas)
+	-- el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_total_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_total_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_total_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		almacen_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		transferencia_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		(p_movimiento->>'transferencia_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	-- Cada serie entra disponible al almacén o sale de él, y queda enlazada
+	-- al movimiento para reconstruir su historia.
+	for v_serie in select jsonb_array_elements_text(v_series)
+	loop
+		select id, estado, almacen_id
+		into v_serie_id, v_serie_estado, v_serie_almacen
+		from series
+		where articulo_id = v_articulo_id
+			and numero_serie = v_serie
+		for update;
+
+		if v_delta > 0 then
+			if v_serie_estado = 'disponible' then
+				raise exception 'La serie % del artículo % ya está en existencia', v_serie, v_articulo_id
+					using errcode = 'PT409';
+			end if;
+
+			if v_serie_id is null then
+				insert into series (articulo_id, numero_serie, estado, almacen_id)
+				values (v_articulo_id, v_serie, 'disponible', v_almacen_id)
+				returning id into v_serie_id;
+			else
+				update series
+				set estado = 'disponible',
+					almacen_id = v_almacen_id
+				where id = v_serie_id;
+			end if;
+		else
+			if v_serie_id is null or v_serie_estado <> 'disponible' or v_serie_almacen <> v_almacen_id then
+				raise exception 'La serie % del artículo % no está disponible en el almacén %',
+					v_serie, v_articulo_id, v_almacen_id
+					using errcode = 'PT409';
+			end if;
+
+			update series
+			set estado = case when p_movimiento->>'tipo_movimiento' = 'venta' then 'vendida' else 'fuera' end
+			where id = v_serie_id;
+		end if;
+
+		insert into movimientos_series (movimiento_id, serie_id)
+		values (v_movimiento_id, v_serie_id);
+
+		v_serie_id := null;
+		v_serie_estado := null;
+		v_serie_almacen := null;
+	end loop;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_total_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Los umbrales son por artículo y se comparan contra el total de almacenes.
+	-- Al volver sobre el mínimo las alertas pendientes se dan por atendidas.
+	if v_stock_minimo is not null and v_total_anterior >= v_stock_minimo and v_total_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_total_anterior <= v_stock_maximo and v_total_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_total_anterior,
+			v_total_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_total_anterior < v_stock_minimo and v_total_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'almacen_id', v_almacen_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta,
+		'series', coalesce(v_series, '[]'::jsonb)
+	);
+end;
+$$;
+
+-- Revierte un movimiento y, si se indica, registra el que lo reemplaza.
+-- p_reverso y p_nuevo llegan armados desde la API con su delta; aquí se
+-- validan contra el original y se enlazan a él.
+create or replace function reversar_movimiento(
+	p_movimiento_id bigint,
+	p_reverso jsonb,
+	p_nuevo jsonb default null
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_original movimientos_inventario;
+	v_reverso jsonb;
+	v_nuevo jsonb;
+begin
+	select * into v_original
+	from movimientos_inventario
+	where id = p_movimiento_id
+	for update;
+
+	if not found then
+		raise exception 'No se encontró el movimiento %', p_movimiento_id using errcode = 'PT404';
+	end if;
+
+	if v_original.reversa_de is not null then
+		raise exception 'El movimiento % es un reverso y no se puede revertir', p_movimiento_id
+			using errcode = 'PT409';
+	end if;
+
+	if exists (select 1 from movimientos_inventario where reversa_de = p_movimiento_id) then
+		raise exception 'El movimiento % ya fue revertido', p_movimiento_id using errcode = 'PT409';
+	end if;
+
+	-- El reverso devuelve las mismas series que movió el original
+	if not p_reverso ? 'series' then
+		p_reverso := p_reverso || jsonb_build_object('series', (
+			select jsonb_agg(s.numero_serie order by s.numero_serie)
+			from movimientos_series ms
+			join series s on s.id = ms.serie_id
+			where ms.movimiento_id = p_movimiento_id
+		));
+	end if;
+
+	v_reverso := aplicar_movimiento(p_reverso || jsonb_build_object('reversa_de', p_movimiento_id));
+
+	if p_nuevo is not null then
+		v_nuevo := aplicar_movimiento(p_nuevo || jsonb_build_object('reemplaza_a', p_movimiento_id));
+	end if;
+
+	return jsonb_build_object(
+		'reverso', v_reverso,
+		'nuevo', v_nuevo
+	);
+end;
+$$;
+
+create or replace function registrar_compra(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_hint text;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas)
+	values (p_compra->>'notas')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'compra',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'costo_unitario', v_item->'precio_unitario',
+				'motivo', 'Compra #' || v_compra_id,
+				'usuario_nombre', p_compra->>'usuario_nombre',
+				'compra_id', v_compra_id,
+				'series', v_item->'series',
+				'requiere_series', true
+			));
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id,
+				'series', v_item->'series',
+				'requiere_series', true
+			));
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
@@ -0,0 +1,209 @@
+-- Trazabilidad de lotes y series hasta el cliente.
+--
+-- Cada línea de venta guarda los lotes y series que se entregaron. Para los
+-- retiros de producto, trazabilidad_ventas calcula desde los movimientos lo
+-- que cada venta se llevó de cada lote o serie, neto de cancelaciones y
+-- reversos, con los datos de contacto del cliente.
+
+alter table ventas_detalle
+	add column if not exists lotes jsonb,
+	add column if not exists series jsonb;
+
+create or replace view trazabilidad_ventas as
+with entregas as (
+	select
+		m.venta_id,
+		m.articulo_id,
+		l.lote,
+		l.caducidad,
+		null::text as numero_serie,
+		sign(t.signo * m.cantidad) * -1 * ml.cantidad as cantidad
+	from movimientos_inventario m
+	join tipos_movimiento t on t.clave = m.tipo_movimiento
+	join movimientos_lotes ml on ml.movimiento_id = m.id
+	join lotes l on l.id = ml.lote_id
+	where m.venta_id is not null
+	union all
+	select
+		m.venta_id,
+		m.articulo_id,
+		null,
+		null,
+		s.numero_serie,
+		sign(t.signo * m.cantidad) * -1
+	from movimientos_inventario m
+	join tipos_movimiento t on t.clave = m.tipo_movimiento
+	join movimientos_series ms on ms.movimiento_id = m.id
+	join series s on s.id = ms.serie_id
+	where m.venta_id is not null
+)
+select
+	e.venta_id,
+	v.created_at as fecha_venta,
+	v.cliente_nombre,
+	v.cliente_razon_social,
+	v.cliente_telefono,
+	v.cliente_correo,
+	e.articulo_id,
+	a.nombre as articulo_nombre,
+	a.marca,
+	e.lote,
+	e.caducidad,
+	e.numero_serie,
+	sum(e.cantidad) as cantidad
+from entregas e
+join ventas v on v.id = e.venta_id
+join articulos a on a.id = e.articulo_id
+group by
+	e.venta_id, v.created_at, v.cliente_nombre, v.cliente_razon_social,
+	v.cliente_telefono, v.cliente_correo, e.articulo_id, a.nombre, a.marca,
+	e.lote, e.caducidad, e.numero_serie
+having sum(e.cantidad) > 0;
+
+-- Lo que de un lote o serie sigue en nuestros almacenes
+create or replace view trazabilidad_existencias as
+select
+	l.articulo_id,
+	l.nombre as articulo_nombre,
+	l.marca,
+	l.almacen_id,
+	l.almacen_nombre,
+	l.lote,
+	l.caducidad,
+	null::text as numero_serie,
+	l.cantidad
+from lotes_caducidad_view l
+union all
+select
+	s.articulo_id,
+	a.nombre,
+	a.marca,
+	s.almacen_id,
+	al.nombre,
+	null,
+	null,
+	s.numero_serie,
+	1
+from series s
+join articulos a on a.id = s.articulo_id
+join almacenes al on al.id = s.almacen_id
+where s.estado = 'disponible';
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+	v_detalle_id bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning id into v_detalle_id;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id,
+				'series', v_item->'series',
+				'requiere_series', true,
+				'lote', v_item->>'lote'
+			));
+
+			-- La línea guarda qué lotes y series se entregaron
+			update ventas_detalle
+			set lotes = nullif(v_movimiento->'lotes', '[]'::jsonb),
+				series = nullif(v_movimiento->'series', '[]'::jsonb)
+			where id = v_detalle_id;
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
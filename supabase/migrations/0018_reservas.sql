@@ -0,0 +1,312 @@
+-- Reservas (apartados) de existencias para un cliente o documento.
+--
+-- Una reserva aparta una cantidad de un artículo en un almacén hasta una
+-- fecha. Sólo cuentan las activas y no vencidas; la API además marca como
+-- vencidas las que pasaron su fecha. registrar_venta consume la reserva que
+-- indique cada línea.
+
+create table if not exists reservas (
+	id bigint generated by default as identity primary key,
+	articulo_id bigint not null references articulos (id),
+	almacen_id bigint not null references almacenes (id),
+	cantidad numeric not null check (cantidad > 0),
+	cliente_nombre text,
+	documento text,
+	notas text,
+	estado text not null default 'activa'
+		check (estado in ('activa', 'consumida', 'liberada', 'vencida')),
+	expira_en timestamptz not null,
+	venta_id bigint references ventas (id) on delete set null,
+	usuario_nombre text,
+	created_at timestamptz not null default now(),
+	liberada_en timestamptz,
+	check (cliente_nombre is not null or documento is not null)
+);
+
+create index if not exists reservas_activas_idx
+	on reservas (articulo_id, almacen_id)
+	where estado = 'activa';
+
+create or replace function cantidad_reservada(p_articulo_id bigint, p_almacen_id bigint default null)
+returns numeric
+language sql
+stable
+as $$
+	select coalesce(sum(cantidad), 0)
+	from reservas
+	where articulo_id = p_articulo_id
+		and (p_almacen_id is null or almacen_id = p_almacen_id)
+		and estado = 'activa'
+		and expira_en > now();
+$$;
+
+-- Las vistas de inventario agregan lo reservado al final
+create or replace view inventario_view as
+select
+	a.id,
+	a.nombre,
+	a.precio_venta,
+	a.costo,
+	a.proveedor,
+	a.codigo_barras,
+	a.marca,
+	a.estado,
+	a.categoria_id,
+	coalesce(sum(i.cantidad_actual), 0) as cantidad_actual,
+	max(i.ultima_actualizacion) as ultima_actualizacion,
+	cantidad_reservada(a.id) as reservado
+from articulos a
+left join inventarios i on i.articulo_id = a.id
+group by a.id;
+
+create or replace view inventario_almacen_view as
+select
+	a.id,
+	a.nombre,
+	a.precio_venta,
+	a.costo,
+	a.proveedor,
+	a.codigo_barras,
+	a.marca,
+	a.estado,
+	a.categoria_id,
+	i.cantidad_actual,
+	i.ultima_actualizacion,
+	i.almacen_id,
+	al.nombre as almacen_nombre,
+	cantidad_reservada(a.id, i.almacen_id) as reservado
+from articulos a
+join inventarios i on i.articulo_id = a.id
+join almacenes al on al.id = i.almacen_id;
+
+-- Crea una reserva si lo disponible (existencia menos lo ya apartado) alcanza.
+-- El bloqueo de la fila de inventarios serializa reservas y movimientos.
+create or replace function crear_reserva(p_reserva jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_reserva->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_reserva->>'almacen_id')::bigint, almacen_predeterminado());
+	v_cantidad numeric := (p_reserva->>'cantidad')::numeric;
+	v_existencia numeric;
+	v_disponible numeric;
+	v_reserva reservas;
+begin
+	set local lock_timeout = '3s';
+
+	select cantidad_actual into v_existencia
+	from inventarios
+	where articulo_id = v_articulo_id and almacen_id = v_almacen_id
+	for update;
+
+	v_disponible := coalesce(v_existencia, 0) - cantidad_reservada(v_articulo_id, v_almacen_id);
+	if v_disponible < v_cantidad then
+		raise exception 'Sólo hay % unidades disponibles del artículo % en el almacén %',
+			greatest(v_disponible, 0), v_articulo_id, v_almacen_id
+			using errcode = 'PT422';
+	end if;
+
+	insert into reservas (
+		articulo_id, almacen_id, cantidad, cliente_nombre, documento,
+		notas, expira_en, usuario_nombre
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		v_cantidad,
+		p_reserva->>'cliente_nombre',
+		p_reserva->>'documento',
+		p_reserva->>'notas',
+		(p_reserva->>'expira_en')::timestamptz,
+		p_reserva->>'usuario_nombre'
+	)
+	returning * into v_reserva;
+
+	return to_jsonb(v_reserva) || jsonb_build_object('disponible', v_disponible - v_cantidad);
+exception
+	when lock_not_available then
+		raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+			using errcode = 'PT409', hint = 'reintentar';
+end;
+$$;
+
+create or replace function liberar_reservas_vencidas()
+returns integer
+language plpgsql
+as $$
+declare
+	v_total integer;
+begin
+	update reservas
+	set estado = 'vencida',
+		liberada_en = now()
+	where estado = 'activa'
+		and expira_en <= now();
+
+	get diagnostics v_total = row_count;
+	return v_total;
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+	v_detalle_id bigint;
+	v_almacen_id bigint;
+	v_reservado numeric;
+	v_cantidad_almacen numeric;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning id into v_detalle_id;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			-- La reserva indicada se consume y la mercancía sale del almacén
+			-- donde estaba apartada
+			v_almacen_id := null;
+			if v_item->>'reserva_id' is not null then
+				update reservas
+				set estado = 'consumida',
+					venta_id = v_venta_id
+				where id = (v_item->>'reserva_id')::bigint
+					and articulo_id = (v_item->>'articulo_id')::bigint
+					and estado = 'activa'
+					and expira_en > now()
+				returning almacen_id into v_almacen_id;
+
+				if not found then
+					raise exception 'La reserva % no está vigente o no corresponde al artículo', v_item->>'reserva_id'
+						using errcode = 'PT409';
+				end if;
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_id,
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id,
+				'series', v_item->'series',
+				'requiere_series', true,
+				'lote', v_item->>'lote'
+			));
+
+			-- La línea guarda qué lotes y series se entregaron
+			update ventas_detalle
+			set lotes = nullif(v_movimiento->'lotes', '[]'::jsonb),
+				series = nullif(v_movimiento->'series', '[]'::jsonb)
+			where id = v_detalle_id;
+
+			-- Donde la política rechaza negativos tampoco se vende lo apartado
+			-- para otros clientes
+			if politica_stock_negativo((v_item->>'articulo_id')::bigint, 'venta') = 'rechazar' then
+				v_reservado := cantidad_reservada(
+					(v_item->>'articulo_id')::bigint,
+					(v_movimiento->>'almacen_id')::bigint
+				);
+				if v_reservado > 0 then
+					select cantidad_actual into v_cantidad_almacen
+					from inventarios
+					where articulo_id = (v_item->>'articulo_id')::bigint
+						and almacen_id = (v_movimiento->>'almacen_id')::bigint;
+
+					if v_cantidad_almacen < v_reservado then
+						raise exception 'Stock insuficiente: % unidades del artículo % están apartadas',
+							v_reservado, v_item->>'articulo_id'
+							using errcode = 'PT422';
+					end if;
+				end if;
+			end if;
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
@@ -0,0 +1,105 @@
+-- Cierre de toma física con ajustes de inventario.
+--
+-- Al cerrar una toma cada artículo contado cuyo conteo difiere de la
+-- existencia del almacén recibe un movimiento ajuste_toma por la diferencia,
+-- de modo que cantidad_actual queda igual a lo contado. El motivo lleva el
+-- folio y el detalle de la toma guarda el movimiento que generó.
+
+-- Las cantidades del ajuste llevan su propio signo (sobrante positivo,
+-- faltante negativo), como los reversos.
+insert into tipos_movimiento (clave, etiqueta, signo, requiere_motivo, permiso) values
+	('ajuste_toma', 'Ajuste por toma física', 1, true, 'update')
+on conflict (clave) do nothing;
+
+alter table tomafisicadetalle
+	add column if not exists movimiento_id bigint references movimientos_inventario (id);
+
+create or replace function cerrar_toma(p_toma_id bigint, p_usuario_nombre text)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_detalle record;
+	v_signo smallint;
+	v_actual numeric;
+	v_delta numeric;
+	v_movimiento jsonb;
+	v_ajustes jsonb := '[]'::jsonb;
+	v_hint text;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id for update;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'abierta' then
+		raise exception 'La toma folio % ya está %', v_toma.folio, v_toma.estado using errcode = 'PT409';
+	end if;
+
+	select signo into v_signo from tipos_movimiento where clave = 'ajuste_toma';
+
+	for v_detalle in
+		select d.id, d.articulo_id, d.cantidad_teorica, d.cantidad_real
+		from tomafisicadetalle d
+		where d.toma_id = p_toma_id
+			and d.cantidad_real is not null
+		order by d.articulo_id
+	loop
+		begin
+			-- Mismo orden de bloqueo que aplicar_movimiento (artículo y después
+			-- inventario) para que la existencia no cambie antes del ajuste
+			perform 1 from articulos where id = v_detalle.articulo_id for update;
+
+			select coalesce(sum(cantidad_actual), 0) into v_actual
+			from inventarios
+			where articulo_id = v_detalle.articulo_id
+				and almacen_id = v_toma.almacen_id;
+
+			v_delta := v_detalle.cantidad_real - v_actual;
+			continue when v_delta = 0;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_detalle.articulo_id,
+				'almacen_id', v_toma.almacen_id,
+				'tipo_movimiento', 'ajuste_toma',
+				'cantidad', v_delta * v_signo,
+				'delta', v_delta,
+				'motivo', 'Ajuste por toma física folio ' || v_toma.folio,
+				'usuario_nombre', p_usuario_nombre
+			));
+
+			update tomafisicadetalle
+			set movimiento_id = (v_movimiento->>'movimiento_id')::bigint
+			where id = v_detalle.id;
+
+			v_ajustes := v_ajustes || jsonb_build_object(
+				'detalle_id', v_detalle.id,
+				'articulo_id', v_detalle.articulo_id,
+				'cantidad_teorica', v_detalle.cantidad_teorica,
+				'cantidad_anterior', v_actual,
+				'cantidad_real', v_detalle.cantidad_real,
+				'ajuste', v_delta,
+				'costo_promedio', v_movimiento->'costo_promedio',
+				'movimiento_id', v_movimiento->'movimiento_id'
+			);
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar el artículo %: %', v_detalle.articulo_id, sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	update tomafisica
+	set estado = 'cerrada',
+		fecha_fin = now()
+	where id = p_toma_id;
+
+	return jsonb_build_object(
+		'toma_id', p_toma_id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'ajustes', v_ajustes
+	);
+end;
+$$;
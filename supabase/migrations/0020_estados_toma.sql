@@ -0,0 +1,217 @@
+-- Estados de la toma física con transiciones controladas.
+--
+--   abierta -> en_conteo -> en_revision -> cerrada
+--                  ^             |
+--                  +-------------+  (regresa a conteo para corregir)
+--
+-- y cualquier estado distinto de cerrada puede pasar a cancelada. Cada
+-- transición queda registrada con el usuario y la fecha. Los conteos
+-- (cantidad_real) sólo se pueden modificar en en_conteo; cerrada y cancelada
+-- son definitivas.
+
+alter table tomafisica
+	drop constraint if exists tomafisica_estado_check;
+
+alter table tomafisica
+	add constraint tomafisica_estado_check
+	check (estado in ('abierta', 'en_conteo', 'en_revision', 'cerrada', 'cancelada'))
+	not valid;
+
+create table if not exists tomafisica_transiciones (
+	id bigint generated by default as identity primary key,
+	toma_id bigint not null references tomafisica (id) on delete cascade,
+	estado_anterior text not null,
+	estado_nuevo text not null,
+	usuario_auth0_sub text,
+	usuario_correo text,
+	motivo text,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists tomafisica_transiciones_toma_idx on tomafisica_transiciones (toma_id);
+
+create or replace function validar_conteo_toma()
+returns trigger
+language plpgsql
+as $$
+declare
+	v_estado text;
+	v_folio bigint;
+begin
+	select estado, folio into v_estado, v_folio from tomafisica where id = new.toma_id;
+	if v_estado is distinct from 'en_conteo' then
+		raise exception 'La toma folio % está %, sólo se pueden registrar conteos en en_conteo', v_folio, v_estado
+			using errcode = 'PT409';
+	end if;
+	return new;
+end;
+$$;
+
+drop trigger if exists tomafisicadetalle_conteo on tomafisicadetalle;
+create trigger tomafisicadetalle_conteo
+	before update of cantidad_real on tomafisicadetalle
+	for each row
+	when (old.cantidad_real is distinct from new.cantidad_real)
+	execute function validar_conteo_toma();
+
+drop function if exists cerrar_toma(bigint, text);
+
+create or replace function cerrar_toma(
+	p_toma_id bigint,
+	p_usuario_sub text,
+	p_usuario_correo text,
+	p_motivo text default null
+)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_detalle record;
+	v_signo smallint;
+	v_actual numeric;
+	v_delta numeric;
+	v_movimiento jsonb;
+	v_ajustes jsonb := '[]'::jsonb;
+	v_hint text;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id for update;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'en_revision' then
+		raise exception 'La toma folio % está %, sólo se puede cerrar desde en_revision', v_toma.folio, v_toma.estado
+			using errcode = 'PT409';
+	end if;
+
+	select signo into v_signo from tipos_movimiento where clave = 'ajuste_toma';
+
+	for v_detalle in
+		select d.id, d.articulo_id, d.cantidad_teorica, d.cantidad_real
+		from tomafisicadetalle d
+		where d.toma_id = p_toma_id
+			and d.cantidad_real is not null
+		order by d.articulo_id
+	loop
+		begin
+			-- Mismo orden de bloqueo que aplicar_movimiento (artículo y después
+			-- inventario) para que la existencia no cambie antes del ajuste
+			perform 1 from articulos where id = v_detalle.articulo_id for update;
+
+			select coalesce(sum(cantidad_actual), 0) into v_actual
+			from inventarios
+			where articulo_id = v_detalle.articulo_id
+				and almacen_id = v_toma.almacen_id;
+
+			v_delta := v_detalle.cantidad_real - v_actual;
+			continue when v_delta = 0;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_detalle.articulo_id,
+				'almacen_id', v_toma.almacen_id,
+				'tipo_movimiento', 'ajuste_toma',
+				'cantidad', v_delta * v_signo,
+				'delta', v_delta,
+				'motivo', 'Ajuste por toma física folio ' || v_toma.folio,
+				'usuario_nombre', p_usuario_correo
+			));
+
+			update tomafisicadetalle
+			set movimiento_id = (v_movimiento->>'movimiento_id')::bigint
+			where id = v_detalle.id;
+
+			v_ajustes := v_ajustes || jsonb_build_object(
+				'detalle_id', v_detalle.id,
+				'articulo_id', v_detalle.articulo_id,
+				'cantidad_teorica', v_detalle.cantidad_teorica,
+				'cantidad_anterior', v_actual,
+				'cantidad_real', v_detalle.cantidad_real,
+				'ajuste', v_delta,
+				'costo_promedio', v_movimiento->'costo_promedio',
+				'movimiento_id', v_movimiento->'movimiento_id'
+			);
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar el artículo %: %', v_detalle.articulo_id, sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	update tomafisica
+	set estado = 'cerrada',
+		fecha_fin = now()
+	where id = p_toma_id;
+
+	insert into tomafisica_transiciones (
+		toma_id, estado_anterior, estado_nuevo, usuario_auth0_sub, usuario_correo, motivo
+	) values (
+		p_toma_id, v_toma.estado, 'cerrada', p_usuario_sub, p_usuario_correo, p_motivo
+	);
+
+	return jsonb_build_object(
+		'toma_id', p_toma_id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'estado_anterior', v_toma.estado,
+		'estado', 'cerrada',
+		'ajustes', v_ajustes
+	);
+end;
+$$;
+
+-- Cambia el estado de la toma validando la transición. El cierre se delega a
+-- cerrar_toma, que además ajusta el inventario.
+create or replace function cambiar_estado_toma(
+	p_toma_id bigint,
+	p_estado text,
+	p_usuario_sub text,
+	p_usuario_correo text,
+	p_motivo text default null
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+begin
+	if p_estado = 'cerrada' then
+		return cerrar_toma(p_toma_id, p_usuario_sub, p_usuario_correo, p_motivo);
+	end if;
+
+	select * into v_toma from tomafisica where id = p_toma_id for update;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+
+	if not (v_toma.estado, p_estado) in (
+		('abierta', 'en_conteo'),
+		('en_conteo', 'en_revision'),
+		('en_revision', 'en_conteo'),
+		('abierta', 'cancelada'),
+		('en_conteo', 'cancelada'),
+		('en_revision', 'cancelada')
+	) then
+		raise exception 'La toma folio % no puede pasar de % a %', v_toma.folio, v_toma.estado, p_estado
+			using errcode = 'PT409';
+	end if;
+
+	update tomafisica
+	set estado = p_estado,
+		fecha_fin = case when p_estado = 'cancelada' then now() else fecha_fin end
+	where id = p_toma_id;
+
+	insert into tomafisica_transiciones (
+		toma_id, estado_anterior, estado_nuevo, usuario_auth0_sub, usuario_correo, motivo
+	) values (
+		p_toma_id, v_toma.estado, p_estado, p_usuario_sub, p_usuario_correo, p_motivo
+	);
+
+	return jsonb_build_object(
+		'toma_id', p_toma_id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'estado_anterior', v_toma.estado,
+		'estado', p_estado
+	);
+end;
+$$;
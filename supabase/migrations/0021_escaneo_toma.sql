@@ -0,0 +1,96 @@
+-- Conteo por escaneo de código de barras durante una toma física.
+--
+-- Cada lectura suma a cantidad_real del artículo en la toma dentro de la
+-- misma sentencia, así dos lectores en el mismo artículo no se pisan. Todas
+-- las lecturas quedan registradas, incluidas las de códigos desconocidos o de
+-- artículos que no forman parte de la toma, para revisarlas antes de cerrar.
+
+create table if not exists tomafisica_escaneos (
+	id bigint generated by default as identity primary key,
+	toma_id bigint not null references tomafisica (id) on delete cascade,
+	codigo_barras text not null,
+	cantidad numeric not null,
+	resultado text not null
+		check (resultado in ('contado', 'desconocido', 'fuera_de_categoria', 'fuera_de_toma')),
+	articulo_id bigint references articulos (id),
+	detalle_id bigint references tomafisicadetalle (id) on delete set null,
+	usuario_auth0_sub text,
+	usuario_correo text,
+	created_at timestamptz not null default now()
+);
+
+create index if not exists tomafisica_escaneos_toma_idx on tomafisica_escaneos (toma_id);
+
+create or replace function escanear_toma(
+	p_toma_id bigint,
+	p_codigo_barras text,
+	p_cantidad numeric,
+	p_usuario_sub text,
+	p_usuario_correo text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_articulo articulos;
+	v_detalle_id bigint;
+	v_cantidad_real numeric;
+	v_resultado text;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'en_conteo' then
+		raise exception 'La toma folio % está %, sólo se puede escanear en en_conteo', v_toma.folio, v_toma.estado
+			using errcode = 'PT409';
+	end if;
+
+	-- Si el código está repetido se prefiere el artículo que sí está en la toma
+	select a.* into v_articulo
+	from articulos a
+	left join tomafisicadetalle d on d.articulo_id = a.id and d.toma_id = p_toma_id
+	where a.codigo_barras = p_codigo_barras
+	order by d.id is null, a.id
+	limit 1;
+
+	if v_articulo.id is null then
+		v_resultado := 'desconocido';
+	else
+		update tomafisicadetalle
+		set cantidad_real = coalesce(cantidad_real, 0) + p_cantidad
+		where toma_id = p_toma_id
+			and articulo_id = v_articulo.id
+		returning id, cantidad_real into v_detalle_id, v_cantidad_real;
+
+		if v_detalle_id is not null then
+			v_resultado := 'contado';
+		elsif v_toma.categoria_id is not null
+			and v_articulo.categoria_id is distinct from v_toma.categoria_id then
+			v_resultado := 'fuera_de_categoria';
+		else
+			-- Artículo dado de alta después de abrir la toma
+			v_resultado := 'fuera_de_toma';
+		end if;
+	end if;
+
+	insert into tomafisica_escaneos (
+		toma_id, codigo_barras, cantidad, resultado, articulo_id, detalle_id,
+		usuario_auth0_sub, usuario_correo
+	) values (
+		p_toma_id, p_codigo_barras, p_cantidad, v_resultado, v_articulo.id, v_detalle_id,
+		p_usuario_sub, p_usuario_correo
+	);
+
+	return jsonb_build_object(
+		'resultado', v_resultado,
+		'codigo_barras', p_codigo_barras,
+		'cantidad', p_cantidad,
+		'articulo_id', v_articulo.id,
+		'articulo_nombre', v_articulo.nombre,
+		'categoria_id', v_articulo.categoria_id,
+		'detalle_id', v_detalle_id,
+		'cantidad_real', v_cantidad_real
+	);
+end;
+$$;
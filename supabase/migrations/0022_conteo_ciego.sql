@@ -0,0 +1,405 @@
+-- Tomas ciegas y con varios contadores.
+--
+-- Una toma ciega no muestra cantidad_teorica a quien cuenta. Con
+-- conteos_requeridos > 1 cada usuario (sub del JWT) registra su propio conteo
+-- en tomafisica_conteos y cantidad_real se fija hasta que coinciden. Antes de
+-- pasar a revisión se marcan para reconteo las líneas en que los conteos
+-- difieren o en que lo contado se aleja de lo teórico más de tolerancia_pct;
+-- una línea marcada por variación se libera cuando todos la vuelven a contar.
+
+alter table tomafisica
+	add column if not exists ciega boolean not null default false,
+	add column if not exists conteos_requeridos integer not null default 1
+		check (conteos_requeridos >= 1),
+	add column if not exists tolerancia_pct numeric check (tolerancia_pct >= 0);
+
+alter table tomafisicadetalle
+	add column if not exists requiere_reconteo boolean not null default false,
+	add column if not exists motivo_reconteo text
+		check (motivo_reconteo in ('conteos_distintos', 'variacion')),
+	add column if not exists reconteo_solicitado_en timestamptz,
+	add column if not exists contado_en timestamptz;
+
+create table if not exists tomafisica_conteos (
+	id bigint generated by default as identity primary key,
+	toma_id bigint not null references tomafisica (id) on delete cascade,
+	detalle_id bigint not null references tomafisicadetalle (id) on delete cascade,
+	usuario_auth0_sub text not null,
+	usuario_correo text,
+	cantidad numeric not null,
+	updated_at timestamptz not null default now(),
+	unique (detalle_id, usuario_auth0_sub)
+);
+
+create index if not exists tomafisica_conteos_toma_idx on tomafisica_conteos (toma_id, usuario_auth0_sub);
+
+-- Las columnas nuevas de tomafisica entran a la vista
+drop view if exists tomafisica_view;
+create view tomafisica_view as
+select
+	t.*,
+	c.nombre as categoria_nombre,
+	al.nombre as almacen_nombre
+from tomafisica t
+left join categorias c on c.id = t.categoria_id
+join almacenes al on al.id = t.almacen_id;
+
+-- Líneas marcadas para reconteo, sin cantidades para no revelarlas en tomas ciegas
+create or replace view tomafisica_reconteo_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	d.motivo_reconteo,
+	d.reconteo_solicitado_en
+from tomafisicadetalle d
+join articulos a on a.id = d.articulo_id
+where d.requiere_reconteo;
+
+-- En conteo cada captura de cantidad_real registra cuándo se contó, aunque
+-- repita el valor (así cuenta como reconteo). Fuera de conteo sólo se acepta
+-- si no cambia.
+create or replace function validar_conteo_toma()
+returns trigger
+language plpgsql
+as $$
+declare
+	v_estado text;
+	v_folio bigint;
+begin
+	select estado, folio into v_estado, v_folio from tomafisica where id = new.toma_id;
+	if v_estado = 'en_conteo' then
+		new.contado_en := now();
+		return new;
+	end if;
+	if old.cantidad_real is distinct from new.cantidad_real then
+		raise exception 'La toma folio % está %, sólo se pueden registrar conteos en en_conteo', v_folio, v_estado
+			using errcode = 'PT409';
+	end if;
+	return new;
+end;
+$$;
+
+drop trigger if exists tomafisicadetalle_conteo on tomafisicadetalle;
+create trigger tomafisicadetalle_conteo
+	before update of cantidad_real on tomafisicadetalle
+	for each row
+	execute function validar_conteo_toma();
+
+-- Registra el conteo de una línea: en tomas de un solo conteo escribe
+-- cantidad_real y con varios contadores el conteo propio del usuario. Con
+-- p_sumar la cantidad se suma a lo ya contado (escaneos). Devuelve el conteo
+-- resultante.
+create or replace function registrar_conteo(
+	p_detalle_id bigint,
+	p_cantidad numeric,
+	p_sumar boolean,
+	p_usuario_sub text,
+	p_usuario_correo text
+) returns numeric
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_cantidad numeric;
+begin
+	-- Bloqueo compartido: los conteos no se cruzan con un cambio de estado
+	select t.* into v_toma
+	from tomafisica t
+	join tomafisicadetalle d on d.toma_id = t.id
+	where d.id = p_detalle_id
+	for share of t;
+
+	if not found then
+		raise exception 'El detalle % no existe', p_detalle_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'en_conteo' then
+		raise exception 'La toma folio % está %, sólo se pueden registrar conteos en en_conteo', v_toma.folio, v_toma.estado
+			using errcode = 'PT409';
+	end if;
+
+	if v_toma.conteos_requeridos > 1 then
+		if p_usuario_sub is null then
+			raise exception 'La toma folio % requiere identificar a cada contador', v_toma.folio
+				using errcode = 'PT422';
+		end if;
+
+		insert into tomafisica_conteos (toma_id, detalle_id, usuario_auth0_sub, usuario_correo, cantidad)
+		values (v_toma.id, p_detalle_id, p_usuario_sub, p_usuario_correo, p_cantidad)
+		on conflict (detalle_id, usuario_auth0_sub) do update
+		set cantidad = case
+				when p_sumar then tomafisica_conteos.cantidad + excluded.cantidad
+				else excluded.cantidad
+			end,
+			usuario_correo = excluded.usuario_correo,
+			updated_at = now()
+		returning cantidad into v_cantidad;
+	else
+		update tomafisicadetalle
+		set cantidad_real = case
+				when p_sumar then coalesce(cantidad_real, 0) + p_cantidad
+				else p_cantidad
+			end
+		where id = p_detalle_id
+		returning cantidad_real into v_cantidad;
+	end if;
+
+	return v_cantidad;
+end;
+$$;
+
+-- Revisa cada línea antes de pasar a revisión. Marca las que deben
+-- recontarse, desmarca las que ya están bien y, con varios contadores, fija
+-- cantidad_real al conteo en que coincidieron. Devuelve las líneas marcadas.
+create or replace function evaluar_reconteo_toma(p_toma_id bigint)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_multiple boolean;
+	v_contadores integer;
+	v_linea record;
+	v_motivo text;
+	v_reconteo jsonb := '[]'::jsonb;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id;
+	v_multiple := v_toma.conteos_requeridos > 1;
+
+	if v_multiple then
+		select count(distinct usuario_auth0_sub) into v_contadores
+		from tomafisica_conteos
+		where toma_id = p_toma_id;
+
+		if v_contadores < v_toma.conteos_requeridos then
+			raise exception 'La toma folio % requiere % conteos independientes y tiene %',
+				v_toma.folio, v_toma.conteos_requeridos, v_contadores
+				using errcode = 'PT409';
+		end if;
+	end if;
+
+	-- Con varios contadores, quien contó en la toma y no registró la línea
+	-- la contó en cero
+	for v_linea in
+		select
+			d.id,
+			d.articulo_id,
+			d.cantidad_teorica,
+			d.reconteo_solicitado_en,
+			case when v_multiple then c.minimo else d.cantidad_real end as minimo,
+			case when v_multiple then c.maximo else d.cantidad_real end as maximo,
+			coalesce(
+				case when v_multiple then c.recontado else d.contado_en >= d.reconteo_solicitado_en end,
+				false
+			) as recontado
+		from tomafisicadetalle d
+		left join lateral (
+			select
+				min(coalesce(tc.cantidad, 0)) as minimo,
+				max(coalesce(tc.cantidad, 0)) as maximo,
+				bool_and(coalesce(tc.updated_at >= d.reconteo_solicitado_en, false)) as recontado
+			from (
+				select distinct usuario_auth0_sub
+				from tomafisica_conteos
+				where toma_id = p_toma_id
+			) u
+			left join tomafisica_conteos tc
+				on tc.detalle_id = d.id
+				and tc.usuario_auth0_sub = u.usuario_auth0_sub
+		) c on true
+		where d.toma_id = p_toma_id
+		order by d.id
+	loop
+		v_motivo := null;
+		if v_linea.minimo is distinct from v_linea.maximo then
+			v_motivo := 'conteos_distintos';
+		elsif v_toma.tolerancia_pct is not null
+			and abs(coalesce(v_linea.maximo, 0) - v_linea.cantidad_teorica)
+				> v_linea.cantidad_teorica * v_toma.tolerancia_pct / 100
+			and not (v_linea.reconteo_solicitado_en is not null and v_linea.recontado) then
+			v_motivo := 'variacion';
+		end if;
+
+		if v_motivo is null then
+			update tomafisicadetalle
+			set requiere_reconteo = false,
+				motivo_reconteo = null
+			where id = v_linea.id
+				and requiere_reconteo;
+
+			if v_multiple then
+				update tomafisicadetalle
+				set cantidad_real = v_linea.maximo
+				where id = v_linea.id;
+			end if;
+		else
+			update tomafisicadetalle
+			set requiere_reconteo = true,
+				motivo_reconteo = v_motivo,
+				reconteo_solicitado_en = case
+					when v_motivo = 'conteos_distintos' then now()
+					else coalesce(reconteo_solicitado_en, now())
+				end
+			where id = v_linea.id;
+
+			v_reconteo := v_reconteo || jsonb_build_object(
+				'detalle_id', v_linea.id,
+				'articulo_id', v_linea.articulo_id,
+				'motivo_reconteo', v_motivo
+			);
+		end if;
+	end loop;
+
+	return v_reconteo;
+end;
+$$;
+
+create or replace function escanear_toma(
+	p_toma_id bigint,
+	p_codigo_barras text,
+	p_cantidad numeric,
+	p_usuario_sub text,
+	p_usuario_correo text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_articulo articulos;
+	v_detalle_id bigint;
+	v_cantidad_real numeric;
+	v_resultado text;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'en_conteo' then
+		raise exception 'La toma folio % está %, sólo se puede escanear en en_conteo', v_toma.folio, v_toma.estado
+			using errcode = 'PT409';
+	end if;
+
+	-- Si el código está repetido se prefiere el artículo que sí está en la toma
+	select a.* into v_articulo
+	from articulos a
+	left join tomafisicadetalle d on d.articulo_id = a.id and d.toma_id = p_toma_id
+	where a.codigo_barras = p_codigo_barras
+	order by d.id is null, a.id
+	limit 1;
+
+	if v_articulo.id is null then
+		v_resultado := 'desconocido';
+	else
+		select id into v_detalle_id
+		from tomafisicadetalle
+		where toma_id = p_toma_id
+			and articulo_id = v_articulo.id;
+
+		if v_detalle_id is not null then
+			v_cantidad_real := registrar_conteo(v_detalle_id, p_cantidad, true, p_usuario_sub, p_usuario_correo);
+			v_resultado := 'contado';
+		elsif v_toma.categoria_id is not null
+			and v_articulo.categoria_id is distinct from v_toma.categoria_id then
+			v_resultado := 'fuera_de_categoria';
+		else
+			-- Artículo dado de alta después de abrir la toma
+			v_resultado := 'fuera_de_toma';
+		end if;
+	end if;
+
+	insert into tomafisica_escaneos (
+		toma_id, codigo_barras, cantidad, resultado, articulo_id, detalle_id,
+		usuario_auth0_sub, usuario_correo
+	) values (
+		p_toma_id, p_codigo_barras, p_cantidad, v_resultado, v_articulo.id, v_detalle_id,
+		p_usuario_sub, p_usuario_correo
+	);
+
+	return jsonb_build_object(
+		'resultado', v_resultado,
+		'codigo_barras', p_codigo_barras,
+		'cantidad', p_cantidad,
+		'articulo_id', v_articulo.id,
+		'articulo_nombre', v_articulo.nombre,
+		'categoria_id', v_articulo.categoria_id,
+		'detalle_id', v_detalle_id,
+		'cantidad_real', v_cantidad_real
+	);
+end;
+$$;
+
+-- Cambia el estado de la toma validando la transición. El cierre se delega a
+-- cerrar_toma, que además ajusta el inventario.
+create or replace function cambiar_estado_toma(
+	p_toma_id bigint,
+	p_estado text,
+	p_usuario_sub text,
+	p_usuario_correo text,
+	p_motivo text default null
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_reconteo jsonb;
+begin
+	if p_estado = 'cerrada' then
+		return cerrar_toma(p_toma_id, p_usuario_sub, p_usuario_correo, p_motivo);
+	end if;
+
+	select * into v_toma from tomafisica where id = p_toma_id for update;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+
+	if not (v_toma.estado, p_estado) in (
+		('abierta', 'en_conteo'),
+		('en_conteo', 'en_revision'),
+		('en_revision', 'en_conteo'),
+		('abierta', 'cancelada'),
+		('en_conteo', 'cancelada'),
+		('en_revision', 'cancelada')
+	) then
+		raise exception 'La toma folio % no puede pasar de % a %', v_toma.folio, v_toma.estado, p_estado
+			using errcode = 'PT409';
+	end if;
+
+	-- No pasa a revisión mientras haya líneas por recontar; las marcas se
+	-- guardan y la toma sigue en conteo
+	if v_toma.estado = 'en_conteo' and p_estado = 'en_revision' then
+		v_reconteo := evaluar_reconteo_toma(p_toma_id);
+		if jsonb_array_length(v_reconteo) > 0 then
+			return jsonb_build_object(
+				'toma_id', p_toma_id,
+				'folio', v_toma.folio,
+				'almacen_id', v_toma.almacen_id,
+				'estado_anterior', v_toma.estado,
+				'estado', v_toma.estado,
+				'reconteo', v_reconteo
+			);
+		end if;
+	end if;
+
+	update tomafisica
+	set estado = p_estado,
+		fecha_fin = case when p_estado = 'cancelada' then now() else fecha_fin end
+	where id = p_toma_id;
+
+	insert into tomafisica_transiciones (
+		toma_id, estado_anterior, estado_nuevo, usuario_auth0_sub, usuario_correo, motivo
+	) values (
+		p_toma_id, v_toma.estado, p_estado, p_usuario_sub, p_usuario_correo, p_motivo
+	);
+
+	return jsonb_build_object(
+		'toma_id', p_toma_id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'estado_anterior', v_toma.estado,
+		'estado', p_estado
+	);
+end;
+$$;
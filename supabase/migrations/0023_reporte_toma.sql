@@ -0,0 +1,24 @@
+-- Reporte valorizado de variaciones de una toma física.
+--
+-- Una fila por línea de la toma con su categoría y la diferencia entre lo
+-- contado y lo teórico en unidades y en dinero al costo de articulos.costo.
+
+create or replace view tomafisica_variacion_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.categoria_id,
+	c.nombre as categoria_nombre,
+	d.cantidad_teorica,
+	coalesce(d.cantidad_real, 0) as cantidad_real,
+	coalesce(d.cantidad_real, 0) - d.cantidad_teorica as diferencia,
+	coalesce(a.costo, 0) as costo,
+	d.cantidad_teorica * coalesce(a.costo, 0) as valor_teorico,
+	(coalesce(d.cantidad_real, 0) - d.cantidad_teorica) * coalesce(a.costo, 0) as valor_diferencia
+from tomafisicadetalle d
+join articulos a on a.id = d.articulo_id
+left join categorias c on c.id = a.categoria_id;
@@ -0,0 +1,620 @@
+-- Congelamiento de existencias durante una toma física y manejo de corte.
+--
+-- Una toma con congelar bloquea todo movimiento de sus artículos en su
+-- almacén mientras no se cierre o cancele. Sin congelar, los movimientos
+-- posteriores al corte (fecha_inicio, cuando se tomó cantidad_teorica) y
+-- anteriores al conteo de cada línea se suman a lo teórico al calcular la
+-- variación y el ajuste del cierre.
+
+alter table tomafisica
+	add column if not exists congelar boolean not null default false;
+
+drop view if exists tomafisica_view;
+create view tomafisica_view as
+select
+	t.*,
+	c.nombre as categoria_nombre,
+	al.nombre as almacen_nombre
+from tomafisica t
+left join categorias c on c.id = t.categoria_id
+join almacenes al on al.id = t.almacen_id;
+
+-- Movimientos netos de cada línea entre el corte y su conteo. Con varios
+-- contadores el conteo es el último registrado; una línea sin conteo toma
+-- hasta el cierre (o hasta ahora). Los ajustes de la propia toma no cuentan.
+create or replace view tomafisica_corte_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	coalesce(sum(tm.signo * m.cantidad), 0) as movimientos_corte
+from tomafisicadetalle d
+join tomafisica t on t.id = d.toma_id
+left join movimientos_inventario m
+	on m.articulo_id = d.articulo_id
+	and m.almacen_id = t.almacen_id
+	and m.fecha > t.fecha_inicio
+	and m.fecha <= coalesce(
+		(select max(c.updated_at) from tomafisica_conteos c where c.detalle_id = d.id),
+		d.contado_en,
+		t.fecha_fin,
+		now()
+	)
+	and m.id is distinct from d.movimiento_id
+left join tipos_movimiento tm on tm.clave = m.tipo_movimiento
+group by d.id, d.toma_id;
+
+create or replace view tomafisica_variacion_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.categoria_id,
+	c.nombre as categoria_nombre,
+	d.cantidad_teorica,
+	coalesce(d.cantidad_real, 0) as cantidad_real,
+	coalesce(d.cantidad_real, 0) - (d.cantidad_teorica + c.movimientos_corte) as diferencia,
+	coalesce(a.costo, 0) as costo,
+	d.cantidad_teorica * coalesce(a.costo, 0) as valor_teorico,
+	(coalesce(d.cantidad_real, 0) - (d.cantidad_teorica + c.movimientos_corte)) * coalesce(a.costo, 0) as valor_diferencia,
+	c.movimientos_corte,
+	d.cantidad_teorica + c.movimientos_corte as cantidad_esperada
+from tomafisicadetalle d
+join tomafisica_corte_view c on c.detalle_id = d.id
+join articulos a on a.id = d.articulo_id
+left join categorias c on c.id = a.categoria_id;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_movimiento->>'almacen_id')::bigint, almacen_predeterminado());
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_total_anterior numeric;
+	v_total_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+	v_serializado boolean;
+	v_series jsonb := p_movimiento->'series';
+	v_serie text;
+	v_serie_id bigint;
+	v_serie_estado text;
+	v_serie_almacen bigint;
+	v_maneja_lotes boolean;
+	v_lotes jsonb;
+	v_lote jsonb;
+	v_lote_id bigint;
+	v_lote_cantidad numeric;
+	v_caducidad date;
+	v_caducidad_lote date;
+	v_lotes_aplicados jsonb := '[]'::jsonb;
+	v_pendiente numeric;
+	v_fila record;
+	v_folio_congelado bigint;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Un artículo que está en una toma congelada sin terminar no se mueve en
+	-- ese almacén; sólo pasan los ajustes con que se cierra la toma.
+	if p_movimiento->>'tipo_movimiento' is distinct from 'ajuste_toma' then
+		select t.folio into v_folio_congelado
+		from tomafisica t
+		join tomafisicadetalle d on d.toma_id = t.id
+		where t.congelar
+			and t.estado in ('abierta', 'en_conteo', 'en_revision')
+			and t.almacen_id = v_almacen_id
+			and d.articulo_id = v_articulo_id
+		limit 1;
+
+		if found then
+			raise exception 'El artículo % está congelado por la toma física folio % en curso',
+				v_articulo_id, v_folio_congelado
+				using errcode = 'PT423';
+		end if;
+	end if;
+
+	-- Si otro movimiento tiene el artículo bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	-- El artículo se bloquea antes que el inventario del almacén: el costo y
+	-- los umbrales dependen de las existencias de todos los almacenes.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select coalesce(costo, 0), stock_minimo, stock_maximo, serializado, maneja_lotes
+		into v_costo_anterior, v_stock_minimo, v_stock_maximo, v_serializado, v_maneja_lotes
+		from articulos
+		where id = v_articulo_id
+		for update;
+
+		if not found then
+			raise exception 'El artículo % no existe', v_articulo_id;
+		end if;
+
+		-- El primer movimiento de un artículo en un almacén abre su inventario
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo_id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+			and almacen_id = v_almacen_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	-- Números de serie: obligatorios cuando quien llama lo pide (recepción de
+	-- compras, ventas) y, si vienen, uno por unidad.
+	if v_serializado and jsonb_typeof(v_series) is distinct from 'array'
+		and coalesce((p_movimiento->>'requiere_series')::boolean, false) then
+		raise exception 'El artículo % es serializado, indique los números de serie', v_articulo_id
+			using errcode = 'PT422';
+	end if;
+	if jsonb_typeof(v_series) = 'array' then
+		if not v_serializado then
+			raise exception 'El artículo % no es serializado', v_articulo_id using errcode = 'PT422';
+		end if;
+		if jsonb_array_length(v_series) <> abs(v_delta) then
+			raise exception 'Se indicaron % números de serie para % unidades del artículo %',
+				jsonb_array_length(v_series), abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	else
+		v_series := null;
+	end if;
+
+	-- Lotes: se aceptan como lista (lote, caducidad, cantidad) o como un solo
+	-- lote para toda la cantidad. Una entrada sin lote va a 'SIN LOTE' salvo
+	-- que quien llama lo exija (recepción de compras); una salida sin lote se
+	-- surte por FEFO más abajo.
+	if v_maneja_lotes then
+		if jsonb_typeof(p_movimiento->'lotes') = 'array' then
+			v_lotes := p_movimiento->'lotes';
+		elsif coalesce(p_movimiento->>'lote', '') <> '' then
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', p_movimiento->>'lote',
+				'caducidad', p_movimiento->>'caducidad',
+				'cantidad', abs(v_delta)
+			));
+		elsif v_delta > 0 then
+			if coalesce((p_movimiento->>'requiere_lote')::boolean, false) then
+				raise exception 'El artículo % maneja lotes, indique lote y caducidad', v_articulo_id
+					using errcode = 'PT422';
+			end if;
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', 'SIN LOTE',
+				'caducidad', null,
+				'cantidad', abs(v_delta)
+			));
+		end if;
+
+		if v_lotes is not null and (
+			select coalesce(sum((x->>'cantidad')::numeric), 0) from jsonb_array_elements(v_lotes) x
+		) <> abs(v_delta) then
+			raise exception 'Las cantidades por lote no suman % para el artículo %', abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+		and almacen_id = v_almacen_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select sum(cantidad_actual)
+	into v_total_actual
+	from inventarios
+	where articulo_id = v_articulo_id;
+
+	v_total_anterior := v_total_actual - v_delta;
+
+	-- Una salida que deja el almacén en negativo se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo % en el almacén %: hay %, se solicitan %',
+					v_articulo_id, v_almacen_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	-- Promedio ponderado móvil sobre las existencias de todos los almacenes:
+	-- sólo las entradas que traen costo lo recalculan, de modo que una
+	-- transferencia no lo altera. Si no había existencias (o eran negativas)
+	-- el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_total_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_total_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_total_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		almacen_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		transferencia_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		(p_movimiento->>'transferencia_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	-- Cada serie entra disponible al almacén o sale de él, y queda enlazada
+	-- al movimiento para reconstruir su historia.
+	for v_serie in select jsonb_array_elements_text(v_series)
+	loop
+		select id, estado, almacen_id
+		into v_serie_id, v_serie_estado, v_serie_almacen
+		from series
+		where articulo_id = v_articulo_id
+			and numero_serie = v_serie
+		for update;
+
+		if v_delta > 0 then
+			if v_serie_estado = 'disponible' then
+				raise exception 'La serie % del artículo % ya está en existencia', v_serie, v_articulo_id
+					using errcode = 'PT409';
+			end if;
+
+			if v_serie_id is null then
+				insert into series (articulo_id, numero_serie, estado, almacen_id)
+				values (v_articulo_id, v_serie, 'disponible', v_almacen_id)
+				returning id into v_serie_id;
+			else
+				update series
+				set estado = 'disponible',
+					almacen_id = v_almacen_id
+				where id = v_serie_id;
+			end if;
+		else
+			if v_serie_id is null or v_serie_estado <> 'disponible' or v_serie_almacen <> v_almacen_id then
+				raise exception 'La serie % del artículo % no está disponible en el almacén %',
+					v_serie, v_articulo_id, v_almacen_id
+					using errcode = 'PT409';
+			end if;
+
+			update series
+			set estado = case when p_movimiento->>'tipo_movimiento' = 'venta' then 'vendida' else 'fuera' end
+			where id = v_serie_id;
+		end if;
+
+		insert into movimientos_series (movimiento_id, serie_id)
+		values (v_movimiento_id, v_serie_id);
+
+		v_serie_id := null;
+		v_serie_estado := null;
+		v_serie_almacen := null;
+	end loop;
+
+	-- Existencias por lote, enlazadas al movimiento para la trazabilidad
+	if v_maneja_lotes and v_lotes is not null then
+		for v_lote in select value from jsonb_array_elements(v_lotes)
+		loop
+			v_lote_cantidad := (v_lote->>'cantidad')::numeric;
+			v_caducidad := (v_lote->>'caducidad')::date;
+
+			if v_delta > 0 then
+				insert into lotes (articulo_id, almacen_id, lote, caducidad, cantidad)
+				values (v_articulo_id, v_almacen_id, v_lote->>'lote', v_caducidad, 0)
+				on conflict (articulo_id, almacen_id, lote) do nothing;
+
+				update lotes
+				set cantidad = cantidad + v_lote_cantidad,
+					caducidad = coalesce(caducidad, v_caducidad)
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if v_caducidad is not null and v_caducidad_lote <> v_caducidad then
+					raise exception 'El lote % del artículo % ya está registrado con caducidad %',
+						v_lote->>'lote', v_articulo_id, v_caducidad_lote
+						using errcode = 'PT409';
+				end if;
+			else
+				update lotes
+				set cantidad = cantidad - v_lote_cantidad
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+					and cantidad >= v_lote_cantidad
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if not found then
+					raise exception 'El lote % del artículo % no tiene % unidades en el almacén %',
+						v_lote->>'lote', v_articulo_id, v_lote_cantidad, v_almacen_id
+						using errcode = 'PT409';
+				end if;
+			end if;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_lote_id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_lote->>'lote',
+				'caducidad', v_caducidad_lote,
+				'cantidad', v_lote_cantidad
+			);
+		end loop;
+	elsif v_maneja_lotes and v_delta < 0 then
+		-- FEFO: primero lo que caduca antes. Si los lotes no alcanzan (sólo
+		-- posible si la política permite negativos) el resto queda sin lote.
+		v_pendiente := -v_delta;
+		for v_fila in
+			select id, lote, caducidad, cantidad
+			from lotes
+			where articulo_id = v_articulo_id
+				and almacen_id = v_almacen_id
+				and cantidad > 0
+			order by caducidad nulls last, id
+			for update
+		loop
+			v_lote_cantidad := least(v_pendiente, v_fila.cantidad);
+
+			update lotes
+			set cantidad = cantidad - v_lote_cantidad
+			where id = v_fila.id;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_fila.id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_fila.lote,
+				'caducidad', v_fila.caducidad,
+				'cantidad', v_lote_cantidad
+			);
+
+			v_pendiente := v_pendiente - v_lote_cantidad;
+			exit when v_pendiente <= 0;
+		end loop;
+	end if;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_total_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Los umbrales son por artículo y se comparan contra el total de almacenes.
+	-- Al volver sobre el mínimo las alertas pendientes se dan por atendidas.
+	if v_stock_minimo is not null and v_total_anterior >= v_stock_minimo and v_total_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_total_anterior <= v_stock_maximo and v_total_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_total_anterior,
+			v_total_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_total_anterior < v_stock_minimo and v_total_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'almacen_id', v_almacen_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta,
+		'series', coalesce(v_series, '[]'::jsonb),
+		'lotes', v_lotes_aplicados
+	);
+end;
+$$;
+
+create or replace function cerrar_toma(
+	p_toma_id bigint,
+	p_usuario_sub text,
+	p_usuario_correo text,
+	p_motivo text default null
+)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_detalle record;
+	v_signo smallint;
+	v_actual numeric;
+	v_corte numeric;
+	v_delta numeric;
+	v_movimiento jsonb;
+	v_ajustes jsonb := '[]'::jsonb;
+	v_hint text;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id for update;
+	if not found then
+		raise exception 'La toma % no existe', p_toma_id using errcode = 'PT404';
+	end if;
+	if v_toma.estado <> 'en_revision' then
+		raise exception 'La toma folio % está %, sólo se puede cerrar desde en_revision', v_toma.folio, v_toma.estado
+			using errcode = 'PT409';
+	end if;
+
+	select signo into v_signo from tipos_movimiento where clave = 'ajuste_toma';
+
+	for v_detalle in
+		select d.id, d.articulo_id, d.cantidad_teorica, d.cantidad_real, c.movimientos_corte
+		from tomafisicadetalle d
+		join tomafisica_corte_view c on c.detalle_id = d.id
+		where d.toma_id = p_toma_id
+			and d.cantidad_real is not null
+		order by d.articulo_id
+	loop
+		begin
+			-- Mismo orden de bloqueo que aplicar_movimiento (artículo y después
+			-- inventario) para que la existencia no cambie antes del ajuste
+			perform 1 from articulos where id = v_detalle.articulo_id for update;
+
+			select coalesce(sum(cantidad_actual), 0) into v_actual
+			from inventarios
+			where articulo_id = v_detalle.articulo_id
+				and almacen_id = v_toma.almacen_id;
+
+			-- El ajuste es la variación contra lo esperado al momento de
+			-- contar (teórico más los movimientos posteriores al corte); lo que
+			-- se movió después del conteo se conserva. En una toma congelada no
+			-- hay tales movimientos y la existencia queda igual a lo contado.
+			v_corte := v_detalle.movimientos_corte;
+			v_delta := v_detalle.cantidad_real - (v_detalle.cantidad_teorica + v_corte);
+			continue when v_delta = 0;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_detalle.articulo_id,
+				'almacen_id', v_toma.almacen_id,
+				'tipo_movimiento', 'ajuste_toma',
+				'cantidad', v_delta * v_signo,
+				'delta', v_delta,
+				'motivo', 'Ajuste por toma física folio ' || v_toma.folio,
+				'usuario_nombre', p_usuario_correo
+			));
+
+			update tomafisicadetalle
+			set movimiento_id = (v_movimiento->>'movimiento_id')::bigint
+			where id = v_detalle.id;
+
+			v_ajustes := v_ajustes || jsonb_build_object(
+				'detalle_id', v_detalle.id,
+				'articulo_id', v_detalle.articulo_id,
+				'cantidad_teorica', v_detalle.cantidad_teorica,
+				'cantidad_anterior', v_actual,
+				'movimientos_corte', v_corte,
+				'cantidad_real', v_detalle.cantidad_real,
+				'ajuste', v_delta,
+				'costo_promedio', v_movimiento->'costo_promedio',
+				'movimiento_id', v_movimiento->'movimiento_id'
+			);
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar el artículo %: %', v_detalle.articulo_id, sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	update tomafisica
+	set estado = 'cerrada',
+		fecha_fin = now()
+	where id = p_toma_id;
+
+	insert into tomafisica_transiciones (
+		toma_id, estado_anterior, estado_nuevo, usuario_auth0_sub, usuario_correo, motivo
+	) values (
+		p_toma_id, v_toma.estado, 'cerrada', p_usuario_sub, p_usuario_correo, p_motivo
+	);
+
+	return jsonb_build_object(
+		'toma_id', p_toma_id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'estado_anterior', v_toma.estado,
+		'estado', 'cerrada',
+		'ajustes', v_ajustes
+	);
+end;
+$$;
@@ -0,0 +1,24 @@
+-- Hojas de conteo impresas para tomas físicas.
+--
+-- articulos.ubicacion (pasillo, anaquel, nivel) ordena las hojas para que
+-- quien cuenta recorra el almacén en orden. La vista da las líneas de la toma
+-- con lo necesario para imprimirlas.
+
+alter table articulos
+	add column if not exists ubicacion text;
+
+create or replace view tomafisica_hoja_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.ubicacion,
+	a.categoria_id,
+	c.nombre as categoria_nombre,
+	d.cantidad_teorica
+from tomafisicadetalle d
+join articulos a on a.id = d.articulo_id
+left join categorias c on c.id = a.categoria_id;
@@ -0,0 +1,288 @@
+-- Conciliación de ventas y compras dentro de la base.
+--
+-- Editar o eliminar un documento bloquea su cabecera y compara sus líneas
+-- anteriores contra las nuevas en la misma transacción. Así dos ediciones o
+-- eliminaciones simultáneas del mismo documento no compensan ambas contra las
+-- mismas líneas. La API ya no arma los movimientos compensatorios.
+
+drop function if exists editar_venta(bigint, jsonb, jsonb, jsonb);
+drop function if exists eliminar_venta(bigint, jsonb);
+drop function if exists editar_compra(bigint, jsonb, jsonb, jsonb);
+drop function if exists eliminar_compra(bigint, jsonb);
+
+-- Aplica los movimientos que llevan el inventario de las líneas anteriores a
+-- las nuevas (arreglos de {articulo_id, cantidad}), por artículo y en orden de
+-- articulo_id para que dos documentos bloqueen en el mismo orden. Los aumentos
+-- se registran con p_tipo y las disminuciones con p_tipo_inverso; p_base trae
+-- lo común a todos (motivo, usuario, documento). Las entradas de p_tipo toman
+-- el costo_unitario de las líneas nuevas, si lo traen.
+create or replace function conciliar_documento(
+	p_anteriores jsonb,
+	p_nuevas jsonb,
+	p_tipo text,
+	p_tipo_inverso text,
+	p_base jsonb
+) returns void
+language plpgsql
+as $$
+declare
+	v_fila record;
+	v_tipo text;
+	v_signo smallint;
+	v_hint text;
+begin
+	for v_fila in
+		select
+			x.articulo_id,
+			sum(case when x.nueva then x.cantidad else -x.cantidad end) as diferencia,
+			max(x.costo_unitario) filter (where x.nueva) as costo_unitario
+		from (
+			select
+				(value->>'articulo_id')::bigint as articulo_id,
+				(value->>'cantidad')::numeric as cantidad,
+				(value->>'costo_unitario')::numeric as costo_unitario,
+				false as nueva
+			from jsonb_array_elements(coalesce(p_anteriores, '[]'::jsonb))
+			union all
+			select
+				(value->>'articulo_id')::bigint,
+				(value->>'cantidad')::numeric,
+				(value->>'costo_unitario')::numeric,
+				true
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb))
+		) x
+		group by x.articulo_id
+		having sum(case when x.nueva then x.cantidad else -x.cantidad end) <> 0
+		order by x.articulo_id
+	loop
+		v_tipo := case when v_fila.diferencia > 0 then p_tipo else p_tipo_inverso end;
+
+		select signo into v_signo from tipos_movimiento where clave = v_tipo;
+		if not found then
+			raise exception 'Tipo de movimiento % no registrado', v_tipo;
+		end if;
+
+		begin
+			perform aplicar_movimiento(p_base || jsonb_build_object(
+				'articulo_id', v_fila.articulo_id,
+				'tipo_movimiento', v_tipo,
+				'cantidad', abs(v_fila.diferencia),
+				'delta', v_signo * abs(v_fila.diferencia),
+				'costo_unitario', case when v_tipo = p_tipo then v_fila.costo_unitario end
+			));
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar inventario del articulo_id %: %', v_fila.articulo_id, sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_nuevas
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function eliminar_venta(
+	p_venta_id bigint,
+	p_usuario_nombre text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_anteriores jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	perform conciliar_documento(v_anteriores, '[]'::jsonb, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Eliminación de venta #' || p_venta_id,
+		'usuario_nombre', p_usuario_nombre,
+		'venta_id', p_venta_id
+	));
+
+	delete from ventas where id = p_venta_id;
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+-- Editar o eliminar un borrador no toca inventario: nunca lo afectó.
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_estado text;
+	v_anteriores jsonb;
+	v_nuevas jsonb;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from compras_detalles
+	where compra_id = p_compra_id;
+
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	-- Las unidades adicionales entran al costo de la línea editada
+	if v_estado <> 'borrador' then
+		select coalesce(jsonb_agg(jsonb_build_object(
+			'articulo_id', articulo_id,
+			'cantidad', cantidad,
+			'costo_unitario', precio_unitario
+		)), '[]'::jsonb)
+		into v_nuevas
+		from compras_detalles
+		where compra_id = p_compra_id;
+
+		perform conciliar_documento(v_anteriores, v_nuevas, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Edición de compra #' || p_compra_id,
+			'usuario_nombre', p_compra->>'usuario_nombre',
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+create or replace function eliminar_compra(
+	p_compra_id bigint,
+	p_usuario_nombre text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_estado text;
+	v_anteriores jsonb;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	if v_estado <> 'borrador' then
+		select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+		into v_anteriores
+		from compras_detalles
+		where compra_id = p_compra_id;
+
+		perform conciliar_documento(v_anteriores, '[]'::jsonb, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Eliminación de compra #' || p_compra_id,
+			'usuario_nombre', p_usuario_nombre,
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	delete from compras where id = p_compra_id;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
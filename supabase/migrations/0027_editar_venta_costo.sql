@@ -0,0 +1,94 @@
+-- Editar una venta conserva el costo con que se vendió cada artículo.
+--
+-- editar_venta reemplaza las líneas y antes les ponía el costo promedio del
+-- momento de la edición, con lo que el margen de una venta vieja cambiaba al
+-- corregirle el cliente o una cantidad. Ahora los artículos que ya estaban en
+-- la venta conservan su costo (ponderado si venían en varias líneas) y sólo
+-- los agregados en la edición toman el costo actual.
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb;
+	v_costos jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	-- Costo ponderado de lo ya vendido por artículo; nulo si ninguna de sus
+	-- líneas lo tenía guardado
+	select coalesce(jsonb_object_agg(articulo_id, costo), '{}'::jsonb)
+	into v_costos
+	from (
+		select
+			articulo_id,
+			sum(costo_unitario * cantidad) filter (where costo_unitario is not null)
+				/ nullif(sum(cantidad) filter (where costo_unitario is not null), 0) as costo
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				case when v_costos ? a.id::text then (v_costos->>a.id::text)::numeric else a.costo end
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_nuevas
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
@@ -0,0 +1,26 @@
+-- El signo de un tipo de movimiento no cambia una vez usado.
+--
+-- Kardex, existencias a una fecha y conciliaciones leen el signo del registro
+-- para interpretar movimientos ya guardados; cambiarlo reescribiría en silencio
+-- todo el historial de ese tipo. Etiqueta, motivo y permiso sí pueden cambiar.
+
+create or replace function validar_signo_tipo_movimiento()
+returns trigger
+language plpgsql
+as $$
+begin
+	if new.signo <> old.signo
+		and exists (select 1 from movimientos_inventario where tipo_movimiento = old.clave)
+	then
+		raise exception 'El tipo de movimiento % ya tiene movimientos, su signo no puede cambiar', old.clave
+			using errcode = 'PT409';
+	end if;
+	return new;
+end;
+$$;
+
+drop trigger if exists tipos_movimiento_signo on tipos_movimiento;
+create trigger tipos_movimiento_signo
+	before update of signo on tipos_movimiento
+	for each row
+	execute function validar_signo_tipo_movimiento();
@@ -0,0 +1,30 @@
+-- aplicar_movimientos conserva el código y el hint de los errores.
+--
+-- Al envolver el error de cada movimiento con el articulo_id se perdía el
+-- sqlstate, así que un stock insuficiente (422), un conflicto de versión
+-- (409 con hint 'reintentar') o un artículo congelado por toma (423) llegaban
+-- a la API como 400. Confirmar una compra lo usa todavía.
+
+create or replace function aplicar_movimientos(p_movimientos jsonb)
+returns void
+language plpgsql
+as $$
+declare
+	v_mov jsonb;
+	v_hint text;
+begin
+	for v_mov in
+		select value from jsonb_array_elements(coalesce(p_movimientos, '[]'::jsonb))
+	loop
+		begin
+			perform aplicar_movimiento(v_mov);
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar inventario del articulo_id %: %',
+				v_mov->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+end;
+$$;
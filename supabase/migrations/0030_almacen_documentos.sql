@@ -0,0 +1,640 @@
+-- Almacén en las líneas de ventas y compras.
+--
+-- Cada línea indica el almacén del que sale o al que entra la mercancía; sin
+-- almacén se usa el predeterminado como hasta ahora, o el de la reserva que
+-- consume. Las líneas existentes toman el almacén del movimiento con que se
+-- registraron. Editar o eliminar un documento compensa en el almacén de cada
+-- línea, y una línea editada sin almacén conserva el que tenía el artículo.
+
+alter table ventas_detalle
+	add column if not exists almacen_id bigint references almacenes (id);
+
+update ventas_detalle d
+set almacen_id = coalesce((
+	select m.almacen_id
+	from movimientos_inventario m
+	where m.venta_id = d.venta_id
+		and m.articulo_id = d.articulo_id
+		and m.tipo_movimiento = 'venta'
+	order by m.id
+	limit 1
+), almacen_predeterminado())
+where d.almacen_id is null;
+
+alter table ventas_detalle
+	alter column almacen_id set default almacen_predeterminado(),
+	alter column almacen_id set not null;
+
+alter table compras_detalles
+	add column if not exists almacen_id bigint references almacenes (id);
+
+update compras_detalles d
+set almacen_id = coalesce((
+	select m.almacen_id
+	from movimientos_inventario m
+	where m.compra_id = d.compra_id
+		and m.articulo_id = d.articulo_id
+		and m.tipo_movimiento = 'compra'
+	order by m.id
+	limit 1
+), almacen_predeterminado())
+where d.almacen_id is null;
+
+alter table compras_detalles
+	alter column almacen_id set default almacen_predeterminado(),
+	alter column almacen_id set not null;
+
+-- Compara por artículo y almacén; las líneas sin almacén cuentan en el
+-- predeterminado.
+create or replace function conciliar_documento(
+	p_anteriores jsonb,
+	p_nuevas jsonb,
+	p_tipo text,
+	p_tipo_inverso text,
+	p_base jsonb
+) returns void
+language plpgsql
+as $$
+declare
+	v_fila record;
+	v_tipo text;
+	v_signo smallint;
+	v_hint text;
+begin
+	for v_fila in
+		select
+			x.articulo_id,
+			x.almacen_id,
+			sum(case when x.nueva then x.cantidad else -x.cantidad end) as diferencia,
+			max(x.costo_unitario) filter (where x.nueva) as costo_unitario
+		from (
+			select
+				(value->>'articulo_id')::bigint as articulo_id,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()) as almacen_id,
+				(value->>'cantidad')::numeric as cantidad,
+				(value->>'costo_unitario')::numeric as costo_unitario,
+				false as nueva
+			from jsonb_array_elements(coalesce(p_anteriores, '[]'::jsonb))
+			union all
+			select
+				(value->>'articulo_id')::bigint,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()),
+				(value->>'cantidad')::numeric,
+				(value->>'costo_unitario')::numeric,
+				true
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb))
+		) x
+		group by x.articulo_id, x.almacen_id
+		having sum(case when x.nueva then x.cantidad else -x.cantidad end) <> 0
+		order by x.articulo_id, x.almacen_id
+	loop
+		v_tipo := case when v_fila.diferencia > 0 then p_tipo else p_tipo_inverso end;
+
+		select signo into v_signo from tipos_movimiento where clave = v_tipo;
+		if not found then
+			raise exception 'Tipo de movimiento % no registrado', v_tipo;
+		end if;
+
+		begin
+			perform aplicar_movimiento(p_base || jsonb_build_object(
+				'articulo_id', v_fila.articulo_id,
+				'almacen_id', v_fila.almacen_id,
+				'tipo_movimiento', v_tipo,
+				'cantidad', abs(v_fila.diferencia),
+				'delta', v_signo * abs(v_fila.diferencia),
+				'costo_unitario', case when v_tipo = p_tipo then v_fila.costo_unitario end
+			));
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error al ajustar inventario del articulo_id %: %', v_fila.articulo_id, sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+end;
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+	v_detalle_id bigint;
+	v_almacen_id bigint;
+	v_reservado numeric;
+	v_cantidad_almacen numeric;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			-- La reserva indicada se consume y la mercancía sale del almacén
+			-- donde estaba apartada; si la línea indica almacén debe ser ése
+			v_almacen_id := (v_item->>'almacen_id')::bigint;
+			if v_item->>'reserva_id' is not null then
+				update reservas
+				set estado = 'consumida',
+					venta_id = v_venta_id
+				where id = (v_item->>'reserva_id')::bigint
+					and articulo_id = (v_item->>'articulo_id')::bigint
+					and (v_almacen_id is null or almacen_id = v_almacen_id)
+					and estado = 'activa'
+					and expira_en > now()
+				returning almacen_id into v_almacen_id;
+
+				if not found then
+					raise exception 'La reserva % no está vigente o no corresponde al artículo y almacén', v_item->>'reserva_id'
+						using errcode = 'PT409';
+				end if;
+			end if;
+			v_almacen_id := coalesce(v_almacen_id, almacen_predeterminado());
+
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				v_almacen_id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning id into v_detalle_id;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_id,
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id,
+				'series', v_item->'series',
+				'requiere_series', true,
+				'lote', v_item->>'lote'
+			));
+
+			-- La línea guarda qué lotes y series se entregaron
+			update ventas_detalle
+			set lotes = nullif(v_movimiento->'lotes', '[]'::jsonb),
+				series = nullif(v_movimiento->'series', '[]'::jsonb)
+			where id = v_detalle_id;
+
+			-- Donde la política rechaza negativos tampoco se vende lo apartado
+			-- para otros clientes
+			if politica_stock_negativo((v_item->>'articulo_id')::bigint, 'venta') = 'rechazar' then
+				v_reservado := cantidad_reservada(
+					(v_item->>'articulo_id')::bigint,
+					(v_movimiento->>'almacen_id')::bigint
+				);
+				if v_reservado > 0 then
+					select cantidad_actual into v_cantidad_almacen
+					from inventarios
+					where articulo_id = (v_item->>'articulo_id')::bigint
+						and almacen_id = (v_movimiento->>'almacen_id')::bigint;
+
+					if v_cantidad_almacen < v_reservado then
+						raise exception 'Stock insuficiente: % unidades del artículo % están apartadas',
+							v_reservado, v_item->>'articulo_id'
+							using errcode = 'PT422';
+					end if;
+				end if;
+			end if;
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb;
+	v_costos jsonb;
+	v_almacenes jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	-- Costo ponderado de lo ya vendido por artículo; nulo si ninguna de sus
+	-- líneas lo tenía guardado
+	select coalesce(jsonb_object_agg(articulo_id, costo), '{}'::jsonb)
+	into v_costos
+	from (
+		select
+			articulo_id,
+			sum(costo_unitario * cantidad) filter (where costo_unitario is not null)
+				/ nullif(sum(cantidad) filter (where costo_unitario is not null), 0) as costo
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	-- Sin almacén en la línea, el artículo sigue saliendo de donde salió
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>a.id::text)::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				case when v_costos ? a.id::text then (v_costos->>a.id::text)::numeric else a.costo end
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_nuevas
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function eliminar_venta(
+	p_venta_id bigint,
+	p_usuario_nombre text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_anteriores jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	perform conciliar_documento(v_anteriores, '[]'::jsonb, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Eliminación de venta #' || p_venta_id,
+		'usuario_nombre', p_usuario_nombre,
+		'venta_id', p_venta_id
+	));
+
+	delete from ventas where id = p_venta_id;
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function registrar_compra(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_hint text;
+	v_almacen_id bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas)
+	values (p_compra->>'notas')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, almacen_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				coalesce((v_item->>'almacen_id')::bigint, almacen_predeterminado()),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			)
+			returning almacen_id into v_almacen_id;
+
+			perform aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_id,
+				'tipo_movimiento', 'compra',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'costo_unitario', v_item->'precio_unitario',
+				'motivo', 'Compra #' || v_compra_id,
+				'usuario_nombre', p_compra->>'usuario_nombre',
+				'compra_id', v_compra_id,
+				'series', v_item->'series',
+				'requiere_series', true,
+				'lote', v_item->>'lote',
+				'caducidad', v_item->>'caducidad',
+				'requiere_lote', true
+			));
+		exception when others then
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
+
+create or replace function crear_compra_borrador(
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_compra_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into compras (notas, proveedor, estado)
+	values (p_compra->>'notas', p_compra->>'proveedor', 'borrador')
+	returning id into v_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, almacen_id, cantidad, precio_unitario)
+			values (
+				v_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				coalesce((v_item->>'almacen_id')::bigint, almacen_predeterminado()),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object('compra_id', v_compra_id);
+end;
+$$;
+
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_estado text;
+	v_anteriores jsonb;
+	v_nuevas jsonb;
+	v_almacenes jsonb;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from compras_detalles
+	where compra_id = p_compra_id;
+
+	-- Sin almacén en la línea, el artículo sigue entrando donde entró
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from compras_detalles
+		where compra_id = p_compra_id
+		group by articulo_id
+	) x;
+
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, almacen_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>(v_item->>'articulo_id'))::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	-- Las unidades adicionales entran al costo de la línea editada
+	if v_estado <> 'borrador' then
+		select coalesce(jsonb_agg(jsonb_build_object(
+			'articulo_id', articulo_id,
+			'almacen_id', almacen_id,
+			'cantidad', cantidad,
+			'costo_unitario', precio_unitario
+		)), '[]'::jsonb)
+		into v_nuevas
+		from compras_detalles
+		where compra_id = p_compra_id;
+
+		perform conciliar_documento(v_anteriores, v_nuevas, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Edición de compra #' || p_compra_id,
+			'usuario_nombre', p_compra->>'usuario_nombre',
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+create or replace function eliminar_compra(
+	p_compra_id bigint,
+	p_usuario_nombre text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_estado text;
+	v_anteriores jsonb;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	if v_estado <> 'borrador' then
+		select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+		into v_anteriores
+		from compras_detalles
+		where compra_id = p_compra_id;
+
+		perform conciliar_documento(v_anteriores, '[]'::jsonb, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Eliminación de compra #' || p_compra_id,
+			'usuario_nombre', p_usuario_nombre,
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	delete from compras where id = p_compra_id;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
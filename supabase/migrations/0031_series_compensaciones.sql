@@ -0,0 +1,373 @@
+-- Series en las compensaciones de ventas y compras.
+--
+-- Editar o eliminar un documento movía las unidades compensadas sin número de
+-- serie, así que una serie vendida seguía marcada como vendida después de
+-- cancelar la venta y las unidades nuevas salían sin identificar. Ahora las
+-- líneas editadas de artículos serializados traen sus series (todas, no sólo
+-- las agregadas) y la compensación devuelve o mueve exactamente esas.
+
+-- Series que un documento dejó movidas en su sentido (vendidas por la venta,
+-- recibidas por la compra) para un artículo en un almacén, descontando las
+-- que sus ediciones ya devolvieron.
+create or replace function series_documento(
+	p_venta_id bigint,
+	p_compra_id bigint,
+	p_articulo_id bigint,
+	p_almacen_id bigint
+) returns text[]
+language sql
+stable
+as $$
+	select coalesce(array_agg(x.numero_serie order by x.numero_serie), '{}')
+	from (
+		select s.numero_serie
+		from movimientos_series ms
+		join movimientos_inventario m on m.id = ms.movimiento_id
+		join tipos_movimiento t on t.clave = m.tipo_movimiento
+		join series s on s.id = ms.serie_id
+		where (m.venta_id = p_venta_id or m.compra_id = p_compra_id)
+			and m.articulo_id = p_articulo_id
+			and m.almacen_id = p_almacen_id
+		group by s.numero_serie
+		having sum(case when m.venta_id = p_venta_id then -t.signo else t.signo end) > 0
+	) x;
+$$;
+
+-- Aplica los movimientos que llevan el inventario de las líneas anteriores a
+-- las nuevas, por artículo y almacén y en orden de articulo_id para que dos
+-- documentos bloqueen en el mismo orden. Los aumentos se registran con p_tipo
+-- y las disminuciones con p_tipo_inverso; p_base trae lo común a todos
+-- (motivo, usuario, documento).
+--
+-- En artículos serializados se comparan las series que el documento movió
+-- con las de las líneas nuevas: las que ya no están se regresan con su
+-- número y las agregadas salen (o entran) con el suyo, aunque la cantidad no
+-- cambie. Las unidades sin serie sólo se aceptan para devolver lo registrado
+-- antes de que hubiera series; para mover más unidades hay que indicarlas.
+create or replace function conciliar_documento(
+	p_anteriores jsonb,
+	p_nuevas jsonb,
+	p_tipo text,
+	p_tipo_inverso text,
+	p_base jsonb
+) returns void
+language plpgsql
+as $$
+declare
+	v_fila record;
+	v_signo smallint;
+	v_signo_inverso smallint;
+	v_serializado boolean;
+	v_previas text[];
+	v_series text[];
+	v_quitadas text[];
+	v_agregadas text[];
+	v_residuo numeric;
+	v_cantidad numeric;
+	v_movimientos jsonb;
+	v_mov jsonb;
+	v_hint text;
+begin
+	select signo into v_signo from tipos_movimiento where clave = p_tipo;
+	select signo into v_signo_inverso from tipos_movimiento where clave = p_tipo_inverso;
+	if v_signo is null or v_signo_inverso is null then
+		raise exception 'Tipos de movimiento % y % deben estar registrados', p_tipo, p_tipo_inverso;
+	end if;
+
+	for v_fila in
+		select
+			x.articulo_id,
+			x.almacen_id,
+			sum(case when x.nueva then x.cantidad else -x.cantidad end) as diferencia,
+			max(x.costo_unitario) filter (where x.nueva) as costo_unitario
+		from (
+			select
+				(value->>'articulo_id')::bigint as articulo_id,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()) as almacen_id,
+				(value->>'cantidad')::numeric as cantidad,
+				(value->>'costo_unitario')::numeric as costo_unitario,
+				false as nueva
+			from jsonb_array_elements(coalesce(p_anteriores, '[]'::jsonb))
+			union all
+			select
+				(value->>'articulo_id')::bigint,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()),
+				(value->>'cantidad')::numeric,
+				(value->>'costo_unitario')::numeric,
+				true
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb))
+		) x
+		group by x.articulo_id, x.almacen_id
+		order by x.articulo_id, x.almacen_id
+	loop
+		select serializado into v_serializado from articulos where id = v_fila.articulo_id;
+
+		v_quitadas := '{}';
+		v_agregadas := '{}';
+		if v_serializado then
+			v_previas := series_documento(
+				(p_base->>'venta_id')::bigint,
+				(p_base->>'compra_id')::bigint,
+				v_fila.articulo_id,
+				v_fila.almacen_id
+			);
+
+			select coalesce(array_agg(distinct s.serie), '{}')
+			into v_series
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb)) l
+			cross join lateral jsonb_array_elements_text(
+				case when jsonb_typeof(l->'series') = 'array' then l->'series' else '[]'::jsonb end
+			) s(serie)
+			where (l->>'articulo_id')::bigint = v_fila.articulo_id
+				and coalesce((l->>'almacen_id')::bigint, almacen_predeterminado()) = v_fila.almacen_id;
+
+			v_quitadas := array(select unnest(v_previas) except select unnest(v_series) order by 1);
+			v_agregadas := array(select unnest(v_series) except select unnest(v_previas) order by 1);
+		end if;
+
+		-- Unidades que cambian sin una serie que las identifique
+		v_residuo := v_fila.diferencia - cardinality(v_agregadas) + cardinality(v_quitadas);
+		if v_residuo > 0 and v_serializado then
+			raise exception 'El artículo % es serializado, indique los números de serie de todas sus unidades',
+				v_fila.articulo_id
+				using errcode = 'PT422';
+		end if;
+
+		v_movimientos := '[]'::jsonb;
+		if cardinality(v_quitadas) > 0 then
+			v_movimientos := v_movimientos || jsonb_build_object(
+				'tipo_movimiento', p_tipo_inverso,
+				'cantidad', cardinality(v_quitadas),
+				'delta', v_signo_inverso * cardinality(v_quitadas),
+				'series', to_jsonb(v_quitadas)
+			);
+		end if;
+		if v_residuo < 0 then
+			v_movimientos := v_movimientos || jsonb_build_object(
+				'tipo_movimiento', p_tipo_inverso,
+				'cantidad', -v_residuo,
+				'delta', v_signo_inverso * -v_residuo
+			);
+		end if;
+		v_cantidad := cardinality(v_agregadas) + greatest(v_residuo, 0);
+		if v_cantidad > 0 then
+			v_movimientos := v_movimientos || jsonb_build_object(
+				'tipo_movimiento', p_tipo,
+				'cantidad', v_cantidad,
+				'delta', v_signo * v_cantidad,
+				'costo_unitario', v_fila.costo_unitario,
+				'series', case when cardinality(v_agregadas) > 0 then to_jsonb(v_agregadas) end,
+				'requiere_series', true
+			);
+		end if;
+
+		for v_mov in select value from jsonb_array_elements(v_movimientos)
+		loop
+			begin
+				perform aplicar_movimiento(p_base || jsonb_build_object(
+					'articulo_id', v_fila.articulo_id,
+					'almacen_id', v_fila.almacen_id
+				) || v_mov);
+			exception when others then
+				get stacked diagnostics v_hint = pg_exception_hint;
+				raise exception 'Error al ajustar inventario del articulo_id %: %', v_fila.articulo_id, sqlerrm
+					using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+						hint = coalesce(v_hint, '');
+			end;
+		end loop;
+	end loop;
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb := '[]'::jsonb;
+	v_costos jsonb;
+	v_almacenes jsonb;
+	v_almacen_linea bigint;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	-- Costo ponderado de lo ya vendido por artículo; nulo si ninguna de sus
+	-- líneas lo tenía guardado
+	select coalesce(jsonb_object_agg(articulo_id, costo), '{}'::jsonb)
+	into v_costos
+	from (
+		select
+			articulo_id,
+			sum(costo_unitario * cantidad) filter (where costo_unitario is not null)
+				/ nullif(sum(cantidad) filter (where costo_unitario is not null), 0) as costo
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	-- Sin almacén en la línea, el artículo sigue saliendo de donde salió
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>a.id::text)::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				case when v_costos ? a.id::text then (v_costos->>a.id::text)::numeric else a.costo end
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning almacen_id into v_almacen_linea;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_nuevas := v_nuevas || jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_linea,
+				'cantidad', v_item->'cantidad',
+				'series', v_item->'series'
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_estado text;
+	v_anteriores jsonb;
+	v_nuevas jsonb := '[]'::jsonb;
+	v_almacenes jsonb;
+	v_almacen_linea bigint;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from compras_detalles
+	where compra_id = p_compra_id;
+
+	-- Sin almacén en la línea, el artículo sigue entrando donde entró
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from compras_detalles
+		where compra_id = p_compra_id
+		group by articulo_id
+	) x;
+
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, almacen_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>(v_item->>'articulo_id'))::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			)
+			returning almacen_id into v_almacen_linea;
+
+			v_nuevas := v_nuevas || jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_linea,
+				'cantidad', v_item->'cantidad',
+				'costo_unitario', v_item->'precio_unitario',
+				'series', v_item->'series'
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	-- Las unidades adicionales entran al costo de la línea editada
+	if v_estado <> 'borrador' then
+		perform conciliar_documento(v_anteriores, v_nuevas, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Edición de compra #' || p_compra_id,
+			'usuario_nombre', p_compra->>'usuario_nombre',
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
@@ -0,0 +1,936 @@
+-- Lotes en las compensaciones y FEFO sin lotes caducados.
+--
+-- Cancelar parte de una venta regresaba las unidades a 'SIN LOTE' y cancelar
+-- parte de una compra sacaba las del lote que caducaba antes, no las
+-- recibidas, con lo que la trazabilidad por lote dejaba de cuadrar. Ahora la
+-- compensación usa los lotes netos que el documento movió. Además FEFO ya no
+-- surte lotes caducados: si sólo quedan ésos, la salida se rechaza.
+
+-- Lotes que un documento dejó movidos en su sentido para un artículo en un
+-- almacén, netos de lo que sus ediciones ya regresaron.
+create or replace function lotes_documento(
+	p_venta_id bigint,
+	p_compra_id bigint,
+	p_articulo_id bigint,
+	p_almacen_id bigint
+) returns jsonb
+language sql
+stable
+as $$
+	select coalesce(jsonb_agg(jsonb_build_object(
+		'lote', x.lote,
+		'caducidad', x.caducidad,
+		'cantidad', x.cantidad
+	) order by x.id), '[]'::jsonb)
+	from (
+		select
+			l.id,
+			l.lote,
+			l.caducidad,
+			sum(ml.cantidad * case when m.venta_id = p_venta_id then -t.signo else t.signo end) as cantidad
+		from movimientos_lotes ml
+		join movimientos_inventario m on m.id = ml.movimiento_id
+		join tipos_movimiento t on t.clave = m.tipo_movimiento
+		join lotes l on l.id = ml.lote_id
+		where (m.venta_id = p_venta_id or m.compra_id = p_compra_id)
+			and m.articulo_id = p_articulo_id
+			and m.almacen_id = p_almacen_id
+		group by l.id, l.lote, l.caducidad
+		having sum(ml.cantidad * case when m.venta_id = p_venta_id then -t.signo else t.signo end) > 0
+	) x;
+$$;
+
+-- Toma p_cantidad unidades de una lista de lotes ({lote, caducidad, cantidad})
+-- en su orden. Devuelve los lotes tomados y lo que queda de la lista.
+create or replace function tomar_lotes(p_lotes jsonb, p_cantidad numeric)
+returns jsonb
+language plpgsql
+immutable
+as $$
+declare
+	v_lote jsonb;
+	v_tomados jsonb := '[]'::jsonb;
+	v_resto jsonb := '[]'::jsonb;
+	v_pendiente numeric := p_cantidad;
+	v_cantidad numeric;
+begin
+	for v_lote in select value from jsonb_array_elements(coalesce(p_lotes, '[]'::jsonb))
+	loop
+		v_cantidad := least(v_pendiente, (v_lote->>'cantidad')::numeric);
+		if v_cantidad > 0 then
+			v_tomados := v_tomados || jsonb_set(v_lote, '{cantidad}', to_jsonb(v_cantidad));
+			v_pendiente := v_pendiente - v_cantidad;
+		end if;
+		if (v_lote->>'cantidad')::numeric > v_cantidad then
+			v_resto := v_resto || jsonb_set(v_lote, '{cantidad}', to_jsonb((v_lote->>'cantidad')::numeric - v_cantidad));
+		end if;
+	end loop;
+
+	return jsonb_build_object('lotes', v_tomados, 'resto', v_resto);
+end;
+$$;
+
+-- Aplica los movimientos que llevan el inventario de las líneas anteriores a
+-- las nuevas, por artículo y almacén y en orden de articulo_id para que dos
+-- documentos bloqueen en el mismo orden. Los aumentos se registran con p_tipo
+-- y las disminuciones con p_tipo_inverso; p_base trae lo común a todos
+-- (motivo, usuario, documento).
+--
+-- En artículos serializados se comparan las series que el documento movió
+-- con las de las líneas nuevas: las que ya no están se regresan con su
+-- número y las agregadas salen (o entran) con el suyo, aunque la cantidad no
+-- cambie. Las unidades sin serie sólo se aceptan para devolver lo registrado
+-- antes de que hubiera series; para mover más unidades hay que indicarlas.
+-- En artículos con lotes lo que se regresa vuelve a (o sale de) los lotes que
+-- el documento movió, y lo agregado usa el lote de la línea.
+create or replace function conciliar_documento(
+	p_anteriores jsonb,
+	p_nuevas jsonb,
+	p_tipo text,
+	p_tipo_inverso text,
+	p_base jsonb
+) returns void
+language plpgsql
+as $$
+declare
+	v_fila record;
+	v_signo smallint;
+	v_signo_inverso smallint;
+	v_serializado boolean;
+	v_maneja_lotes boolean;
+	v_lotes_documento jsonb;
+	v_toma jsonb;
+	v_tomado numeric;
+	v_pieza int;
+	v_series_pieza text[];
+	v_lote text;
+	v_caducidad text;
+	v_previas text[];
+	v_series text[];
+	v_quitadas text[];
+	v_agregadas text[];
+	v_residuo numeric;
+	v_cantidad numeric;
+	v_movimientos jsonb;
+	v_mov jsonb;
+	v_hint text;
+begin
+	select signo into v_signo from tipos_movimiento where clave = p_tipo;
+	select signo into v_signo_inverso from tipos_movimiento where clave = p_tipo_inverso;
+	if v_signo is null or v_signo_inverso is null then
+		raise exception 'Tipos de movimiento % y % deben estar registrados', p_tipo, p_tipo_inverso;
+	end if;
+
+	for v_fila in
+		select
+			x.articulo_id,
+			x.almacen_id,
+			sum(case when x.nueva then x.cantidad else -x.cantidad end) as diferencia,
+			max(x.costo_unitario) filter (where x.nueva) as costo_unitario
+		from (
+			select
+				(value->>'articulo_id')::bigint as articulo_id,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()) as almacen_id,
+				(value->>'cantidad')::numeric as cantidad,
+				(value->>'costo_unitario')::numeric as costo_unitario,
+				false as nueva
+			from jsonb_array_elements(coalesce(p_anteriores, '[]'::jsonb))
+			union all
+			select
+				(value->>'articulo_id')::bigint,
+				coalesce((value->>'almacen_id')::bigint, almacen_predeterminado()),
+				(value->>'cantidad')::numeric,
+				(value->>'costo_unitario')::numeric,
+				true
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb))
+		) x
+		group by x.articulo_id, x.almacen_id
+		order by x.articulo_id, x.almacen_id
+	loop
+		select serializado, maneja_lotes
+		into v_serializado, v_maneja_lotes
+		from articulos
+		where id = v_fila.articulo_id;
+
+		v_quitadas := '{}';
+		v_agregadas := '{}';
+		if v_serializado then
+			v_previas := series_documento(
+				(p_base->>'venta_id')::bigint,
+				(p_base->>'compra_id')::bigint,
+				v_fila.articulo_id,
+				v_fila.almacen_id
+			);
+
+			select coalesce(array_agg(distinct s.serie), '{}')
+			into v_series
+			from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb)) l
+			cross join lateral jsonb_array_elements_text(
+				case when jsonb_typeof(l->'series') = 'array' then l->'series' else '[]'::jsonb end
+			) s(serie)
+			where (l->>'articulo_id')::bigint = v_fila.articulo_id
+				and coalesce((l->>'almacen_id')::bigint, almacen_predeterminado()) = v_fila.almacen_id;
+
+			v_quitadas := array(select unnest(v_previas) except select unnest(v_series) order by 1);
+			v_agregadas := array(select unnest(v_series) except select unnest(v_previas) order by 1);
+		end if;
+
+		-- Unidades que cambian sin una serie que las identifique
+		v_residuo := v_fila.diferencia - cardinality(v_agregadas) + cardinality(v_quitadas);
+		if v_residuo > 0 and v_serializado then
+			raise exception 'El artículo % es serializado, indique los números de serie de todas sus unidades',
+				v_fila.articulo_id
+				using errcode = 'PT422';
+		end if;
+
+		-- Lo que se regresa sale (o entra) de los lotes que el documento movió;
+		-- sólo lo registrado antes de los lotes queda sin lote.
+		v_lotes_documento := '[]'::jsonb;
+		if v_maneja_lotes then
+			v_lotes_documento := lotes_documento(
+				(p_base->>'venta_id')::bigint,
+				(p_base->>'compra_id')::bigint,
+				v_fila.articulo_id,
+				v_fila.almacen_id
+			);
+		end if;
+
+		-- Primero las unidades con serie, luego las que no la tienen
+		v_movimientos := '[]'::jsonb;
+		for v_pieza in 1..2 loop
+			if v_pieza = 1 then
+				v_cantidad := cardinality(v_quitadas);
+				v_series_pieza := v_quitadas;
+			else
+				v_cantidad := greatest(-v_residuo, 0);
+				v_series_pieza := '{}';
+			end if;
+			continue when v_cantidad = 0;
+
+			v_toma := tomar_lotes(v_lotes_documento, v_cantidad);
+			v_lotes_documento := v_toma->'resto';
+			select coalesce(sum((value->>'cantidad')::numeric), 0)
+			into v_tomado
+			from jsonb_array_elements(v_toma->'lotes');
+
+			if v_tomado > 0 then
+				v_movimientos := v_movimientos || jsonb_build_object(
+					'tipo_movimiento', p_tipo_inverso,
+					'cantidad', v_tomado,
+					'delta', v_signo_inverso * v_tomado,
+					'series', case when cardinality(v_series_pieza) > 0
+						then to_jsonb(v_series_pieza[1:v_tomado::int]) end,
+					'lotes', v_toma->'lotes'
+				);
+			end if;
+			if v_cantidad > v_tomado then
+				v_movimientos := v_movimientos || jsonb_build_object(
+					'tipo_movimiento', p_tipo_inverso,
+					'cantidad', v_cantidad - v_tomado,
+					'delta', v_signo_inverso * (v_cantidad - v_tomado),
+					'series', case when cardinality(v_series_pieza) > 0
+						then to_jsonb(v_series_pieza[v_tomado::int + 1:v_cantidad::int]) end
+				);
+			end if;
+		end loop;
+
+		-- Lo que se agrega usa el lote de las líneas nuevas si todas indican el
+		-- mismo; si no, una salida se surte por FEFO
+		select min(l->>'lote'), min(l->>'caducidad')
+		into v_lote, v_caducidad
+		from jsonb_array_elements(coalesce(p_nuevas, '[]'::jsonb)) l
+		where (l->>'articulo_id')::bigint = v_fila.articulo_id
+			and coalesce((l->>'almacen_id')::bigint, almacen_predeterminado()) = v_fila.almacen_id
+			and coalesce(l->>'lote', '') <> ''
+		having count(distinct l->>'lote') = 1;
+
+		v_cantidad := cardinality(v_agregadas) + greatest(v_residuo, 0);
+		if v_cantidad > 0 then
+			v_movimientos := v_movimientos || jsonb_build_object(
+				'tipo_movimiento', p_tipo,
+				'cantidad', v_cantidad,
+				'delta', v_signo * v_cantidad,
+				'costo_unitario', v_fila.costo_unitario,
+				'series', case when cardinality(v_agregadas) > 0 then to_jsonb(v_agregadas) end,
+				'requiere_series', true,
+				'lote', v_lote,
+				'caducidad', v_caducidad,
+				'requiere_lote', true
+			);
+		end if;
+
+		for v_mov in select value from jsonb_array_elements(v_movimientos)
+		loop
+			begin
+				perform aplicar_movimiento(p_base || jsonb_build_object(
+					'articulo_id', v_fila.articulo_id,
+					'almacen_id', v_fila.almacen_id
+				) || v_mov);
+			exception when others then
+				get stacked diagnostics v_hint = pg_exception_hint;
+				raise exception 'Error al ajustar inventario del articulo_id %: %', v_fila.articulo_id, sqlerrm
+					using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+						hint = coalesce(v_hint, '');
+			end;
+		end loop;
+	end loop;
+end;
+$$;
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb := '[]'::jsonb;
+	v_costos jsonb;
+	v_almacenes jsonb;
+	v_almacen_linea bigint;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	-- Costo ponderado de lo ya vendido por artículo; nulo si ninguna de sus
+	-- líneas lo tenía guardado
+	select coalesce(jsonb_object_agg(articulo_id, costo), '{}'::jsonb)
+	into v_costos
+	from (
+		select
+			articulo_id,
+			sum(costo_unitario * cantidad) filter (where costo_unitario is not null)
+				/ nullif(sum(cantidad) filter (where costo_unitario is not null), 0) as costo
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	-- Sin almacén en la línea, el artículo sigue saliendo de donde salió
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario)
+			select
+				p_venta_id,
+				a.id,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>a.id::text)::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				case when v_costos ? a.id::text then (v_costos->>a.id::text)::numeric else a.costo end
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning almacen_id into v_almacen_linea;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_nuevas := v_nuevas || jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_linea,
+				'cantidad', v_item->'cantidad',
+				'series', v_item->'series',
+				'lote', v_item->>'lote'
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
+
+create or replace function editar_compra(
+	p_compra_id bigint,
+	p_compra jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_estado text;
+	v_anteriores jsonb;
+	v_nuevas jsonb := '[]'::jsonb;
+	v_almacenes jsonb;
+	v_almacen_linea bigint;
+begin
+	select estado into v_estado from compras where id = p_compra_id for update;
+	if not found then
+		raise exception 'La compra % no existe', p_compra_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from compras_detalles
+	where compra_id = p_compra_id;
+
+	-- Sin almacén en la línea, el artículo sigue entrando donde entró
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from compras_detalles
+		where compra_id = p_compra_id
+		group by articulo_id
+	) x;
+
+	update compras
+	set notas = p_compra->>'notas'
+	where id = p_compra_id;
+
+	delete from compras_detalles where compra_id = p_compra_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into compras_detalles (compra_id, articulo_id, almacen_id, cantidad, precio_unitario)
+			values (
+				p_compra_id,
+				(v_item->>'articulo_id')::bigint,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>(v_item->>'articulo_id'))::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric
+			)
+			returning almacen_id into v_almacen_linea;
+
+			v_nuevas := v_nuevas || jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_linea,
+				'cantidad', v_item->'cantidad',
+				'costo_unitario', v_item->'precio_unitario',
+				'series', v_item->'series',
+				'lote', v_item->>'lote',
+				'caducidad', v_item->>'caducidad'
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	-- Las unidades adicionales entran al costo de la línea editada
+	if v_estado <> 'borrador' then
+		perform conciliar_documento(v_anteriores, v_nuevas, 'compra', 'cancelacion_compra', jsonb_build_object(
+			'motivo', 'Edición de compra #' || p_compra_id,
+			'usuario_nombre', p_compra->>'usuario_nombre',
+			'compra_id', p_compra_id
+		));
+	end if;
+
+	return jsonb_build_object('compra_id', p_compra_id);
+end;
+$$;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_movimiento->>'almacen_id')::bigint, almacen_predeterminado());
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_total_anterior numeric;
+	v_total_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+	v_serializado boolean;
+	v_series jsonb := p_movimiento->'series';
+	v_serie text;
+	v_serie_id bigint;
+	v_serie_estado text;
+	v_serie_almacen bigint;
+	v_maneja_lotes boolean;
+	v_lotes jsonb;
+	v_lote jsonb;
+	v_lote_id bigint;
+	v_lote_cantidad numeric;
+	v_caducidad date;
+	v_caducidad_lote date;
+	v_lotes_aplicados jsonb := '[]'::jsonb;
+	v_pendiente numeric;
+	v_fila record;
+	v_folio_congelado bigint;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Un artículo que está en una toma congelada sin terminar no se mueve en
+	-- ese almacén; sólo pasan los ajustes con que se cierra la toma.
+	if p_movimiento->>'tipo_movimiento' is distinct from 'ajuste_toma' then
+		select t.folio into v_folio_congelado
+		from tomafisica t
+		join tomafisicadetalle d on d.toma_id = t.id
+		where t.congelar
+			and t.estado in ('abierta', 'en_conteo', 'en_revision')
+			and t.almacen_id = v_almacen_id
+			and d.articulo_id = v_articulo_id
+		limit 1;
+
+		if found then
+			raise exception 'El artículo % está congelado por la toma física folio % en curso',
+				v_articulo_id, v_folio_congelado
+				using errcode = 'PT423';
+		end if;
+	end if;
+
+	-- Si otro movimiento tiene el artículo bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	-- El artículo se bloquea antes que el inventario del almacén: el costo y
+	-- los umbrales dependen de las existencias de todos los almacenes.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select coalesce(costo, 0), stock_minimo, stock_maximo, serializado, maneja_lotes
+		into v_costo_anterior, v_stock_minimo, v_stock_maximo, v_serializado, v_maneja_lotes
+		from articulos
+		where id = v_articulo_id
+		for update;
+
+		if not found then
+			raise exception 'El artículo % no existe', v_articulo_id;
+		end if;
+
+		-- El primer movimiento de un artículo en un almacén abre su inventario
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo_id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+			and almacen_id = v_almacen_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	-- Números de serie: obligatorios cuando quien llama lo pide (recepción de
+	-- compras, ventas) y, si vienen, uno por unidad.
+	if v_serializado and jsonb_typeof(v_series) is distinct from 'array'
+		and coalesce((p_movimiento->>'requiere_series')::boolean, false) then
+		raise exception 'El artículo % es serializado, indique los números de serie', v_articulo_id
+			using errcode = 'PT422';
+	end if;
+	if jsonb_typeof(v_series) = 'array' then
+		if not v_serializado then
+			raise exception 'El artículo % no es serializado', v_articulo_id using errcode = 'PT422';
+		end if;
+		if jsonb_array_length(v_series) <> abs(v_delta) then
+			raise exception 'Se indicaron % números de serie para % unidades del artículo %',
+				jsonb_array_length(v_series), abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	else
+		v_series := null;
+	end if;
+
+	-- Lotes: se aceptan como lista (lote, caducidad, cantidad) o como un solo
+	-- lote para toda la cantidad. Una entrada sin lote va a 'SIN LOTE' salvo
+	-- que quien llama lo exija (recepción de compras); una salida sin lote se
+	-- surte por FEFO más abajo.
+	if v_maneja_lotes then
+		if jsonb_typeof(p_movimiento->'lotes') = 'array' then
+			v_lotes := p_movimiento->'lotes';
+		elsif coalesce(p_movimiento->>'lote', '') <> '' then
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', p_movimiento->>'lote',
+				'caducidad', p_movimiento->>'caducidad',
+				'cantidad', abs(v_delta)
+			));
+		elsif v_delta > 0 then
+			if coalesce((p_movimiento->>'requiere_lote')::boolean, false) then
+				raise exception 'El artículo % maneja lotes, indique lote y caducidad', v_articulo_id
+					using errcode = 'PT422';
+			end if;
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', 'SIN LOTE',
+				'caducidad', null,
+				'cantidad', abs(v_delta)
+			));
+		end if;
+
+		if v_lotes is not null and (
+			select coalesce(sum((x->>'cantidad')::numeric), 0) from jsonb_array_elements(v_lotes) x
+		) <> abs(v_delta) then
+			raise exception 'Las cantidades por lote no suman % para el artículo %', abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+		and almacen_id = v_almacen_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select sum(cantidad_actual)
+	into v_total_actual
+	from inventarios
+	where articulo_id = v_articulo_id;
+
+	v_total_anterior := v_total_actual - v_delta;
+
+	-- Una salida que deja el almacén en negativo se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo % en el almacén %: hay %, se solicitan %',
+					v_articulo_id, v_almacen_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	-- Promedio ponderado móvil sobre las existencias de todos los almacenes:
+	-- sólo las entradas que traen costo lo recalculan, de modo que una
+	-- transferencia no lo altera. Si no había existencias (o eran negativas)
+	-- el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_total_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_total_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_total_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		almacen_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		transferencia_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		(p_movimiento->>'transferencia_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	-- Cada serie entra disponible al almacén o sale de él, y queda enlazada
+	-- al movimiento para reconstruir su historia.
+	for v_serie in select jsonb_array_elements_text(v_series)
+	loop
+		select id, estado, almacen_id
+		into v_serie_id, v_serie_estado, v_serie_almacen
+		from series
+		where articulo_id = v_articulo_id
+			and numero_serie = v_serie
+		for update;
+
+		if v_delta > 0 then
+			if v_serie_estado = 'disponible' then
+				raise exception 'La serie % del artículo % ya está en existencia', v_serie, v_articulo_id
+					using errcode = 'PT409';
+			end if;
+
+			if v_serie_id is null then
+				insert into series (articulo_id, numero_serie, estado, almacen_id)
+				values (v_articulo_id, v_serie, 'disponible', v_almacen_id)
+				returning id into v_serie_id;
+			else
+				update series
+				set estado = 'disponible',
+					almacen_id = v_almacen_id
+				where id = v_serie_id;
+			end if;
+		else
+			if v_serie_id is null or v_serie_estado <> 'disponible' or v_serie_almacen <> v_almacen_id then
+				raise exception 'La serie % del artículo % no está disponible en el almacén %',
+					v_serie, v_articulo_id, v_almacen_id
+					using errcode = 'PT409';
+			end if;
+
+			update series
+			set estado = case when p_movimiento->>'tipo_movimiento' = 'venta' then 'vendida' else 'fuera' end
+			where id = v_serie_id;
+		end if;
+
+		insert into movimientos_series (movimiento_id, serie_id)
+		values (v_movimiento_id, v_serie_id);
+
+		v_serie_id := null;
+		v_serie_estado := null;
+		v_serie_almacen := null;
+	end loop;
+
+	-- Existencias por lote, enlazadas al movimiento para la trazabilidad
+	if v_maneja_lotes and v_lotes is not null then
+		for v_lote in select value from jsonb_array_elements(v_lotes)
+		loop
+			v_lote_cantidad := (v_lote->>'cantidad')::numeric;
+			v_caducidad := (v_lote->>'caducidad')::date;
+
+			if v_delta > 0 then
+				insert into lotes (articulo_id, almacen_id, lote, caducidad, cantidad)
+				values (v_articulo_id, v_almacen_id, v_lote->>'lote', v_caducidad, 0)
+				on conflict (articulo_id, almacen_id, lote) do nothing;
+
+				update lotes
+				set cantidad = cantidad + v_lote_cantidad,
+					caducidad = coalesce(caducidad, v_caducidad)
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if v_caducidad is not null and v_caducidad_lote <> v_caducidad then
+					raise exception 'El lote % del artículo % ya está registrado con caducidad %',
+						v_lote->>'lote', v_articulo_id, v_caducidad_lote
+						using errcode = 'PT409';
+				end if;
+			else
+				update lotes
+				set cantidad = cantidad - v_lote_cantidad
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+					and cantidad >= v_lote_cantidad
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if not found then
+					raise exception 'El lote % del artículo % no tiene % unidades en el almacén %',
+						v_lote->>'lote', v_articulo_id, v_lote_cantidad, v_almacen_id
+						using errcode = 'PT409';
+				end if;
+			end if;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_lote_id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_lote->>'lote',
+				'caducidad', v_caducidad_lote,
+				'cantidad', v_lote_cantidad
+			);
+		end loop;
+	elsif v_maneja_lotes and v_delta < 0 then
+		-- FEFO: primero lo que caduca antes, sin surtir lotes caducados; para
+		-- sacar uno (una baja por caducidad) hay que indicarlo. El ajuste de una
+		-- toma sí los toma, porque descuenta lo que ya no está. Si los lotes no
+		-- alcanzan (sólo posible si la política permite negativos) el resto
+		-- queda sin lote.
+		v_pendiente := -v_delta;
+		for v_fila in
+			select id, lote, caducidad, cantidad
+			from lotes
+			where articulo_id = v_articulo_id
+				and almacen_id = v_almacen_id
+				and cantidad > 0
+				and (
+					caducidad is null
+					or caducidad >= current_date
+					or p_movimiento->>'tipo_movimiento' = 'ajuste_toma'
+				)
+			order by caducidad nulls last, id
+			for update
+		loop
+			v_lote_cantidad := least(v_pendiente, v_fila.cantidad);
+
+			update lotes
+			set cantidad = cantidad - v_lote_cantidad
+			where id = v_fila.id;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_fila.id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_fila.lote,
+				'caducidad', v_fila.caducidad,
+				'cantidad', v_lote_cantidad
+			);
+
+			v_pendiente := v_pendiente - v_lote_cantidad;
+			exit when v_pendiente <= 0;
+		end loop;
+
+		if v_pendiente > 0 and exists (
+			select 1
+			from lotes
+			where articulo_id = v_articulo_id
+				and almacen_id = v_almacen_id
+				and cantidad > 0
+				and caducidad < current_date
+		) then
+			raise exception 'El artículo % no tiene lotes vigentes para surtir % unidades en el almacén % (quedan lotes caducados), indique el lote',
+				v_articulo_id, v_pendiente, v_almacen_id
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_total_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Los umbrales son por artículo y se comparan contra el total de almacenes.
+	-- Al volver sobre el mínimo las alertas pendientes se dan por atendidas.
+	if v_stock_minimo is not null and v_total_anterior >= v_stock_minimo and v_total_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_total_anterior <= v_stock_maximo and v_total_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_total_anterior,
+			v_total_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_total_anterior < v_stock_minimo and v_total_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'almacen_id', v_almacen_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta,
+		'series', coalesce(v_series, '[]'::jsonb),
+		'lotes', v_lotes_aplicados
+	);
+end;
+$$;
@@ -0,0 +1,148 @@
+-- Editar una venta conserva sus lotes y series.
+--
+-- editar_venta borra y vuelve a insertar las líneas, y las nuevas quedaban
+-- sin los lotes y series entregados que registrar_venta guarda en cada una,
+-- así que la venta editada desaparecía de la trazabilidad por línea. Ahora
+-- cada línea guarda las series que trae y los lotes netos de la venta se
+-- reparten entre las líneas del artículo.
+
+create or replace function editar_venta(
+	p_venta_id bigint,
+	p_venta jsonb,
+	p_articulos jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_item jsonb;
+	v_linea bigint;
+	v_anteriores jsonb;
+	v_nuevas jsonb := '[]'::jsonb;
+	v_costos jsonb;
+	v_almacenes jsonb;
+	v_almacen_linea bigint;
+	v_grupo record;
+	v_detalle record;
+	v_lotes jsonb;
+	v_toma jsonb;
+begin
+	perform 1 from ventas where id = p_venta_id for update;
+	if not found then
+		raise exception 'La venta % no existe', p_venta_id using errcode = 'PT404';
+	end if;
+
+	select coalesce(jsonb_agg(jsonb_build_object('articulo_id', articulo_id, 'almacen_id', almacen_id, 'cantidad', cantidad)), '[]'::jsonb)
+	into v_anteriores
+	from ventas_detalle
+	where venta_id = p_venta_id;
+
+	-- Costo ponderado de lo ya vendido por artículo; nulo si ninguna de sus
+	-- líneas lo tenía guardado
+	select coalesce(jsonb_object_agg(articulo_id, costo), '{}'::jsonb)
+	into v_costos
+	from (
+		select
+			articulo_id,
+			sum(costo_unitario * cantidad) filter (where costo_unitario is not null)
+				/ nullif(sum(cantidad) filter (where costo_unitario is not null), 0) as costo
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	-- Sin almacén en la línea, el artículo sigue saliendo de donde salió
+	select coalesce(jsonb_object_agg(articulo_id, almacen_id), '{}'::jsonb)
+	into v_almacenes
+	from (
+		select articulo_id, min(almacen_id) as almacen_id
+		from ventas_detalle
+		where venta_id = p_venta_id
+		group by articulo_id
+	) x;
+
+	update ventas
+	set cliente_nombre = p_venta->>'cliente_nombre',
+		cliente_razon_social = p_venta->>'cliente_razon_social',
+		cliente_direccion = p_venta->>'cliente_direccion',
+		cliente_telefono = p_venta->>'cliente_telefono',
+		cliente_correo = p_venta->>'cliente_correo',
+		notas = p_venta->>'notas'
+	where id = p_venta_id;
+
+	delete from ventas_detalle where venta_id = p_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario, series)
+			select
+				p_venta_id,
+				a.id,
+				coalesce(
+					(v_item->>'almacen_id')::bigint,
+					(v_almacenes->>a.id::text)::bigint,
+					almacen_predeterminado()
+				),
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				case when v_costos ? a.id::text then (v_costos->>a.id::text)::numeric else a.costo end,
+				case when jsonb_typeof(v_item->'series') = 'array'
+					then nullif(v_item->'series', '[]'::jsonb) end
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning almacen_id into v_almacen_linea;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_nuevas := v_nuevas || jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_linea,
+				'cantidad', v_item->'cantidad',
+				'series', v_item->'series',
+				'lote', v_item->>'lote'
+			);
+		exception when others then
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm;
+		end;
+	end loop;
+
+	perform conciliar_documento(v_anteriores, v_nuevas, 'venta', 'cancelacion_venta', jsonb_build_object(
+		'motivo', 'Edición de venta #' || p_venta_id,
+		'usuario_nombre', p_venta->>'usuario_nombre',
+		'venta_id', p_venta_id
+	));
+
+	-- Las líneas vuelven a guardar qué lotes se entregaron: los que la venta
+	-- tiene movidos después de la edición, repartidos en orden de línea
+	for v_grupo in
+		select distinct articulo_id, almacen_id
+		from ventas_detalle
+		where venta_id = p_venta_id
+	loop
+		v_lotes := lotes_documento(p_venta_id, null, v_grupo.articulo_id, v_grupo.almacen_id);
+		continue when v_lotes = '[]'::jsonb;
+
+		for v_detalle in
+			select id, cantidad
+			from ventas_detalle
+			where venta_id = p_venta_id
+				and articulo_id = v_grupo.articulo_id
+				and almacen_id = v_grupo.almacen_id
+			order by id
+		loop
+			v_toma := tomar_lotes(v_lotes, v_detalle.cantidad);
+			v_lotes := v_toma->'resto';
+
+			update ventas_detalle
+			set lotes = nullif(v_toma->'lotes', '[]'::jsonb)
+			where id = v_detalle.id;
+		end loop;
+	end loop;
+
+	return jsonb_build_object('venta_id', p_venta_id);
+end;
+$$;
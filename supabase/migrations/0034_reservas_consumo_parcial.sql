@@ -0,0 +1,665 @@
+-- Reservas consumidas en parte y respetadas por todas las salidas.
+--
+-- Una venta marcaba consumida la reserva completa aunque la línea llevara
+-- menos unidades, y sólo registrar_venta revisaba lo apartado: una salida
+-- manual o una transferencia podía llevarse lo reservado para un cliente.
+-- Ahora cada reserva lleva lo ya consumido, sólo cuenta como apartado lo que
+-- resta, y aplicar_movimiento revisa lo apartado en cada salida.
+
+alter table reservas
+	add column if not exists cantidad_consumida numeric not null default 0;
+
+-- Las reservas consumidas antes de este cambio se dan por consumidas completas
+update reservas
+set cantidad_consumida = cantidad
+where estado = 'consumida'
+	and cantidad_consumida = 0;
+
+alter table reservas
+	drop constraint if exists reservas_cantidad_consumida_check;
+alter table reservas
+	add constraint reservas_cantidad_consumida_check
+	check (cantidad_consumida >= 0 and cantidad_consumida <= cantidad);
+
+create or replace function cantidad_reservada(p_articulo_id bigint, p_almacen_id bigint default null)
+returns numeric
+language sql
+stable
+as $$
+	select coalesce(sum(cantidad - cantidad_consumida), 0)
+	from reservas
+	where articulo_id = p_articulo_id
+		and (p_almacen_id is null or almacen_id = p_almacen_id)
+		and estado = 'activa'
+		and expira_en > now();
+$$;
+
+create or replace function registrar_venta(
+	p_venta jsonb,
+	p_articulos jsonb,
+	p_pagos jsonb default '[]'::jsonb
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_venta_id bigint;
+	v_item jsonb;
+	v_linea bigint;
+	v_movimiento jsonb;
+	v_backorders jsonb := '[]'::jsonb;
+	v_hint text;
+	v_detalle_id bigint;
+	v_almacen_id bigint;
+begin
+	if p_articulos is null or jsonb_array_length(p_articulos) = 0 then
+		raise exception 'Debe enviar al menos un artículo';
+	end if;
+
+	insert into ventas (
+		cliente_nombre,
+		cliente_razon_social,
+		cliente_direccion,
+		cliente_telefono,
+		cliente_correo,
+		requiere_factura,
+		notas,
+		total
+	) values (
+		p_venta->>'cliente_nombre',
+		p_venta->>'cliente_razon_social',
+		p_venta->>'cliente_direccion',
+		p_venta->>'cliente_telefono',
+		p_venta->>'cliente_correo',
+		coalesce((p_venta->>'requiere_factura')::boolean, false),
+		p_venta->>'notas',
+		(p_venta->>'total')::numeric
+	)
+	returning id into v_venta_id;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(p_articulos) with ordinality
+	loop
+		begin
+			-- La línea consume de la reserva indicada hasta su cantidad y la
+			-- mercancía sale del almacén donde estaba apartada; si la línea
+			-- indica almacén debe ser ése. Lo que la línea no cubre sigue
+			-- apartado, y lo que pase de la reserva sale de lo libre. Se
+			-- consume antes del movimiento para que no choque con su propia
+			-- reserva.
+			v_almacen_id := (v_item->>'almacen_id')::bigint;
+			if v_item->>'reserva_id' is not null then
+				update reservas
+				set cantidad_consumida = least(cantidad, cantidad_consumida + (v_item->>'cantidad')::numeric),
+					estado = case
+						when cantidad_consumida + (v_item->>'cantidad')::numeric >= cantidad then 'consumida'
+						else estado
+					end,
+					venta_id = v_venta_id
+				where id = (v_item->>'reserva_id')::bigint
+					and articulo_id = (v_item->>'articulo_id')::bigint
+					and (v_almacen_id is null or almacen_id = v_almacen_id)
+					and estado = 'activa'
+					and expira_en > now()
+				returning almacen_id into v_almacen_id;
+
+				if not found then
+					raise exception 'La reserva % no está vigente o no corresponde al artículo y almacén', v_item->>'reserva_id'
+						using errcode = 'PT409';
+				end if;
+			end if;
+			v_almacen_id := coalesce(v_almacen_id, almacen_predeterminado());
+
+			insert into ventas_detalle (venta_id, articulo_id, almacen_id, cantidad, precio_unitario, costo_unitario)
+			select
+				v_venta_id,
+				a.id,
+				v_almacen_id,
+				(v_item->>'cantidad')::int,
+				(v_item->>'precio_unitario')::numeric,
+				a.costo
+			from articulos a
+			where a.id = (v_item->>'articulo_id')::bigint
+			returning id into v_detalle_id;
+
+			if not found then
+				raise exception 'El artículo no existe';
+			end if;
+
+			v_movimiento := aplicar_movimiento(jsonb_build_object(
+				'articulo_id', v_item->'articulo_id',
+				'almacen_id', v_almacen_id,
+				'tipo_movimiento', 'venta',
+				'cantidad', v_item->'cantidad',
+				'delta', v_item->'delta',
+				'motivo', 'Venta #' || v_venta_id,
+				'usuario_nombre', p_venta->>'usuario_nombre',
+				'venta_id', v_venta_id,
+				'series', v_item->'series',
+				'requiere_series', true,
+				'lote', v_item->>'lote'
+			));
+
+			-- La línea guarda qué lotes y series se entregaron
+			update ventas_detalle
+			set lotes = nullif(v_movimiento->'lotes', '[]'::jsonb),
+				series = nullif(v_movimiento->'series', '[]'::jsonb)
+			where id = v_detalle_id;
+
+			if (v_movimiento->>'backorder')::boolean then
+				v_backorders := v_backorders || jsonb_build_object(
+					'linea', v_linea,
+					'articulo_id', v_item->'articulo_id',
+					'cantidad_actual', v_movimiento->'cantidad_actual'
+				);
+			end if;
+		exception when others then
+			-- Se conserva el código de los errores PTxxx (stock insuficiente,
+			-- conflicto de versión) para que la API responda con el mismo estado.
+			get stacked diagnostics v_hint = pg_exception_hint;
+			raise exception 'Error en el artículo de la línea % (articulo_id %): %',
+				v_linea, v_item->>'articulo_id', sqlerrm
+				using errcode = case when sqlstate like 'PT%' then sqlstate else 'P0001' end,
+					hint = coalesce(v_hint, '');
+		end;
+	end loop;
+
+	for v_item, v_linea in
+		select value, ordinality from jsonb_array_elements(coalesce(p_pagos, '[]'::jsonb)) with ordinality
+	loop
+		begin
+			insert into pagos (venta_id, monto, metodo_pago)
+			values (
+				v_venta_id,
+				(v_item->>'monto')::numeric,
+				v_item->>'metodo_pago'
+			);
+		exception when others then
+			raise exception 'Error en el pago de la línea %: %', v_linea, sqlerrm;
+		end;
+	end loop;
+
+	return jsonb_build_object(
+		'venta_id', v_venta_id,
+		'backorders', v_backorders
+	);
+end;
+$$;
+
+create or replace function aplicar_movimiento(p_movimiento jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_articulo_id bigint := (p_movimiento->>'articulo_id')::bigint;
+	v_almacen_id bigint := coalesce((p_movimiento->>'almacen_id')::bigint, almacen_predeterminado());
+	v_delta numeric := (p_movimiento->>'delta')::numeric;
+	v_costo_entrada numeric := (p_movimiento->>'costo_unitario')::numeric;
+	v_cantidad_anterior numeric;
+	v_cantidad_actual numeric;
+	v_total_anterior numeric;
+	v_total_actual numeric;
+	v_costo_anterior numeric;
+	v_costo_promedio numeric;
+	v_movimiento_id bigint;
+	v_version bigint;
+	v_version_esperada bigint := (p_movimiento->>'version')::bigint;
+	v_backorder boolean := false;
+	v_stock_minimo numeric;
+	v_stock_maximo numeric;
+	v_alerta text;
+	v_serializado boolean;
+	v_series jsonb := p_movimiento->'series';
+	v_serie text;
+	v_serie_id bigint;
+	v_serie_estado text;
+	v_serie_almacen bigint;
+	v_maneja_lotes boolean;
+	v_lotes jsonb;
+	v_lote jsonb;
+	v_lote_id bigint;
+	v_lote_cantidad numeric;
+	v_caducidad date;
+	v_caducidad_lote date;
+	v_lotes_aplicados jsonb := '[]'::jsonb;
+	v_pendiente numeric;
+	v_fila record;
+	v_folio_congelado bigint;
+	v_reservado numeric;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Un artículo que está en una toma congelada sin terminar no se mueve en
+	-- ese almacén; sólo pasan los ajustes con que se cierra la toma.
+	if p_movimiento->>'tipo_movimiento' is distinct from 'ajuste_toma' then
+		select t.folio into v_folio_congelado
+		from tomafisica t
+		join tomafisicadetalle d on d.toma_id = t.id
+		where t.congelar
+			and t.estado in ('abierta', 'en_conteo', 'en_revision')
+			and t.almacen_id = v_almacen_id
+			and d.articulo_id = v_articulo_id
+		limit 1;
+
+		if found then
+			raise exception 'El artículo % está congelado por la toma física folio % en curso',
+				v_articulo_id, v_folio_congelado
+				using errcode = 'PT423';
+		end if;
+	end if;
+
+	-- Si otro movimiento tiene el artículo bloqueado más de lo razonable se
+	-- responde 409 para que el cliente reintente en vez de colgar la petición.
+	-- El artículo se bloquea antes que el inventario del almacén: el costo y
+	-- los umbrales dependen de las existencias de todos los almacenes.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		select coalesce(costo, 0), stock_minimo, stock_maximo, serializado, maneja_lotes
+		into v_costo_anterior, v_stock_minimo, v_stock_maximo, v_serializado, v_maneja_lotes
+		from articulos
+		where id = v_articulo_id
+		for update;
+
+		if not found then
+			raise exception 'El artículo % no existe', v_articulo_id;
+		end if;
+
+		-- El primer movimiento de un artículo en un almacén abre su inventario
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo_id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+
+		select version
+		into v_version
+		from inventarios
+		where articulo_id = v_articulo_id
+			and almacen_id = v_almacen_id
+		for update;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del artículo % está siendo modificado, vuelva a intentar', v_articulo_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	-- Números de serie: obligatorios cuando quien llama lo pide (recepción de
+	-- compras, ventas) y, si vienen, uno por unidad.
+	if v_serializado and jsonb_typeof(v_series) is distinct from 'array'
+		and coalesce((p_movimiento->>'requiere_series')::boolean, false) then
+		raise exception 'El artículo % es serializado, indique los números de serie', v_articulo_id
+			using errcode = 'PT422';
+	end if;
+	if jsonb_typeof(v_series) = 'array' then
+		if not v_serializado then
+			raise exception 'El artículo % no es serializado', v_articulo_id using errcode = 'PT422';
+		end if;
+		if jsonb_array_length(v_series) <> abs(v_delta) then
+			raise exception 'Se indicaron % números de serie para % unidades del artículo %',
+				jsonb_array_length(v_series), abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	else
+		v_series := null;
+	end if;
+
+	-- Lotes: se aceptan como lista (lote, caducidad, cantidad) o como un solo
+	-- lote para toda la cantidad. Una entrada sin lote va a 'SIN LOTE' salvo
+	-- que quien llama lo exija (recepción de compras); una salida sin lote se
+	-- surte por FEFO más abajo.
+	if v_maneja_lotes then
+		if jsonb_typeof(p_movimiento->'lotes') = 'array' then
+			v_lotes := p_movimiento->'lotes';
+		elsif coalesce(p_movimiento->>'lote', '') <> '' then
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', p_movimiento->>'lote',
+				'caducidad', p_movimiento->>'caducidad',
+				'cantidad', abs(v_delta)
+			));
+		elsif v_delta > 0 then
+			if coalesce((p_movimiento->>'requiere_lote')::boolean, false) then
+				raise exception 'El artículo % maneja lotes, indique lote y caducidad', v_articulo_id
+					using errcode = 'PT422';
+			end if;
+			v_lotes := jsonb_build_array(jsonb_build_object(
+				'lote', 'SIN LOTE',
+				'caducidad', null,
+				'cantidad', abs(v_delta)
+			));
+		end if;
+
+		if v_lotes is not null and (
+			select coalesce(sum((x->>'cantidad')::numeric), 0) from jsonb_array_elements(v_lotes) x
+		) <> abs(v_delta) then
+			raise exception 'Las cantidades por lote no suman % para el artículo %', abs(v_delta), v_articulo_id
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	-- Control optimista: quien envía la versión que leyó sólo aplica el
+	-- movimiento si nadie más tocó el inventario desde entonces.
+	if v_version_esperada is not null and v_version_esperada <> v_version then
+		raise exception 'El inventario del artículo % cambió (versión %, se esperaba %), vuelva a intentar',
+			v_articulo_id, v_version, v_version_esperada
+			using errcode = 'PT409', hint = 'reintentar';
+	end if;
+
+	update inventarios
+	set cantidad_actual = cantidad_actual + v_delta,
+		version = version + 1,
+		ultima_actualizacion = now()
+	where articulo_id = v_articulo_id
+		and almacen_id = v_almacen_id
+	returning cantidad_actual, version into v_cantidad_actual, v_version;
+
+	v_cantidad_anterior := v_cantidad_actual - v_delta;
+
+	select sum(cantidad_actual)
+	into v_total_actual
+	from inventarios
+	where articulo_id = v_articulo_id;
+
+	v_total_anterior := v_total_actual - v_delta;
+
+	-- Una salida que deja el almacén en negativo se resuelve según la política
+	if v_delta < 0 and v_cantidad_actual < 0 then
+		case politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento')
+			when 'rechazar' then
+				raise exception 'Stock insuficiente para el artículo % en el almacén %: hay %, se solicitan %',
+					v_articulo_id, v_almacen_id, v_cantidad_anterior, -v_delta
+					using errcode = 'PT422';
+			when 'backorder' then
+				v_backorder := true;
+			else
+				null;
+		end case;
+	end if;
+
+	-- Donde la política rechaza negativos tampoco sale lo apartado para otros
+	-- clientes, venga de una venta, una salida manual o una transferencia.
+	-- Los ajustes de toma y las reversas registran lo que ya ocurrió.
+	if v_delta < 0
+		and p_movimiento->>'tipo_movimiento' is distinct from 'ajuste_toma'
+		and p_movimiento->>'reversa_de' is null
+		and politica_stock_negativo(v_articulo_id, p_movimiento->>'tipo_movimiento') = 'rechazar'
+	then
+		v_reservado := cantidad_reservada(v_articulo_id, v_almacen_id);
+		if v_reservado > 0 and v_cantidad_actual < v_reservado then
+			raise exception 'Stock insuficiente para el artículo % en el almacén %: hay % libres, se solicitan %',
+				v_articulo_id, v_almacen_id, greatest(v_cantidad_anterior - v_reservado, 0), -v_delta
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	-- Promedio ponderado móvil sobre las existencias de todos los almacenes:
+	-- sólo las entradas que traen costo lo recalculan, de modo que una
+	-- transferencia no lo altera. Si no había existencias (o eran negativas)
+	-- el costo de la entrada manda.
+	v_costo_promedio := v_costo_anterior;
+	if v_delta > 0 and v_costo_entrada is not null then
+		if v_total_anterior <= 0 then
+			v_costo_promedio := v_costo_entrada;
+		else
+			v_costo_promedio := round(
+				(v_total_anterior * v_costo_anterior + v_delta * v_costo_entrada) / v_total_actual,
+				4
+			);
+		end if;
+
+		update articulos
+		set costo = v_costo_promedio
+		where id = v_articulo_id;
+	end if;
+
+	insert into movimientos_inventario (
+		articulo_id,
+		almacen_id,
+		tipo_movimiento,
+		cantidad,
+		motivo,
+		usuario_nombre,
+		venta_id,
+		compra_id,
+		transferencia_id,
+		costo_unitario,
+		costo_promedio,
+		reversa_de,
+		reemplaza_a,
+		backorder
+	) values (
+		v_articulo_id,
+		v_almacen_id,
+		p_movimiento->>'tipo_movimiento',
+		(p_movimiento->>'cantidad')::numeric,
+		p_movimiento->>'motivo',
+		p_movimiento->>'usuario_nombre',
+		(p_movimiento->>'venta_id')::bigint,
+		(p_movimiento->>'compra_id')::bigint,
+		(p_movimiento->>'transferencia_id')::bigint,
+		coalesce(v_costo_entrada, v_costo_anterior),
+		v_costo_promedio,
+		(p_movimiento->>'reversa_de')::bigint,
+		(p_movimiento->>'reemplaza_a')::bigint,
+		v_backorder
+	)
+	returning id into v_movimiento_id;
+
+	-- Cada serie entra disponible al almacén o sale de él, y queda enlazada
+	-- al movimiento para reconstruir su historia.
+	for v_serie in select jsonb_array_elements_text(v_series)
+	loop
+		select id, estado, almacen_id
+		into v_serie_id, v_serie_estado, v_serie_almacen
+		from series
+		where articulo_id = v_articulo_id
+			and numero_serie = v_serie
+		for update;
+
+		if v_delta > 0 then
+			if v_serie_estado = 'disponible' then
+				raise exception 'La serie % del artículo % ya está en existencia', v_serie, v_articulo_id
+					using errcode = 'PT409';
+			end if;
+
+			if v_serie_id is null then
+				insert into series (articulo_id, numero_serie, estado, almacen_id)
+				values (v_articulo_id, v_serie, 'disponible', v_almacen_id)
+				returning id into v_serie_id;
+			else
+				update series
+				set estado = 'disponible',
+					almacen_id = v_almacen_id
+				where id = v_serie_id;
+			end if;
+		else
+			if v_serie_id is null or v_serie_estado <> 'disponible' or v_serie_almacen <> v_almacen_id then
+				raise exception 'La serie % del artículo % no está disponible en el almacén %',
+					v_serie, v_articulo_id, v_almacen_id
+					using errcode = 'PT409';
+			end if;
+
+			update series
+			set estado = case when p_movimiento->>'tipo_movimiento' = 'venta' then 'vendida' else 'fuera' end
+			where id = v_serie_id;
+		end if;
+
+		insert into movimientos_series (movimiento_id, serie_id)
+		values (v_movimiento_id, v_serie_id);
+
+		v_serie_id := null;
+		v_serie_estado := null;
+		v_serie_almacen := null;
+	end loop;
+
+	-- Existencias por lote, enlazadas al movimiento para la trazabilidad
+	if v_maneja_lotes and v_lotes is not null then
+		for v_lote in select value from jsonb_array_elements(v_lotes)
+		loop
+			v_lote_cantidad := (v_lote->>'cantidad')::numeric;
+			v_caducidad := (v_lote->>'caducidad')::date;
+
+			if v_delta > 0 then
+				insert into lotes (articulo_id, almacen_id, lote, caducidad, cantidad)
+				values (v_articulo_id, v_almacen_id, v_lote->>'lote', v_caducidad, 0)
+				on conflict (articulo_id, almacen_id, lote) do nothing;
+
+				update lotes
+				set cantidad = cantidad + v_lote_cantidad,
+					caducidad = coalesce(caducidad, v_caducidad)
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if v_caducidad is not null and v_caducidad_lote <> v_caducidad then
+					raise exception 'El lote % del artículo % ya está registrado con caducidad %',
+						v_lote->>'lote', v_articulo_id, v_caducidad_lote
+						using errcode = 'PT409';
+				end if;
+			else
+				update lotes
+				set cantidad = cantidad - v_lote_cantidad
+				where articulo_id = v_articulo_id
+					and almacen_id = v_almacen_id
+					and lote = v_lote->>'lote'
+					and cantidad >= v_lote_cantidad
+				returning id, caducidad into v_lote_id, v_caducidad_lote;
+
+				if not found then
+					raise exception 'El lote % del artículo % no tiene % unidades en el almacén %',
+						v_lote->>'lote', v_articulo_id, v_lote_cantidad, v_almacen_id
+						using errcode = 'PT409';
+				end if;
+			end if;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_lote_id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_lote->>'lote',
+				'caducidad', v_caducidad_lote,
+				'cantidad', v_lote_cantidad
+			);
+		end loop;
+	elsif v_maneja_lotes and v_delta < 0 then
+		-- FEFO: primero lo que caduca antes, sin surtir lotes caducados; para
+		-- sacar uno (una baja por caducidad) hay que indicarlo. El ajuste de una
+		-- toma sí los toma, porque descuenta lo que ya no está. Si los lotes no
+		-- alcanzan (sólo posible si la política permite negativos) el resto
+		-- queda sin lote.
+		v_pendiente := -v_delta;
+		for v_fila in
+			select id, lote, caducidad, cantidad
+			from lotes
+			where articulo_id = v_articulo_id
+				and almacen_id = v_almacen_id
+				and cantidad > 0
+				and (
+					caducidad is null
+					or caducidad >= current_date
+					or p_movimiento->>'tipo_movimiento' = 'ajuste_toma'
+				)
+			order by caducidad nulls last, id
+			for update
+		loop
+			v_lote_cantidad := least(v_pendiente, v_fila.cantidad);
+
+			update lotes
+			set cantidad = cantidad - v_lote_cantidad
+			where id = v_fila.id;
+
+			insert into movimientos_lotes (movimiento_id, lote_id, cantidad)
+			values (v_movimiento_id, v_fila.id, v_lote_cantidad);
+
+			v_lotes_aplicados := v_lotes_aplicados || jsonb_build_object(
+				'lote', v_fila.lote,
+				'caducidad', v_fila.caducidad,
+				'cantidad', v_lote_cantidad
+			);
+
+			v_pendiente := v_pendiente - v_lote_cantidad;
+			exit when v_pendiente <= 0;
+		end loop;
+
+		if v_pendiente > 0 and exists (
+			select 1
+			from lotes
+			where articulo_id = v_articulo_id
+				and almacen_id = v_almacen_id
+				and cantidad > 0
+				and caducidad < current_date
+		) then
+			raise exception 'El artículo % no tiene lotes vigentes para surtir % unidades en el almacén % (quedan lotes caducados), indique el lote',
+				v_articulo_id, v_pendiente, v_almacen_id
+				using errcode = 'PT422';
+		end if;
+	end if;
+
+	if v_costo_promedio is distinct from v_costo_anterior then
+		insert into articulos_costos_historial (
+			articulo_id,
+			movimiento_id,
+			cantidad_anterior,
+			costo_anterior,
+			cantidad_entrada,
+			costo_entrada,
+			costo_nuevo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_total_anterior,
+			v_costo_anterior,
+			v_delta,
+			v_costo_entrada,
+			v_costo_promedio
+		);
+	end if;
+
+	-- Los umbrales son por artículo y se comparan contra el total de almacenes.
+	-- Al volver sobre el mínimo las alertas pendientes se dan por atendidas.
+	if v_stock_minimo is not null and v_total_anterior >= v_stock_minimo and v_total_actual < v_stock_minimo then
+		v_alerta := 'bajo_minimo';
+	elsif v_stock_maximo is not null and v_total_anterior <= v_stock_maximo and v_total_actual > v_stock_maximo then
+		v_alerta := 'sobre_maximo';
+	end if;
+
+	if v_alerta is not null then
+		insert into alertas_stock (
+			articulo_id,
+			movimiento_id,
+			tipo,
+			cantidad_anterior,
+			cantidad_actual,
+			stock_minimo,
+			stock_maximo
+		) values (
+			v_articulo_id,
+			v_movimiento_id,
+			v_alerta,
+			v_total_anterior,
+			v_total_actual,
+			v_stock_minimo,
+			v_stock_maximo
+		);
+	end if;
+
+	if v_stock_minimo is not null and v_total_anterior < v_stock_minimo and v_total_actual >= v_stock_minimo then
+		update alertas_stock
+		set atendida = true
+		where articulo_id = v_articulo_id
+			and tipo = 'bajo_minimo'
+			and not atendida;
+	end if;
+
+	return jsonb_build_object(
+		'movimiento_id', v_movimiento_id,
+		'almacen_id', v_almacen_id,
+		'cantidad_actual', v_cantidad_actual,
+		'costo_promedio', v_costo_promedio,
+		'version', v_version,
+		'backorder', v_backorder,
+		'alerta', v_alerta,
+		'series', coalesce(v_series, '[]'::jsonb),
+		'lotes', v_lotes_aplicados
+	);
+end;
+$$;
@@ -0,0 +1,49 @@
+-- El detalle de una toma sólo cambia en el estado que le corresponde.
+--
+-- El trigger de 0022 sólo vigila las capturas de cantidad_real: una toma
+-- cerrada o cancelada podía perder o ganar líneas, o cambiar su teórico y sus
+-- ajustes. Este trigger cubre el resto:
+--   * cerrada y cancelada no admiten ningún cambio en sus líneas;
+--   * las líneas se agregan o quitan sólo mientras la toma está abierta.
+-- Los demás campos (marcas de reconteo, movimiento del ajuste) los escriben
+-- las funciones de la toma antes de cambiarla de estado. Si la toma ya no
+-- existe (borrado en cascada) no hay nada que proteger.
+
+create or replace function validar_estado_detalle_toma()
+returns trigger
+language plpgsql
+as $$
+declare
+	v_toma_id bigint := case when tg_op = 'DELETE' then old.toma_id else new.toma_id end;
+	v_estado text;
+	v_folio bigint;
+begin
+	if tg_op = 'UPDATE' and new.toma_id <> old.toma_id then
+		raise exception 'Una línea no puede pasar a otra toma' using errcode = 'PT409';
+	end if;
+
+	select estado, folio into v_estado, v_folio from tomafisica where id = v_toma_id;
+	if not found then
+		return case when tg_op = 'DELETE' then old else new end;
+	end if;
+
+	if v_estado in ('cerrada', 'cancelada') then
+		raise exception 'La toma folio % está %, sus líneas ya no se pueden modificar', v_folio, v_estado
+			using errcode = 'PT409';
+	end if;
+
+	if tg_op in ('INSERT', 'DELETE') and v_estado <> 'abierta' then
+		raise exception 'La toma folio % está %, sólo se pueden agregar o quitar líneas mientras está abierta',
+			v_folio, v_estado
+			using errcode = 'PT409';
+	end if;
+
+	return case when tg_op = 'DELETE' then old else new end;
+end;
+$$;
+
+drop trigger if exists tomafisicadetalle_estado on tomafisicadetalle;
+create trigger tomafisicadetalle_estado
+	before insert or update or delete on tomafisicadetalle
+	for each row
+	execute function validar_estado_detalle_toma();
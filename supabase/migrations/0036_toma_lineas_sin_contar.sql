@@ -0,0 +1,113 @@
+-- Las líneas que nadie contó quedan sin contar.
+--
+-- Con varios contadores, evaluar_reconteo_toma fijaba cantidad_real en el
+-- mayor de los conteos tomando como cero a quien no registró la línea, así
+-- que una línea que nadie contó quedaba en 0 y cerrar_toma dejaba su
+-- existencia en cero. Ahora queda en null, igual que con un solo contador, y
+-- el cierre la omite. La tolerancia tampoco se evalúa en líneas sin contar.
+-- Las tomas nuevas crean sus líneas sin contar en lugar de en 0.
+
+create or replace function evaluar_reconteo_toma(p_toma_id bigint)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_toma tomafisica;
+	v_multiple boolean;
+	v_contadores integer;
+	v_linea record;
+	v_motivo text;
+	v_reconteo jsonb := '[]'::jsonb;
+begin
+	select * into v_toma from tomafisica where id = p_toma_id;
+	v_multiple := v_toma.conteos_requeridos > 1;
+
+	if v_multiple then
+		select count(distinct usuario_auth0_sub) into v_contadores
+		from tomafisica_conteos
+		where toma_id = p_toma_id;
+
+		if v_contadores < v_toma.conteos_requeridos then
+			raise exception 'La toma folio % requiere % conteos independientes y tiene %',
+				v_toma.folio, v_toma.conteos_requeridos, v_contadores
+				using errcode = 'PT409';
+		end if;
+	end if;
+
+	-- Con varios contadores, quien contó en la toma y no registró la línea
+	-- la contó en cero; si nadie la registró queda sin contar, como en una
+	-- toma de un solo conteo
+	for v_linea in
+		select
+			d.id,
+			d.articulo_id,
+			d.cantidad_teorica,
+			d.reconteo_solicitado_en,
+			case when v_multiple then c.minimo else d.cantidad_real end as minimo,
+			case when v_multiple then c.maximo else d.cantidad_real end as maximo,
+			coalesce(
+				case when v_multiple then c.recontado else d.contado_en >= d.reconteo_solicitado_en end,
+				false
+			) as recontado
+		from tomafisicadetalle d
+		left join lateral (
+			select
+				case when count(tc.id) > 0 then min(coalesce(tc.cantidad, 0)) end as minimo,
+				case when count(tc.id) > 0 then max(coalesce(tc.cantidad, 0)) end as maximo,
+				bool_and(coalesce(tc.updated_at >= d.reconteo_solicitado_en, false)) as recontado
+			from (
+				select distinct usuario_auth0_sub
+				from tomafisica_conteos
+				where toma_id = p_toma_id
+			) u
+			left join tomafisica_conteos tc
+				on tc.detalle_id = d.id
+				and tc.usuario_auth0_sub = u.usuario_auth0_sub
+		) c on true
+		where d.toma_id = p_toma_id
+		order by d.id
+	loop
+		v_motivo := null;
+		if v_linea.minimo is distinct from v_linea.maximo then
+			v_motivo := 'conteos_distintos';
+		elsif v_toma.tolerancia_pct is not null
+			and v_linea.maximo is not null
+			and abs(v_linea.maximo - v_linea.cantidad_teorica)
+				> v_linea.cantidad_teorica * v_toma.tolerancia_pct / 100
+			and not (v_linea.reconteo_solicitado_en is not null and v_linea.recontado) then
+			v_motivo := 'variacion';
+		end if;
+
+		if v_motivo is null then
+			update tomafisicadetalle
+			set requiere_reconteo = false,
+				motivo_reconteo = null
+			where id = v_linea.id
+				and requiere_reconteo;
+
+			if v_multiple then
+				update tomafisicadetalle
+				set cantidad_real = v_linea.maximo
+				where id = v_linea.id;
+			end if;
+		else
+			update tomafisicadetalle
+			set requiere_reconteo = true,
+				motivo_reconteo = v_motivo,
+				reconteo_solicitado_en = case
+					when v_motivo = 'conteos_distintos' then now()
+					else coalesce(reconteo_solicitado_en, now())
+				end
+			where id = v_linea.id;
+
+			v_reconteo := v_reconteo || jsonb_build_object(
+				'detalle_id', v_linea.id,
+				'articulo_id', v_linea.articulo_id,
+				'motivo_reconteo', v_motivo
+			);
+		end if;
+	end loop;
+
+	return v_reconteo;
+end;
+$$;
@@ -0,0 +1,30 @@
+-- El reporte de variaciones no cuenta como faltante lo que no se contó.
+--
+-- La vista tomaba cantidad_real null como 0, así que cada línea sin contar
+-- aparecía como merma total aunque cerrar_toma la omite y no la ajusta. Ahora
+-- esas líneas traen cantidad_real y diferencias en null y contada en false;
+-- el reporte las señala y las deja fuera de los totales.
+
+create or replace view tomafisica_variacion_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	a.categoria_id,
+	c.nombre as categoria_nombre,
+	d.cantidad_teorica,
+	d.cantidad_real,
+	d.cantidad_real - (d.cantidad_teorica + co.movimientos_corte) as diferencia,
+	coalesce(a.costo, 0) as costo,
+	d.cantidad_teorica * coalesce(a.costo, 0) as valor_teorico,
+	(d.cantidad_real - (d.cantidad_teorica + co.movimientos_corte)) * coalesce(a.costo, 0) as valor_diferencia,
+	co.movimientos_corte,
+	d.cantidad_teorica + co.movimientos_corte as cantidad_esperada,
+	d.cantidad_real is not null as contada
+from tomafisicadetalle d
+join tomafisica_corte_view co on co.detalle_id = d.id
+join articulos a on a.id = d.articulo_id
+left join categorias c on c.id = a.categoria_id;
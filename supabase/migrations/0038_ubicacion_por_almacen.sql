@@ -0,0 +1,97 @@
+-- La ubicación (pasillo, anaquel, nivel) es por almacén.
+--
+-- 0025 la guardaba en articulos, pero las existencias y las tomas son por
+-- almacén y el mismo artículo está en otro lugar en cada uno, así que las
+-- hojas de conteo no salían en el orden en que se recorre el almacén. Pasa a
+-- inventarios (articulo_id, almacen_id); cada almacén hereda la que tenía el
+-- artículo y después se ajusta con asignar_ubicacion.
+
+alter table inventarios
+	add column if not exists ubicacion text;
+
+update inventarios i
+set ubicacion = a.ubicacion
+from articulos a
+where a.id = i.articulo_id
+	and i.ubicacion is null
+	and a.ubicacion is not null;
+
+drop view if exists tomafisica_hoja_view;
+
+alter table articulos
+	drop column if exists ubicacion;
+
+create view tomafisica_hoja_view as
+select
+	d.id as detalle_id,
+	d.toma_id,
+	d.articulo_id,
+	a.nombre,
+	a.marca,
+	a.codigo_barras,
+	i.ubicacion,
+	a.categoria_id,
+	c.nombre as categoria_nombre,
+	d.cantidad_teorica
+from tomafisicadetalle d
+join tomafisica t on t.id = d.toma_id
+join articulos a on a.id = d.articulo_id
+left join inventarios i on i.articulo_id = d.articulo_id and i.almacen_id = t.almacen_id
+left join categorias c on c.id = a.categoria_id;
+
+-- La vista por almacén muestra la ubicación al final
+create or replace view inventario_almacen_view as
+select
+	a.id,
+	a.nombre,
+	a.precio_venta,
+	a.costo,
+	a.proveedor,
+	a.codigo_barras,
+	a.marca,
+	a.estado,
+	a.categoria_id,
+	i.cantidad_actual,
+	i.ultima_actualizacion,
+	i.almacen_id,
+	al.nombre as almacen_nombre,
+	cantidad_reservada(a.id, i.almacen_id) as reservado,
+	i.ubicacion
+from articulos a
+join inventarios i on i.articulo_id = a.id
+join almacenes al on al.id = i.almacen_id;
+
+-- Asigna la ubicación de un artículo en un almacén. Si el artículo todavía no
+-- tiene inventario ahí se abre en cero, como lo haría su primer movimiento.
+-- Una ubicación vacía la quita.
+create or replace function asignar_ubicacion(
+	p_articulo_id bigint,
+	p_almacen_id bigint,
+	p_ubicacion text
+) returns jsonb
+language plpgsql
+as $$
+declare
+	v_almacen_id bigint := coalesce(p_almacen_id, almacen_predeterminado());
+	v_inventario inventarios;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+	if not exists (select 1 from articulos where id = p_articulo_id) then
+		raise exception 'El artículo % no existe', p_articulo_id using errcode = 'PT404';
+	end if;
+
+	insert into inventarios (articulo_id, almacen_id, cantidad_actual, ubicacion)
+	values (p_articulo_id, v_almacen_id, 0, nullif(trim(p_ubicacion), ''))
+	on conflict (articulo_id, almacen_id) do update
+	set ubicacion = excluded.ubicacion
+	returning * into v_inventario;
+
+	return jsonb_build_object(
+		'articulo_id', v_inventario.articulo_id,
+		'almacen_id', v_inventario.almacen_id,
+		'ubicacion', v_inventario.ubicacion
+	);
+end;
+$$;
@@ -0,0 +1,75 @@
+-- La toma y su foto del inventario se crean en una sola transacción.
+--
+-- La API insertaba la toma con la hora del servidor de aplicación y después,
+-- en otras llamadas, leía inventarios e insertaba el detalle. Un movimiento
+-- confirmado entre ambos pasos quedaba fuera del teórico y también antes de
+-- fecha_inicio (se perdía), o dentro del teórico y después de fecha_inicio
+-- (se contaba dos veces en tomafisica_corte_view). Ahora fecha_inicio es el
+-- now() de la misma transacción que toma la foto, y la foto espera a los
+-- movimientos en curso del almacén.
+
+create or replace function crear_toma_fisica(p_toma jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_almacen_id bigint := coalesce((p_toma->>'almacen_id')::bigint, almacen_predeterminado());
+	v_categoria_id bigint := (p_toma->>'categoria_id')::bigint;
+	v_toma tomafisica;
+	v_lineas integer;
+begin
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	insert into tomafisica (
+		fecha_inicio, estado, categoria_id, almacen_id, ciega, conteos_requeridos,
+		tolerancia_pct, congelar, usuario_auth0_sub, usuario_correo
+	) values (
+		now(),
+		'abierta',
+		v_categoria_id,
+		v_almacen_id,
+		coalesce((p_toma->>'ciega')::boolean, false),
+		coalesce((p_toma->>'conteos_requeridos')::integer, 1),
+		(p_toma->>'tolerancia_pct')::numeric,
+		coalesce((p_toma->>'congelar')::boolean, false),
+		p_toma->>'usuario_auth0_sub',
+		p_toma->>'usuario_correo'
+	)
+	returning * into v_toma;
+
+	-- El bloqueo compartido espera a que terminen los movimientos que ya
+	-- tienen tomado el inventario del almacén; la foto se lee después y los
+	-- incluye.
+	perform set_config('lock_timeout', '3s', true);
+	begin
+		perform 1 from inventarios where almacen_id = v_almacen_id for share;
+	exception
+		when lock_not_available then
+			raise exception 'El inventario del almacén % está siendo modificado, vuelva a intentar', v_almacen_id
+				using errcode = 'PT409', hint = 'reintentar';
+	end;
+
+	insert into tomafisicadetalle (toma_id, articulo_id, cantidad_teorica, cantidad_real)
+	select v_toma.id, a.id, coalesce(i.cantidad_actual, 0), null
+	from articulos a
+	left join inventarios i on i.articulo_id = a.id and i.almacen_id = v_almacen_id
+	where v_categoria_id is null or a.categoria_id = v_categoria_id
+	order by a.id;
+
+	get diagnostics v_lineas = row_count;
+
+	return jsonb_build_object(
+		'toma_id', v_toma.id,
+		'folio', v_toma.folio,
+		'almacen_id', v_toma.almacen_id,
+		'fecha_inicio', v_toma.fecha_inicio,
+		'ciega', v_toma.ciega,
+		'conteos_requeridos', v_toma.conteos_requeridos,
+		'tolerancia_pct', v_toma.tolerancia_pct,
+		'congelar', v_toma.congelar,
+		'lineas', v_lineas
+	);
+end;
+$$;
@@ -0,0 +1,76 @@
+-- El alta de un artículo y su inventario inicial van en una sola transacción
+-- y el inventario entra por aplicar_movimiento.
+--
+-- La API insertaba el artículo y después escribía inventarios y el
+-- movimiento 'alta' directamente: sin almacén, sin costo del movimiento, sin
+-- series ni lotes y sin revisar si el almacén está congelado por una toma.
+-- Si la segunda escritura fallaba el artículo quedaba sin inventario.
+
+create or replace function crear_articulo(p_articulo jsonb, p_inventario jsonb default '{}'::jsonb)
+returns jsonb
+language plpgsql
+as $$
+declare
+	v_almacen_id bigint := coalesce((p_inventario->>'almacen_id')::bigint, almacen_predeterminado());
+	v_cantidad numeric := coalesce((p_inventario->>'cantidad')::numeric, 0);
+	v_columnas text;
+	v_articulo articulos;
+	v_movimiento jsonb;
+begin
+	if v_cantidad < 0 then
+		raise exception 'El inventario inicial no puede ser negativo' using errcode = 'PT400';
+	end if;
+	if not exists (select 1 from almacenes where id = v_almacen_id and activo) then
+		raise exception 'El almacén % no existe o está inactivo', v_almacen_id using errcode = 'PT422';
+	end if;
+
+	-- Sólo se insertan las columnas que trae el payload; las demás (id,
+	-- fechas) toman su valor por omisión.
+	select string_agg(quote_ident(c.column_name), ', ' order by c.ordinal_position)
+	into v_columnas
+	from information_schema.columns c
+	where c.table_schema = 'public'
+		and c.table_name = 'articulos'
+		and c.column_name <> 'id'
+		and p_articulo ? c.column_name;
+
+	if v_columnas is null then
+		raise exception 'Indique los datos del artículo' using errcode = 'PT400';
+	end if;
+
+	execute format(
+		'insert into articulos (%1$s) select %1$s from jsonb_populate_record(null::articulos, $1) returning *',
+		v_columnas
+	)
+	using p_articulo
+	into v_articulo;
+
+	if v_cantidad > 0 then
+		v_movimiento := aplicar_movimiento(jsonb_build_object(
+			'articulo_id', v_articulo.id,
+			'almacen_id', v_almacen_id,
+			'tipo_movimiento', 'alta',
+			'cantidad', v_cantidad,
+			'delta', v_cantidad,
+			'costo_unitario', v_articulo.costo,
+			'motivo', 'Inventario inicial',
+			'usuario_nombre', p_inventario->>'usuario_nombre',
+			'series', p_inventario->'series',
+			'requiere_series', true,
+			'lote', p_inventario->>'lote',
+			'caducidad', p_inventario->>'caducidad',
+			'lotes', p_inventario->'lotes'
+		));
+	else
+		-- Sin existencias el artículo igual queda dado de alta en el almacén
+		insert into inventarios (articulo_id, almacen_id, cantidad_actual)
+		values (v_articulo.id, v_almacen_id, 0)
+		on conflict (articulo_id, almacen_id) do nothing;
+	end if;
+
+	return to_jsonb(v_articulo) || jsonb_build_object(
+		'almacen_id', v_almacen_id,
+		'movimiento', v_movimiento
+	);
+end;
+$$;
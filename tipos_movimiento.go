@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// obtenerTiposMovimiento carga el registro de tipos de movimiento indexado por
+// clave. Se consulta en cada petición para que los tipos dados de alta o
+// modificados en /api/movimientos/tipos apliquen de inmediato.
+func obtenerTiposMovimiento() (map[string]TipoMovimiento, error) {
+	var tipos []TipoMovimiento
+	if err := supabaseClient.DB.From("tipos_movimiento").Select("*").Execute(&tipos); err != nil {
+		return nil, err
+	}
+
+	registro := make(map[string]TipoMovimiento, len(tipos))
+	for _, t := range tipos {
+		registro[t.Clave] = t
+	}
+	return registro, nil
+}
+
+// validarTipoMovimiento revisa un movimiento capturado a mano contra el
+// registro: que el tipo exista y no sea de sistema, que el usuario tenga el
+// permiso que pide y que traiga motivo si es obligatorio. Devuelve el mensaje
+// y el código HTTP del problema, o un mensaje vacío si todo está en orden.
+func validarTipoMovimiento(tipo TipoMovimiento, existe bool, motivo string, claims *middleware.CustomClaims) (string, int) {
+	if !existe {
+		return "Tipo de movimiento desconocido o no permitido", http.StatusBadRequest
+	}
+	if tipo.SoloSistema {
+		return "El tipo de movimiento " + tipo.Clave + " sólo lo registra el sistema", http.StatusForbidden
+	}
+	if !claims.HasPermission(tipo.Permiso) {
+		return "Insufficient scope.", http.StatusForbidden
+	}
+	if tipo.RequiereMotivo && motivo == "" {
+		return "El tipo de movimiento " + tipo.Clave + " requiere motivo", http.StatusBadRequest
+	}
+	return "", 0
+}
+
+// Handler para /api/movimientos/tipos (GET, POST, PUT). POST da de alta un
+// tipo nuevo; PUT modifica uno existente por su clave. El signo de un tipo que
+// ya tiene movimientos no se puede cambiar (lo impide la base).
+func handleTiposMovimiento(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost && r.Method != http.MethodPut {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		var tipos []TipoMovimiento
+		if err := supabaseClient.DB.From("tipos_movimiento").Select("*").OrderBy("clave", "asc").Execute(&tipos); err != nil {
+			http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		if tipos == nil {
+			tipos = []TipoMovimiento{}
+		}
+
+		json.NewEncoder(w).Encode(tipos)
+		return
+	}
+
+	// POST: crear un tipo; PUT: actualizar uno existente
+	permiso := "create"
+	if r.Method == http.MethodPut {
+		permiso = "update"
+	}
+	if !claims.HasPermission(permiso) {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload TipoMovimientoPayload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	tipo, mensaje := camposTipoMovimiento(payload, r.Method == http.MethodPost)
+	if mensaje != "" {
+		http.Error(w, `{"error":"`+mensaje+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	var results []TipoMovimiento
+	if r.Method == http.MethodPut {
+		err := supabaseClient.DB.From("tipos_movimiento").Update(tipo).Eq("clave", payload.Clave).Execute(&results)
+		if err != nil {
+			responderErrorRPC(w, err)
+			return
+		}
+		if len(results) == 0 {
+			http.Error(w, `{"error":"Tipo de movimiento no encontrado"}`, http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(results[0])
+		return
+	}
+
+	tipo["clave"] = payload.Clave
+	err := supabaseClient.DB.From("tipos_movimiento").Insert(tipo).Execute(&results)
+	if err != nil {
+		if esViolacionUnica(err) {
+			http.Error(w, `{"error":"Ya existe un tipo de movimiento con la clave `+payload.Clave+`"}`, http.StatusConflict)
+			return
+		}
+		http.Error(w, `{"error":"Error al guardar tipo de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	if len(results) > 0 {
+		json.NewEncoder(w).Encode(results[0])
+	} else {
+		json.NewEncoder(w).Encode(payload)
+	}
+}
+
+// camposTipoMovimiento arma las columnas a guardar. Al crear exige etiqueta y
+// signo y el permiso toma "create" por omisión; al editar sólo incluye los
+// campos enviados, para no pisar lo que ya tiene el tipo. solo_sistema nunca
+// se toma del payload.
+func camposTipoMovimiento(payload TipoMovimientoPayload, crear bool) (map[string]interface{}, string) {
+	if payload.Clave == "" {
+		return nil, "Debe indicar la clave"
+	}
+	if crear && (payload.Etiqueta == nil || payload.Signo == nil) {
+		return nil, "Debe indicar clave, etiqueta y signo"
+	}
+
+	tipo := map[string]interface{}{}
+	if payload.Etiqueta != nil {
+		if *payload.Etiqueta == "" {
+			return nil, "La etiqueta no puede estar vacía"
+		}
+		tipo["etiqueta"] = *payload.Etiqueta
+	}
+	if payload.Signo != nil {
+		if *payload.Signo != 1 && *payload.Signo != -1 {
+			return nil, "El signo debe ser 1 (entrada) o -1 (salida)"
+		}
+		tipo["signo"] = *payload.Signo
+	}
+	if payload.RequiereMotivo != nil {
+		tipo["requiere_motivo"] = *payload.RequiereMotivo
+	} else if crear {
+		tipo["requiere_motivo"] = false
+	}
+	if payload.Permiso != nil && *payload.Permiso != "" {
+		tipo["permiso"] = *payload.Permiso
+	} else if crear {
+		tipo["permiso"] = "create"
+	}
+
+	if len(tipo) == 0 {
+		return nil, "No se indicó ningún campo a actualizar"
+	}
+	return tipo, ""
+}
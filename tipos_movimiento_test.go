@@ -0,0 +1,108 @@
+package main
+
+import (
+	"equiposmedicos/middleware"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func TestValidarTipoMovimiento(t *testing.T) {
+	ajuste := TipoMovimiento{Clave: "ajuste_toma", Signo: 1, RequiereMotivo: true, Permiso: "update", SoloSistema: true}
+	merma := TipoMovimiento{Clave: "merma", Signo: -1, RequiereMotivo: true, Permiso: "update"}
+	entrada := TipoMovimiento{Clave: "entrada", Signo: 1, Permiso: "create"}
+
+	todos := &middleware.CustomClaims{Permissions: []string{"read", "create", "update", "delete"}}
+	soloCrear := &middleware.CustomClaims{Permissions: []string{"read", "create"}}
+
+	casos := []struct {
+		nombre string
+		tipo   TipoMovimiento
+		existe bool
+		motivo string
+		claims *middleware.CustomClaims
+		status int
+	}{
+		{"tipo desconocido", TipoMovimiento{}, false, "x", todos, http.StatusBadRequest},
+		{"ajuste de toma a mano aun con todos los permisos", ajuste, true, "conteo", todos, http.StatusForbidden},
+		{"sin el permiso del tipo", merma, true, "rota", soloCrear, http.StatusForbidden},
+		{"falta motivo obligatorio", merma, true, "", todos, http.StatusBadRequest},
+		{"merma con motivo", merma, true, "rota", todos, 0},
+		{"entrada sin motivo", entrada, true, "", soloCrear, 0},
+	}
+
+	for _, c := range casos {
+		mensaje, status := validarTipoMovimiento(c.tipo, c.existe, c.motivo, c.claims)
+		if status != c.status {
+			t.Errorf("%s: status %d (%q), se esperaba %d", c.nombre, status, mensaje, c.status)
+		}
+		if (status == 0) != (mensaje == "") {
+			t.Errorf("%s: mensaje %q no corresponde al status %d", c.nombre, mensaje, status)
+		}
+	}
+}
+
+func TestCamposTipoMovimiento(t *testing.T) {
+	texto := func(v string) *string { return &v }
+	entero := func(v int) *int { return &v }
+	verdadero := true
+
+	casos := []struct {
+		nombre   string
+		payload  TipoMovimientoPayload
+		crear    bool
+		esperado map[string]interface{}
+		falla    bool
+	}{
+		{
+			nombre:   "alta con permiso por omisión",
+			payload:  TipoMovimientoPayload{Clave: "donacion", Etiqueta: texto("Donación"), Signo: entero(1)},
+			crear:    true,
+			esperado: map[string]interface{}{"etiqueta": "Donación", "signo": 1, "requiere_motivo": false, "permiso": "create"},
+		},
+		{
+			nombre:  "alta sin signo",
+			payload: TipoMovimientoPayload{Clave: "donacion", Etiqueta: texto("Donación")},
+			crear:   true,
+			falla:   true,
+		},
+		{
+			nombre:   "edición conserva el permiso que no se envió",
+			payload:  TipoMovimientoPayload{Clave: "merma", Etiqueta: texto("Merma")},
+			esperado: map[string]interface{}{"etiqueta": "Merma"},
+		},
+		{
+			nombre:   "edición de sólo requiere_motivo",
+			payload:  TipoMovimientoPayload{Clave: "merma", RequiereMotivo: &verdadero},
+			esperado: map[string]interface{}{"requiere_motivo": true},
+		},
+		{
+			nombre:  "edición con signo inválido",
+			payload: TipoMovimientoPayload{Clave: "merma", Signo: entero(0)},
+			falla:   true,
+		},
+		{
+			nombre:  "edición sin campos",
+			payload: TipoMovimientoPayload{Clave: "merma"},
+			falla:   true,
+		},
+	}
+
+	for _, c := range casos {
+		t.Run(c.nombre, func(t *testing.T) {
+			tipo, mensaje := camposTipoMovimiento(c.payload, c.crear)
+			if c.falla {
+				if mensaje == "" {
+					t.Fatalf("se esperaba error, se obtuvo %v", tipo)
+				}
+				return
+			}
+			if mensaje != "" {
+				t.Fatalf("error inesperado: %s", mensaje)
+			}
+			if !reflect.DeepEqual(tipo, c.esperado) {
+				t.Errorf("se obtuvo %v, se esperaba %v", tipo, c.esperado)
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+	"strconv"
+	"strings"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Handler para /api/inventario/tomas/{id}/{accion}. Reparte a cada operación
+// sobre una toma según el último segmento de la ruta.
+func handleTomas(w http.ResponseWriter, r *http.Request) {
+	partes := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/inventario/tomas/"), "/")
+	if len(partes) != 2 {
+		http.Error(w, `{"error":"Ruta no encontrada"}`, http.StatusNotFound)
+		return
+	}
+	tomaID, err := strconv.Atoi(partes[0])
+	if err != nil || tomaID <= 0 {
+		http.Error(w, `{"error":"ID de toma inválido"}`, http.StatusBadRequest)
+		return
+	}
+
+	switch partes[1] {
+	case "estado":
+		handleEstadoToma(w, r, tomaID)
+	case "transiciones":
+		handleTransicionesToma(w, r, tomaID)
+	case "escaneo":
+		handleEscaneoToma(w, r, tomaID)
+	case "reconteo":
+		handleReconteoToma(w, r, tomaID)
+	case "reporte":
+		handleReporteToma(w, r, tomaID)
+	case "hojas.pdf":
+		handleHojasConteo(w, r, tomaID)
+	default:
+		http.Error(w, `{"error":"Ruta no encontrada"}`, http.StatusNotFound)
+	}
+}
+
+// PUT /api/inventario/tomas/{id}/estado con {"estado": "...", "motivo": "..."}.
+// Estados: abierta -> en_conteo -> en_revision -> cerrada, con regreso de
+// en_revision a en_conteo y cancelada desde cualquiera sin cerrar.
+func handleEstadoToma(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodPut {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	var payload struct {
+		Estado string `json:"estado"`
+		Motivo string `json:"motivo"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Cancelar requiere el mismo permiso que antes tenía eliminar la toma
+	permiso := "update"
+	switch payload.Estado {
+	case "en_conteo", "en_revision", "cerrada":
+	case "cancelada":
+		permiso = "delete"
+	default:
+		http.Error(w, `{"error":"Estado inválido; use en_conteo, en_revision, cerrada o cancelada"}`, http.StatusBadRequest)
+		return
+	}
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission(permiso) {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	cambiarEstadoToma(w, tomaID, payload.Estado, payload.Motivo, claims)
+}
+
+// cambiarEstadoToma aplica la transición en la base, que valida que sea
+// permitida y la registra, y responde al cliente. Al cerrar se incluye el
+// resumen de los ajustes de inventario.
+func cambiarEstadoToma(w http.ResponseWriter, tomaID int, estado, motivo string, claims *middleware.CustomClaims) {
+	params := map[string]interface{}{
+		"p_toma_id":        tomaID,
+		"p_estado":         estado,
+		"p_usuario_sub":    claims.Subject,
+		"p_usuario_correo": claims.Email,
+	}
+	if motivo != "" {
+		params["p_motivo"] = motivo
+	}
+
+	var resultado CambioEstadoToma
+	if err := supabaseClient.DB.Rpc("cambiar_estado_toma", params).Execute(&resultado); err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	if len(resultado.Reconteo) > 0 {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":    "Hay líneas por recontar antes de pasar a revisión",
+			"toma_id":  resultado.TomaID,
+			"folio":    resultado.Folio,
+			"estado":   resultado.Estado,
+			"reconteo": resultado.Reconteo,
+		})
+		return
+	}
+
+	respuesta := map[string]interface{}{
+		"toma_id":         resultado.TomaID,
+		"folio":           resultado.Folio,
+		"almacen_id":      resultado.AlmacenID,
+		"estado_anterior": resultado.EstadoAnterior,
+		"estado":          resultado.Estado,
+	}
+
+	switch estado {
+	case "cerrada":
+		if resultado.Ajustes == nil {
+			resultado.Ajustes = []AjusteToma{}
+		}
+
+		// Resumen de los ajustes para quien cierra
+		sobrante, faltante, valor := 0.0, 0.0, 0.0
+		for _, a := range resultado.Ajustes {
+			if a.Ajuste > 0 {
+				sobrante += a.Ajuste
+			} else {
+				faltante -= a.Ajuste
+			}
+			valor += a.Ajuste * a.CostoPromedio
+		}
+
+		respuesta["message"] = "Toma física finalizada y cerrada correctamente"
+		respuesta["ajustes"] = resultado.Ajustes
+		respuesta["total_ajustes"] = len(resultado.Ajustes)
+		respuesta["unidades_sobrantes"] = sobrante
+		respuesta["unidades_faltantes"] = faltante
+		respuesta["valor_ajuste"] = valor
+	case "cancelada":
+		respuesta["message"] = "Toma física cancelada correctamente"
+	default:
+		respuesta["message"] = "Estado de la toma actualizado"
+	}
+
+	json.NewEncoder(w).Encode(respuesta)
+}
+
+// GET /api/inventario/tomas/{id}/transiciones: historial de estados de la toma
+func handleTransicionesToma(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var transiciones []TransicionToma
+	err := supabaseClient.DB.
+		From("tomafisica_transiciones").
+		Select("*").
+		OrderBy("created_at", "asc").
+		Eq("toma_id", strconv.Itoa(tomaID)).
+		Execute(&transiciones)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener transiciones: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if transiciones == nil {
+		transiciones = []TransicionToma{}
+	}
+
+	json.NewEncoder(w).Encode(transiciones)
+}
+
+// /api/inventario/tomas/{id}/escaneo. POST registra una lectura
+// {"codigo_barras": "...", "cantidad": 1} y suma la cantidad (1 si se omite)
+// al conteo del artículo. Los códigos desconocidos o de artículos que no
+// están en la toma se registran y se informan con 404 y 422. GET lista las
+// lecturas que no se pudieron contar, agrupadas por código.
+func handleEscaneoToma(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+
+	if r.Method == http.MethodGet {
+		if !claims.HasPermission("read") {
+			http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+			return
+		}
+
+		var escaneos []EscaneoToma
+		err := supabaseClient.DB.
+			From("tomafisica_escaneos").
+			Select("*").
+			OrderBy("created_at", "asc").
+			Eq("toma_id", strconv.Itoa(tomaID)).
+			Neq("resultado", "contado").
+			Execute(&escaneos)
+		if err != nil {
+			http.Error(w, `{"error":"Error al obtener escaneos: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+
+		// Una fila por código y resultado con el total leído
+		rechazados := []map[string]interface{}{}
+		indice := map[string]int{}
+		for _, e := range escaneos {
+			clave := e.Resultado + "|" + e.CodigoBarras
+			i, existe := indice[clave]
+			if !existe {
+				i = len(rechazados)
+				indice[clave] = i
+				rechazados = append(rechazados, map[string]interface{}{
+					"codigo_barras": e.CodigoBarras,
+					"resultado":     e.Resultado,
+					"articulo_id":   e.ArticuloID,
+					"lecturas":      0,
+					"cantidad":      0.0,
+				})
+			}
+			rechazados[i]["lecturas"] = rechazados[i]["lecturas"].(int) + 1
+			rechazados[i]["cantidad"] = rechazados[i]["cantidad"].(float64) + e.Cantidad
+		}
+
+		json.NewEncoder(w).Encode(rechazados)
+		return
+	}
+
+	// POST: registrar lectura
+	if !claims.HasPermission("update") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var payload struct {
+		CodigoBarras string   `json:"codigo_barras"`
+		Cantidad     *float64 `json:"cantidad,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, `{"error":"JSON inválido: `+err.Error()+`"}`, http.StatusBadRequest)
+		return
+	}
+	payload.CodigoBarras = strings.TrimSpace(payload.CodigoBarras)
+	if payload.CodigoBarras == "" {
+		http.Error(w, `{"error":"Debe indicar codigo_barras"}`, http.StatusBadRequest)
+		return
+	}
+	cantidad := 1.0
+	if payload.Cantidad != nil {
+		cantidad = *payload.Cantidad
+	}
+	if cantidad == 0 {
+		http.Error(w, `{"error":"La cantidad no puede ser cero"}`, http.StatusBadRequest)
+		return
+	}
+
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("escanear_toma", map[string]interface{}{
+		"p_toma_id":        tomaID,
+		"p_codigo_barras":  payload.CodigoBarras,
+		"p_cantidad":       cantidad,
+		"p_usuario_sub":    claims.Subject,
+		"p_usuario_correo": claims.Email,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	switch resultado["resultado"] {
+	case "desconocido":
+		resultado["error"] = "Código de barras desconocido"
+		w.WriteHeader(http.StatusNotFound)
+	case "fuera_de_categoria":
+		resultado["error"] = "El artículo no pertenece a la categoría de la toma"
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	case "fuera_de_toma":
+		resultado["error"] = "El artículo no forma parte de la toma"
+		w.WriteHeader(http.StatusUnprocessableEntity)
+	}
+
+	json.NewEncoder(w).Encode(resultado)
+}
+
+// GET /api/inventario/tomas/{id}/reconteo: líneas marcadas para recontar. No
+// incluye cantidades para no revelar lo teórico en tomas ciegas.
+func handleReconteoToma(w http.ResponseWriter, r *http.Request, tomaID int) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	var lineas []LineaReconteo
+	err := supabaseClient.DB.
+		From("tomafisica_reconteo_view").
+		Select("*").
+		OrderBy("nombre", "asc").
+		Eq("toma_id", strconv.Itoa(tomaID)).
+		Execute(&lineas)
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener líneas por recontar: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	if lineas == nil {
+		lineas = []LineaReconteo{}
+	}
+
+	json.NewEncoder(w).Encode(lineas)
+}
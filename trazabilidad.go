@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"equiposmedicos/middleware"
+	"net/http"
+	"strconv"
+
+	jwtmiddleware "github.com/auth0/go-jwt-middleware/v2"
+	"github.com/auth0/go-jwt-middleware/v2/validator"
+)
+
+// Handler para /api/trazabilidad?lote=X o ?serie=X (GET). Para un retiro de
+// producto devuelve las ventas que se llevaron ese lote o serie, con los datos
+// de contacto del cliente, y lo que aún queda en nuestros almacenes. Con
+// ?articulo_id se acota a un artículo (dos fabricantes pueden repetir un lote)
+// y con ?formato=csv se descarga para entregarlo a la autoridad sanitaria.
+func handleTrazabilidad(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	// Validación de token y permisos
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
+		return
+	}
+
+	lote := r.URL.Query().Get("lote")
+	serie := r.URL.Query().Get("serie")
+	if (lote == "") == (serie == "") {
+		http.Error(w, `{"error":"Indique lote o serie"}`, http.StatusBadRequest)
+		return
+	}
+	columna, valor := "lote", lote
+	if serie != "" {
+		columna, valor = "numero_serie", serie
+	}
+
+	articuloID := r.URL.Query().Get("articulo_id")
+	if articuloID != "" {
+		if _, err := strconv.Atoi(articuloID); err != nil {
+			http.Error(w, `{"error":"articulo_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+	}
+
+	ventasQuery := supabaseClient.DB.
+		From("trazabilidad_ventas").
+		Select("*").
+		OrderBy("fecha_venta", "asc").
+		Eq(columna, valor)
+	if articuloID != "" {
+		ventasQuery.Eq("articulo_id", articuloID)
+	}
+	var ventas []TrazabilidadVenta
+	if err := ventasQuery.Execute(&ventas); err != nil {
+		http.Error(w, `{"error":"Error al obtener ventas: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	existenciasQuery := supabaseClient.DB.
+		From("trazabilidad_existencias").
+		Select("*").
+		OrderBy("almacen_id", "asc").
+		Eq(columna, valor)
+	if articuloID != "" {
+		existenciasQuery.Eq("articulo_id", articuloID)
+	}
+	var existencias []TrazabilidadExistencia
+	if err := existenciasQuery.Execute(&existencias); err != nil {
+		http.Error(w, `{"error":"Error al obtener existencias: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+
+	if r.URL.Query().Get("formato") == "csv" {
+		escribirTrazabilidadCSV(w, ventas, existencias)
+		return
+	}
+
+	if ventas == nil {
+		ventas = []TrazabilidadVenta{}
+	}
+	if existencias == nil {
+		existencias = []TrazabilidadExistencia{}
+	}
+
+	totalVendido, totalExistencia := 0.0, 0.0
+	for _, v := range ventas {
+		totalVendido += v.Cantidad
+	}
+	for _, e := range existencias {
+		totalExistencia += e.Cantidad
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		columna:            valor,
+		"ventas":           ventas,
+		"existencias":      existencias,
+		"total_vendido":    totalVendido,
+		"total_existencia": totalExistencia,
+	})
+}
+
+// Un solo archivo con una fila por venta afectada y otra por cada almacén
+// donde quedan unidades; la columna tipo las distingue.
+func escribirTrazabilidadCSV(w http.ResponseWriter, ventas []TrazabilidadVenta, existencias []TrazabilidadExistencia) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="trazabilidad.csv"`)
+
+	texto := func(s *string) string {
+		if s == nil {
+			return ""
+		}
+		return *s
+	}
+	cantidad := func(c float64) string {
+		return strconv.FormatFloat(c, 'f', -1, 64)
+	}
+
+	escritor := csv.NewWriter(w)
+	escritor.Write([]string{
+		"tipo", "venta_id", "fecha_venta", "cliente_nombre", "cliente_razon_social",
+		"cliente_telefono", "cliente_correo", "almacen", "articulo_id", "articulo",
+		"marca", "lote", "caducidad", "numero_serie", "cantidad",
+	})
+	for _, v := range ventas {
+		escritor.Write([]string{
+			"venta", strconv.Itoa(v.VentaID), v.FechaVenta, v.ClienteNombre, v.ClienteRazonSocial,
+			v.ClienteTelefono, v.ClienteCorreo, "", strconv.Itoa(v.ArticuloID), v.ArticuloNombre,
+			v.Marca, texto(v.Lote), texto(v.Caducidad), texto(v.NumeroSerie), cantidad(v.Cantidad),
+		})
+	}
+	for _, e := range existencias {
+		escritor.Write([]string{
+			"existencia", "", "", "", "",
+			"", "", e.AlmacenNombre, strconv.Itoa(e.ArticuloID), e.ArticuloNombre,
+			e.Marca, texto(e.Lote), texto(e.Caducidad), texto(e.NumeroSerie), cantidad(e.Cantidad),
+		})
+	}
+	escritor.Flush()
+}
@@ -37,13 +37,42 @@ func handleRegistrarVenta(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Calcular total
+	// Validar líneas, calcular total y el movimiento de inventario de cada una
+	tipos, err := obtenerTiposMovimiento()
+	if err != nil {
+		http.Error(w, `{"error":"Error al obtener tipos de movimiento: `+err.Error()+`"}`, http.StatusInternalServerError)
+		return
+	}
+	tipo, ok := tipos["venta"]
+	if !ok {
+		http.Error(w, `{"error":"Tipo de movimiento venta no registrado"}`, http.StatusInternalServerError)
+		return
+	}
 	total := 0.0
-	for _, item := range payload.Articulos {
+	articulos := make([]map[string]interface{}, 0, len(payload.Articulos))
+	for i, item := range payload.Articulos {
+		if item.ArticuloID <= 0 || item.Cantidad <= 0 {
+			http.Error(w, `{"error":"Artículo inválido en la línea `+strconv.Itoa(i+1)+`"}`, http.StatusBadRequest)
+			return
+		}
+		if len(item.Series) > 0 && len(item.Series) != item.Cantidad {
+			http.Error(w, `{"error":"La línea `+strconv.Itoa(i+1)+` debe traer un número de serie por unidad"}`, http.StatusBadRequest)
+			return
+		}
 		total += item.PrecioUnitario * float64(item.Cantidad)
+		articulos = append(articulos, map[string]interface{}{
+			"articulo_id":     item.ArticuloID,
+			"cantidad":        item.Cantidad,
+			"precio_unitario": item.PrecioUnitario,
+			"delta":           tipo.Signo * item.Cantidad,
+			"series":          item.Series,
+			"lote":            item.Lote,
+			"reserva_id":      item.ReservaID,
+			"almacen_id":      item.AlmacenID,
+		})
 	}
 
-	// Insertar venta principal
+	// Registrar venta, detalles, pagos y movimientos en una sola transacción
 	venta := map[string]interface{}{
 		"cliente_nombre":       payload.ClienteNombre,
 		"cliente_razon_social": payload.ClienteRazonSocial,
@@ -53,48 +82,32 @@ func handleRegistrarVenta(w http.ResponseWriter, r *http.Request) {
 		"requiere_factura":     payload.RequiereFactura,
 		"notas":                payload.Notas,
 		"total":                total,
+		"usuario_nombre":       claims.Email,
 	}
-
-	var ventaResult []map[string]interface{}
-	if err := supabaseClient.DB.From("ventas").Insert(venta).Execute(&ventaResult); err != nil || len(ventaResult) == 0 {
-		http.Error(w, `{"error":"Error al crear venta: `+err.Error()+`"}`, http.StatusInternalServerError)
-		return
+	pagos := payload.Pagos
+	if pagos == nil {
+		pagos = []Pago{}
 	}
 
-	ventaID := ventaResult[0]["id"].(float64)
-
-	// Insertar detalles de venta
-	for _, item := range payload.Articulos {
-		detalle := map[string]interface{}{
-			"venta_id":        ventaID,
-			"articulo_id":     item.ArticuloID,
-			"cantidad":        item.Cantidad,
-			"precio_unitario": item.PrecioUnitario,
-		}
-		if err := supabaseClient.DB.From("ventas_detalle").Insert(detalle).Execute(nil); err != nil {
-			http.Error(w, `{"error":"Error al insertar detalle: `+err.Error()+`"}`, http.StatusInternalServerError)
-			return
-		}
+	var ventaResult map[string]interface{}
+	err = supabaseClient.DB.Rpc("registrar_venta", map[string]interface{}{
+		"p_venta":     venta,
+		"p_articulos": articulos,
+		"p_pagos":     pagos,
+	}).Execute(&ventaResult)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
 	}
 
-	// Insertar pagos (fecha se genera automáticamente)
-	for _, pago := range payload.Pagos {
-		pagoMap := map[string]interface{}{
-			"venta_id":    ventaID,
-			"monto":       pago.Monto,
-			"metodo_pago": pago.MetodoPago,
-		}
-		if err := supabaseClient.DB.From("pagos").Insert(pagoMap).Execute(nil); err != nil {
-			http.Error(w, `{"error":"Error al insertar pago: `+err.Error()+`"}`, http.StatusInternalServerError)
-			return
-		}
-	}
+	ventaID := ventaResult["venta_id"].(float64)
 
 	// Respuesta exitosa
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":  "Venta registrada correctamente",
-		"venta_id": ventaID,
-		"total":    total,
+		"message":    "Venta registrada correctamente",
+		"venta_id":   ventaID,
+		"total":      total,
+		"backorders": ventaResult["backorders"],
 	})
 }
 
@@ -195,12 +208,15 @@ func handleEliminarVenta(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Eliminar la venta
-	if err := supabaseClient.DB.From("ventas").
-		Delete().
-		Eq("id", strconv.Itoa(payload.VentaID)).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al eliminar venta: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Eliminar la venta y revertir en inventario lo que descontó en una sola
+	// transacción; la base compara contra las líneas con la venta bloqueada
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("eliminar_venta", map[string]interface{}{
+		"p_venta_id":       payload.VentaID,
+		"p_usuario_nombre": claims.Email,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
 		return
 	}
 
@@ -252,7 +268,16 @@ func handleEditarVenta(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	ventaIDStr := strconv.Itoa(payload.VentaID)
+	for i, item := range payload.Articulos {
+		if item.ArticuloID <= 0 || item.Cantidad <= 0 {
+			http.Error(w, `{"error":"Artículo inválido en la línea `+strconv.Itoa(i+1)+`"}`, http.StatusBadRequest)
+			return
+		}
+		if len(item.Series) > 0 && len(item.Series) != item.Cantidad {
+			http.Error(w, `{"error":"La línea `+strconv.Itoa(i+1)+` debe traer un número de serie por unidad"}`, http.StatusBadRequest)
+			return
+		}
+	}
 
 	updateVenta := map[string]interface{}{
 		"cliente_nombre":       payload.ClienteNombre,
@@ -261,42 +286,144 @@ func handleEditarVenta(w http.ResponseWriter, r *http.Request) {
 		"cliente_telefono":     payload.ClienteTelefono,
 		"cliente_correo":       payload.ClienteCorreo,
 		"notas":                payload.Notas,
+		"usuario_nombre":       claims.Email,
 	}
 
-	if err := supabaseClient.DB.From("ventas").
-		Update(updateVenta).
-		Eq("id", ventaIDStr).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al actualizar venta: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Actualizar cabecera, reemplazar detalles y compensar en inventario sólo
+	// la diferencia contra las líneas anteriores, en una sola transacción
+	var resultado map[string]interface{}
+	err := supabaseClient.DB.Rpc("editar_venta", map[string]interface{}{
+		"p_venta_id":  payload.VentaID,
+		"p_venta":     updateVenta,
+		"p_articulos": payload.Articulos,
+	}).Execute(&resultado)
+	if err != nil {
+		responderErrorRPC(w, err)
+		return
+	}
+
+	// Responder éxito
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Venta editada correctamente",
+		"venta_id": payload.VentaID,
+	})
+}
+
+// Retorna el margen de cada venta usando el costo capturado en cada línea al
+// momento de la venta. Las líneas anteriores al motor de costo promedio no
+// tienen costo guardado y se valúan con el costo actual del artículo.
+func handleReporteMargenes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, `{"message":"Método no permitido"}`, http.StatusMethodNotAllowed)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
 
-	// Borrar detalles anteriores
-	if err := supabaseClient.DB.From("ventas_detalle").
-		Delete().
-		Eq("venta_id", ventaIDStr).
-		Execute(nil); err != nil {
-		http.Error(w, `{"error":"Error al eliminar detalles: `+err.Error()+`"}`, http.StatusInternalServerError)
+	// Validación de permisos
+	token := r.Context().Value(jwtmiddleware.ContextKey{}).(*validator.ValidatedClaims)
+	claims := token.CustomClaims.(*middleware.CustomClaims)
+	if !claims.HasPermission("read") {
+		http.Error(w, `{"message":"Insufficient scope."}`, http.StatusForbidden)
 		return
 	}
 
-	// Insertar nuevos detalles
-	for _, item := range payload.Articulos {
-		detalle := map[string]interface{}{
-			"venta_id":        payload.VentaID,
-			"articulo_id":     item.ArticuloID,
-			"cantidad":        item.Cantidad,
-			"precio_unitario": item.PrecioUnitario,
+	ventaID := ""
+	if ventaIDStr := r.URL.Query().Get("venta_id"); ventaIDStr != "" {
+		id, err := strconv.Atoi(ventaIDStr)
+		if err != nil {
+			http.Error(w, `{"error":"venta_id inválido"}`, http.StatusBadRequest)
+			return
+		}
+		ventaID = strconv.Itoa(id)
+	}
+
+	// Se pagina para no quedar corto por el máximo de filas de Supabase
+	const tamanoPagina = 1000
+
+	type lineaMargen struct {
+		VentaID        int      `json:"venta_id"`
+		ArticuloID     int      `json:"articulo_id"`
+		Cantidad       int      `json:"cantidad"`
+		PrecioUnitario float64  `json:"precio_unitario"`
+		CostoUnitario  *float64 `json:"costo_unitario"`
+	}
+	detalles := []lineaMargen{}
+	for inicio := 0; ; inicio += tamanoPagina {
+		query := &supabaseClient.DB.
+			From("ventas_detalle").
+			Select("venta_id", "articulo_id", "cantidad", "precio_unitario", "costo_unitario").
+			OrderBy("venta_id,id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			FilterRequestBuilder
+		if ventaID != "" {
+			query = query.Eq("venta_id", ventaID)
 		}
-		if err := supabaseClient.DB.From("ventas_detalle").Insert(detalle).Execute(nil); err != nil {
-			http.Error(w, `{"error":"Error al insertar detalle: `+err.Error()+`"}`, http.StatusInternalServerError)
+
+		var pagina []lineaMargen
+		if err := query.Execute(&pagina); err != nil {
+			http.Error(w, `{"error":"Error al obtener detalles de venta: `+err.Error()+`"}`, http.StatusInternalServerError)
 			return
 		}
+		detalles = append(detalles, pagina...)
+		if len(pagina) < tamanoPagina {
+			break
+		}
 	}
 
-	// Responder éxito
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"message":  "Venta editada correctamente",
-		"venta_id": payload.VentaID,
-	})
+	// Costo actual, sólo para líneas sin costo capturado
+	costoActual := map[int]float64{}
+	for inicio := 0; ; inicio += tamanoPagina {
+		var pagina []InventarioArticulo
+		err := supabaseClient.DB.
+			From("articulos").
+			Select("id", "costo").
+			OrderBy("id", "asc").
+			LimitWithOffset(tamanoPagina, inicio).
+			Execute(&pagina)
+		if err != nil {
+			http.Error(w, `{"error":"Error al obtener artículos: `+err.Error()+`"}`, http.StatusInternalServerError)
+			return
+		}
+		for _, a := range pagina {
+			costoActual[a.ID] = a.Costo
+		}
+		if len(pagina) < tamanoPagina {
+			break
+		}
+	}
+
+	type margenVenta struct {
+		VentaID          int     `json:"venta_id"`
+		Ingreso          float64 `json:"ingreso"`
+		Costo            float64 `json:"costo"`
+		Margen           float64 `json:"margen"`
+		MargenPorcentaje float64 `json:"margen_porcentaje"`
+		CostoEstimado    bool    `json:"costo_estimado"`
+	}
+	margenes := []*margenVenta{}
+	porVenta := map[int]*margenVenta{}
+	for _, d := range detalles {
+		m, ok := porVenta[d.VentaID]
+		if !ok {
+			m = &margenVenta{VentaID: d.VentaID}
+			porVenta[d.VentaID] = m
+			margenes = append(margenes, m)
+		}
+		costo := costoActual[d.ArticuloID]
+		if d.CostoUnitario != nil {
+			costo = *d.CostoUnitario
+		} else {
+			m.CostoEstimado = true
+		}
+		m.Ingreso += d.PrecioUnitario * float64(d.Cantidad)
+		m.Costo += costo * float64(d.Cantidad)
+	}
+	for _, m := range margenes {
+		m.Margen = m.Ingreso - m.Costo
+		if m.Ingreso != 0 {
+			m.MargenPorcentaje = m.Margen / m.Ingreso * 100
+		}
+	}
+
+	json.NewEncoder(w).Encode(margenes)
 }